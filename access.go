@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// accessPrefix holds the owners and tokens of every project, one object per project
+	accessPrefix = internalPrefix + "access/"
+)
+
+// tokenPrefix starts every package token. The project name follows it and
+// then the secret, separated by dots, which normalised names never contain.
+const tokenPrefix = "gopi."
+
+// Roles on a project. Owners and maintainers may upload, yank and delete
+// releases and create tokens, only owners may change who has a role.
+const (
+	roleOwner      = "owner"
+	roleMaintainer = "maintainer"
+)
+
+var (
+	// errLastOwner is returned when a change would leave a project without owners
+	errLastOwner = errors.New("a project needs at least one owner")
+	// errAnonymousProject is returned when an anonymous client uploads a new project
+	errAnonymousProject = fmt.Errorf("%w, new projects need an identified uploader to own them", NotAllowed)
+	// errUnownedProject is returned for uploads to a project with files but
+	// without owners when clients can identify themselves
+	errUnownedProject = fmt.Errorf("%w, the project has no owner to allow uploads", NotAllowed)
+	// errAccessUnchanged makes updateAccess leave a project as it is
+	errAccessUnchanged = errors.New("access unchanged")
+)
+
+// projectAccess is who may manage a project
+type projectAccess struct {
+	Owners      []string       `json:"owners"`
+	Maintainers []string       `json:"maintainers"`
+	Tokens      []projectToken `json:"tokens"`
+}
+
+// projectToken lets tools such as twine upload a single project on behalf of its creator
+type projectToken struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hash is the hex encoded SHA256 hash of the token, the token itself is only shown once
+	Hash    string    `json:"hash"`
+	Creator string    `json:"creator"`
+	Created time.Time `json:"created"`
+}
+
+func accessObjectKey(name string) string {
+	return accessPrefix + name + ".json"
+}
+
+// isOwner reports whether name owns the project
+func (pa projectAccess) isOwner(name string) bool {
+	return contains(pa.Owners, name)
+}
+
+// role returns the role of name on the project, empty if it has none
+func (pa projectAccess) role(name string) string {
+	switch {
+	case pa.isOwner(name):
+		return roleOwner
+	case contains(pa.Maintainers, name):
+		return roleMaintainer
+	}
+	return ""
+}
+
+// claimed reports whether the project has an owner. Projects uploaded
+// before gopi recorded owners, or first uploaded anonymously, have none until
+// an admin assigns one.
+func (pa projectAccess) claimed() bool {
+	return len(pa.Owners) > 0
+}
+
+// allows reports whether name may act on the project with role. Nobody may
+// manage a project nobody has claimed.
+func (pa projectAccess) allows(name, role string) bool {
+	if role == roleOwner {
+		return pa.isOwner(name)
+	}
+	return pa.role(name) != ""
+}
+
+func contains(list []string, name string) bool {
+	for _, n := range list {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func without(list []string, name string) []string {
+	var rest []string
+	for _, n := range list {
+		if n != name {
+			rest = append(rest, n)
+		}
+	}
+	return rest
+}
+
+// readAccess reads who may manage a project, nobody is recorded for new projects
+func (s *server) readAccess(ctx context.Context, name string) (projectAccess, error) {
+	var pa projectAccess
+	data, err := s.getObject(ctx, accessObjectKey(name))
+	if errors.Is(err, NoSuchKey) {
+		return pa, nil
+	}
+	if err != nil {
+		return pa, err
+	}
+	err = json.Unmarshal(data, &pa)
+	if err != nil {
+		return pa, fmt.Errorf("Failed to parse %s, %s", accessObjectKey(name), err.Error())
+	}
+	return pa, nil
+}
+
+// updateAccess changes who may manage a project. update is called with the
+// latest copy from the bucket and again if another replica changed it before
+// it could be written. Nothing is written if update returns an error,
+// errAccessUnchanged leaves the project as it is without failing.
+func (s *server) updateAccess(ctx context.Context, name string, update func(*projectAccess) error) error {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+	err := s.updateObject(ctx, accessObjectKey(name), "application/json", func(data []byte) ([]byte, error) {
+		var pa projectAccess
+		if data != nil {
+			err := json.Unmarshal(data, &pa)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse %s, %s", accessObjectKey(name), err.Error())
+			}
+		}
+		err := update(&pa)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(pa.Owners)
+		sort.Strings(pa.Maintainers)
+		return json.Marshal(pa)
+	})
+	if errors.Is(err, errAccessUnchanged) {
+		return nil
+	}
+	return err
+}
+
+// authorizeUpload returns NotAllowed unless uploader may upload to the
+// project, and whether the upload creates the project so uploader has to
+// claim it with claimProject once the file is published. When clients can
+// identify themselves anonymous uploads can't create projects, nobody could
+// manage them, and unclaimed projects that already have files don't accept
+// uploads until an admin assigns an owner. Otherwise nobody owns anything
+// and anyone allowed to upload may.
+func (s *server) authorizeUpload(ctx context.Context, name string, uploader identity) (bool, error) {
+	pa, err := s.readAccess(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if pa.claimed() {
+		if !pa.allows(uploader.name, roleMaintainer) {
+			return false, NotAllowed
+		}
+		return false, nil
+	}
+	pr, err := s.readProject(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if len(pr.Releases) > 0 {
+		if s.cfg.identified {
+			return false, errUnownedProject
+		}
+		return false, nil
+	}
+	if uploader.name == "" {
+		if s.cfg.identified {
+			return false, errAnonymousProject
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// claimProject makes uploader the owner of the new project it uploaded.
+// NotAllowed is returned if another client claimed it first.
+func (s *server) claimProject(ctx context.Context, name string, uploader identity) error {
+	claimed := false
+	err := s.updateAccess(ctx, name, func(pa *projectAccess) error {
+		claimed = false
+		if pa.claimed() {
+			// Claimed by another upload since it was read
+			if !pa.allows(uploader.name, roleMaintainer) {
+				return NotAllowed
+			}
+			return errAccessUnchanged
+		}
+		pa.Owners = []string{uploader.name}
+		claimed = true
+		return nil
+	})
+	if err != nil || !claimed {
+		return err
+	}
+	logger(ctx).Info("Claimed project", "package", name, "owner", uploader.name)
+	s.logChange(ctx, name, "", fmt.Sprintf(actionAddRole, roleOwner, uploader.name))
+	return nil
+}
+
+// addRole gives user a role on the project, replacing the role it had
+func (s *server) addRole(ctx context.Context, name, user, role string) error {
+	err := s.updateAccess(ctx, name, func(pa *projectAccess) error {
+		owners := without(pa.Owners, user)
+		maintainers := without(pa.Maintainers, user)
+		if role == roleOwner {
+			owners = append(owners, user)
+		} else {
+			maintainers = append(maintainers, user)
+		}
+		if pa.claimed() && len(owners) == 0 {
+			return errLastOwner
+		}
+		pa.Owners, pa.Maintainers = owners, maintainers
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.logChange(ctx, name, "", fmt.Sprintf(actionAddRole, role, user))
+	return nil
+}
+
+// removeRole takes the role of user on the project away
+func (s *server) removeRole(ctx context.Context, name, user string) error {
+	role := ""
+	err := s.updateAccess(ctx, name, func(pa *projectAccess) error {
+		role = pa.role(user)
+		owners := without(pa.Owners, user)
+		if pa.claimed() && len(owners) == 0 {
+			return errLastOwner
+		}
+		pa.Owners, pa.Maintainers = owners, without(pa.Maintainers, user)
+		return nil
+	})
+	if err != nil || role == "" {
+		return err
+	}
+	s.logChange(ctx, name, "", fmt.Sprintf(actionRemoveRole, role, user))
+	return nil
+}
+
+// createToken creates a token for uploading the project and returns it, it
+// can't be retrieved later. Uploads with it stop working if creator loses
+// their role on the project.
+func (s *server) createToken(ctx context.Context, name, tokenName, creator string) (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	token := tokenPrefix + name + "." + hex.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(token))
+	err = s.updateAccess(ctx, name, func(pa *projectAccess) error {
+		pa.Tokens = append(pa.Tokens, projectToken{
+			ID:      newRequestID(),
+			Name:    tokenName,
+			Hash:    hex.EncodeToString(hash[:]),
+			Creator: creator,
+			Created: time.Now().UTC(),
+		})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// revokeToken deletes the token with the given ID
+func (s *server) revokeToken(ctx context.Context, name, id string) error {
+	return s.updateAccess(ctx, name, func(pa *projectAccess) error {
+		tokens := pa.Tokens[:0]
+		for _, t := range pa.Tokens {
+			if t.ID != id {
+				tokens = append(tokens, t)
+			}
+		}
+		pa.Tokens = tokens
+		return nil
+	})
+}
+
+// identifyToken returns the identity of a package token, its creator limited to its project
+func (s *server) identifyToken(ctx context.Context, token string) (identity, bool) {
+	rest, ok := strings.CutPrefix(token, tokenPrefix)
+	if !ok {
+		return identity{}, false
+	}
+	name, _, ok := strings.Cut(rest, ".")
+	if !ok || name != normalisePackageName(name) {
+		return identity{}, false
+	}
+	pa, err := s.readAccess(ctx, name)
+	if err != nil {
+		logger(ctx).Error("Failed to read project access", "package", name, "err", err)
+		return identity{}, false
+	}
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	for _, t := range pa.Tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) == 1 {
+			return identity{name: t.Creator, method: authToken, project: name}, true
+		}
+	}
+	logger(ctx).Warn("Unknown package token", "package", name)
+	return identity{}, false
+}
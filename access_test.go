@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAuthorizeUpload(t *testing.T) {
+	ctx := context.Background()
+	alice := identity{name: "alice", method: authPassword}
+	bob := identity{name: "bob", method: authPassword}
+	tests := []struct {
+		name       string
+		identified bool
+		// setup runs before uploader uploads demo
+		setup      func(t *testing.T, s *server)
+		uploader   identity
+		wantErr    error
+		wantOwners []string
+	}{
+		{
+			name:       "first identified uploader claims a new project",
+			identified: true,
+			uploader:   alice,
+			wantOwners: []string{"alice"},
+		},
+		{
+			name:       "other uploaders can't upload a claimed project",
+			identified: true,
+			setup: func(t *testing.T, s *server) {
+				storeTestUpload(t, s, "demo-0.9.tar.gz", "0.9", alice)
+			},
+			uploader:   bob,
+			wantErr:    NotAllowed,
+			wantOwners: []string{"alice"},
+		},
+		{
+			name:       "maintainers upload a claimed project",
+			identified: true,
+			setup: func(t *testing.T, s *server) {
+				storeTestUpload(t, s, "demo-0.9.tar.gz", "0.9", alice)
+				if err := s.addRole(context.Background(), "demo", "bob", roleMaintainer); err != nil {
+					t.Fatalf("Failed to add maintainer, %s", err)
+				}
+			},
+			uploader:   bob,
+			wantOwners: []string{"alice"},
+		},
+		{
+			name:       "anonymous uploads can't create projects when clients identify themselves",
+			identified: true,
+			wantErr:    errAnonymousProject,
+		},
+		{
+			name: "anonymous uploads create projects when clients can't identify themselves",
+		},
+		{
+			name:       "unclaimed projects with files refuse anonymous uploads",
+			identified: true,
+			setup: func(t *testing.T, s *server) {
+				s.cfg.identified = false
+				storeTestUpload(t, s, "demo-0.9.tar.gz", "0.9", identity{})
+				s.cfg.identified = true
+			},
+			wantErr: errUnownedProject,
+		},
+		{
+			name:       "unclaimed projects with files aren't claimed by identified uploaders",
+			identified: true,
+			setup: func(t *testing.T, s *server) {
+				if err := s.addPackage(context.Background(), testPkg("demo-0.9.tar.gz", "0.9", "")); err != nil {
+					t.Fatalf("Failed to add package, %s", err)
+				}
+			},
+			uploader: alice,
+			wantErr:  errUnownedProject,
+		},
+		{
+			name: "unclaimed projects with files accept uploads when clients can't identify themselves",
+			setup: func(t *testing.T, s *server) {
+				storeTestUpload(t, s, "demo-0.9.tar.gz", "0.9", identity{})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, serverConfig{identified: tt.identified})
+			if tt.setup != nil {
+				tt.setup(t, s)
+			}
+			err := s.storeUpload(ctx, testPkg("demo-1.0.tar.gz", "1.0", ""), bytes.NewReader([]byte("demo")), tt.uploader)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("upload returned %v, want %v", err, tt.wantErr)
+			}
+			pa, err := s.readAccess(ctx, "demo")
+			if err != nil {
+				t.Fatalf("Failed to read access, %s", err)
+			}
+			if !reflect.DeepEqual(pa.Owners, tt.wantOwners) {
+				t.Errorf("owners are %v, want %v", pa.Owners, tt.wantOwners)
+			}
+		})
+	}
+}
+
+// storeTestUpload uploads a demo file as uploader
+func storeTestUpload(t *testing.T, s *server, fileName, version string, uploader identity) {
+	t.Helper()
+	if err := s.storeUpload(context.Background(), testPkg(fileName, version, ""), bytes.NewReader([]byte(fileName)), uploader); err != nil {
+		t.Fatalf("Failed to upload %s, %s", fileName, err)
+	}
+}
+
+func TestAuthorizeUploadConcurrentClaim(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{identified: true})
+	replica := newReplica(t, f, serverConfig{identified: true})
+
+	// bob claims the project on the replica while alice's claim is being written
+	f.beforePut = func(key string) {
+		if key != accessObjectKey("demo") {
+			return
+		}
+		f.beforePut = nil
+		if err := replica.claimProject(ctx, "demo", identity{name: "bob"}); err != nil {
+			t.Errorf("Failed to claim the project on the replica, %s", err)
+		}
+	}
+	if err := s.claimProject(ctx, "demo", identity{name: "alice"}); !errors.Is(err, NotAllowed) {
+		t.Errorf("claiming a project claimed by another replica returned %v, want %v", err, NotAllowed)
+	}
+	pa, err := s.readAccess(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read access, %s", err)
+	}
+	if !reflect.DeepEqual(pa.Owners, []string{"bob"}) {
+		t.Errorf("owners are %v, want the first claim kept", pa.Owners)
+	}
+}
+
+func TestUploadClaimsPublishedProjects(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{identified: true})
+	replica := newReplica(t, f, serverConfig{identified: true})
+	alice := identity{name: "alice", method: authPassword}
+
+	// A failed upload doesn't take the name
+	f.denyPut = func(key string) bool { return key == "demo/demo-1.0.tar.gz" }
+	if err := s.storeUpload(ctx, testPkg("demo-1.0.tar.gz", "1.0", ""), bytes.NewReader([]byte("demo")), alice); err == nil {
+		t.Fatal("Upload with a failing bucket succeeded")
+	}
+	f.denyPut = nil
+	pa, err := s.readAccess(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read access, %s", err)
+	}
+	if pa.claimed() {
+		t.Errorf("owners are %v after a failed upload, want none", pa.Owners)
+	}
+
+	// bob claims the project on the replica while alice's file is published
+	f.beforePut = func(key string) {
+		if _, stored := f.get("demo/demo-1.0.tar.gz"); key != projectIndexKey("demo") || !stored {
+			return
+		}
+		f.beforePut = nil
+		if err := replica.claimProject(ctx, "demo", identity{name: "bob"}); err != nil {
+			t.Errorf("Failed to claim the project on the replica, %s", err)
+		}
+	}
+	err = s.storeUpload(ctx, testPkg("demo-1.0.tar.gz", "1.0", ""), bytes.NewReader([]byte("demo")), alice)
+	if !errors.Is(err, NotAllowed) {
+		t.Errorf("upload to a project claimed by another replica returned %v, want %v", err, NotAllowed)
+	}
+	pr, err := s.readProject(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read project, %s", err)
+	}
+	if len(pr.Releases) != 0 {
+		t.Errorf("releases are %+v, want the file withdrawn", pr.Releases)
+	}
+	if _, ok := f.get("demo/demo-1.0.tar.gz"); ok {
+		t.Error("object of the withdrawn file is still in the bucket")
+	}
+
+	// The owner can upload the withdrawn file name
+	storeTestUpload(t, s, "demo-1.0.tar.gz", "1.0", identity{name: "bob", method: authPassword})
+}
+
+func TestRoles(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, serverConfig{identified: true})
+	if err := s.claimProject(ctx, "demo", identity{name: "alice"}); err != nil {
+		t.Fatalf("Failed to claim project, %s", err)
+	}
+	if err := s.removeRole(ctx, "demo", "alice"); !errors.Is(err, errLastOwner) {
+		t.Errorf("removing the last owner returned %v, want %v", err, errLastOwner)
+	}
+	if err := s.addRole(ctx, "demo", "alice", roleMaintainer); !errors.Is(err, errLastOwner) {
+		t.Errorf("making the last owner a maintainer returned %v, want %v", err, errLastOwner)
+	}
+	if err := s.addRole(ctx, "demo", "bob", roleOwner); err != nil {
+		t.Fatalf("Failed to add owner, %s", err)
+	}
+	if err := s.addRole(ctx, "demo", "alice", roleMaintainer); err != nil {
+		t.Fatalf("Failed to make alice a maintainer, %s", err)
+	}
+
+	pa, err := s.readAccess(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read access, %s", err)
+	}
+	if pa.role("alice") != roleMaintainer || pa.role("bob") != roleOwner {
+		t.Errorf("roles of alice and bob are %q and %q, want maintainer and owner", pa.role("alice"), pa.role("bob"))
+	}
+	if !pa.allows("alice", roleMaintainer) || pa.allows("alice", roleOwner) || pa.allows("carol", roleMaintainer) {
+		t.Errorf("access %+v allows the wrong roles", pa)
+	}
+}
+
+func TestUpdateAccessKeepsConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{identified: true})
+	replica := newReplica(t, f, serverConfig{identified: true})
+	if err := s.claimProject(ctx, "demo", identity{name: "alice"}); err != nil {
+		t.Fatalf("Failed to claim project, %s", err)
+	}
+
+	// The replica creates a token between the read and the write of the first server
+	f.beforePut = func(key string) {
+		if key != accessObjectKey("demo") {
+			return
+		}
+		f.beforePut = nil
+		if _, err := replica.createToken(ctx, "demo", "ci", "alice"); err != nil {
+			t.Errorf("Failed to create a token on the replica, %s", err)
+		}
+	}
+	if err := s.addRole(ctx, "demo", "bob", roleMaintainer); err != nil {
+		t.Fatalf("Failed to add maintainer, %s", err)
+	}
+
+	pa, err := s.readAccess(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read access, %s", err)
+	}
+	if len(pa.Tokens) != 1 || !reflect.DeepEqual(pa.Maintainers, []string{"bob"}) {
+		t.Errorf("access is %+v, want both the token and the maintainer", pa)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// requireAdmin only lets requests carrying the admin bearer token through to next
+func (s *server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.adminToken == "" {
+			http.Error(w, "Admin endpoints are disabled, start gopi with -adminToken to enable them", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.adminToken)) != 1 {
+			logger(r.Context()).Warn("Rejected admin request", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gopi admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Ways a client can identify itself
+const (
+	authMTLS     = "mtls"
+	authPassword = "password"
+	authToken    = "token"
+)
+
+// tokenUsername is the Basic auth username of package tokens, as on PyPI
+const tokenUsername = "__token__"
+
+// passwordCacheTTL is how long a checked password is remembered. Browsers
+// send the password with every request and bcrypt is slow on purpose.
+const passwordCacheTTL = 5 * time.Minute
+
+// identity is who a request was made by
+type identity struct {
+	name string
+	// method is how the identity was established
+	method string
+	// project limits a token identity to uploading that project
+	project string
+}
+
+// identify returns the identity of the client that made r, if it could be established
+func (s *server) identify(r *http.Request) (identity, bool) {
+	// Only verified client certificates have chains, gopi never accepts unverified ones
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		if cert.Subject.CommonName != "" {
+			return identity{name: cert.Subject.CommonName, method: authMTLS}, true
+		}
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return identity{}, false
+	}
+	if username == tokenUsername {
+		return s.identifyToken(r.Context(), password)
+	}
+	if s.checkPassword(username, password) {
+		return identity{name: username, method: authPassword}, true
+	}
+	logger(r.Context()).Warn("Wrong username or password", "user", username, "remote_addr", r.RemoteAddr)
+	return identity{}, false
+}
+
+// parseUsers parses "name:bcrypt hash" entries as written by `htpasswd -nB`
+func parseUsers(entries []string) (map[string][]byte, error) {
+	users := make(map[string][]byte, len(entries))
+	var errs []error
+	for _, entry := range entries {
+		name, hash, ok := strings.Cut(entry, ":")
+		if !ok || name == "" {
+			errs = append(errs, fmt.Errorf("user %q must be name:bcrypt-hash", entry))
+			continue
+		}
+		if name == tokenUsername {
+			errs = append(errs, fmt.Errorf("user name %s is reserved for package tokens", tokenUsername))
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			errs = append(errs, fmt.Errorf("user %s doesn't have a bcrypt password hash, %s", name, err.Error()))
+			continue
+		}
+		users[name] = []byte(hash)
+	}
+	return users, errors.Join(errs...)
+}
+
+// passwordCache remembers recently checked passwords by their SHA256 hash
+type passwordCache struct {
+	mu      sync.Mutex
+	checked map[[sha256.Size]byte]time.Time
+}
+
+// checkPassword reports whether password is the password of user. The cache
+// is only locked to look up and record passwords, not while bcrypt runs.
+func (s *server) checkPassword(user, password string) bool {
+	hash, ok := s.cfg.users[user]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	if s.passwords.verified(key) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	s.passwords.remember(key)
+	return true
+}
+
+// verified reports whether the password with the hash key was checked less than passwordCacheTTL ago
+func (pc *passwordCache) verified(key [sha256.Size]byte) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	checked, ok := pc.checked[key]
+	return ok && time.Since(checked) < passwordCacheTTL
+}
+
+// remember records that the password with the hash key is correct, dropping expired entries
+func (pc *passwordCache) remember(key [sha256.Size]byte) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.checked == nil {
+		pc.checked = make(map[[sha256.Size]byte]time.Time)
+	}
+	for k, checked := range pc.checked {
+		if time.Since(checked) >= passwordCacheTTL {
+			delete(pc.checked, k)
+		}
+	}
+	pc.checked[key] = time.Now()
+}
+
+// allowed reports whether id is in allowlist, where "*" matches any identity
+func allowed(allowlist []string, id identity) bool {
+	for _, name := range allowlist {
+		if name == "*" || name == id.name {
+			return true
+		}
+	}
+	return false
+}
+
+// requireRead only lets clients allowed to read packages through to next
+func (s *server) requireRead(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireIdentity("read", s.cfg.readers, next)
+}
+
+// requireUpload only lets clients allowed to upload packages through to next
+func (s *server) requireUpload(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireIdentity("upload", s.cfg.uploaders, next)
+}
+
+// requireIdentity checks the identity of the client against allowlist, an
+// empty allowlist lets anyone through
+func (s *server) requireIdentity(permission string, allowlist []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(allowlist) == 0 {
+			next(w, r)
+			return
+		}
+		id, ok := s.identify(r)
+		if !ok {
+			logger(r.Context()).Warn("Rejected unauthenticated request", "permission", permission, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			s.unauthorized(w)
+			return
+		}
+		if !allowed(allowlist, id) {
+			logger(r.Context()).Warn("Rejected request", "permission", permission, "identity", id.name, "path", r.URL.Path)
+			http.Error(w, fmt.Sprintf("Forbidden, %s may not %s packages", id.name, permission), http.StatusForbidden)
+			return
+		}
+		logger(r.Context()).Debug("Authorized request", "permission", permission, "identity", id.name, "method", id.method)
+		next(w, r)
+	}
+}
+
+// requireManager only lets identified clients allowed to upload through to
+// the management pages, with their identity in the request context. Package
+// tokens can only upload.
+func (s *server) requireManager(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger(r.Context())
+		id, ok := s.identify(r)
+		if !ok {
+			log.Warn("Rejected unauthenticated request", "permission", "manage", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			s.unauthorized(w)
+			return
+		}
+		if id.method == authToken {
+			http.Error(w, "Forbidden, package tokens can only upload packages", http.StatusForbidden)
+			return
+		}
+		if len(s.cfg.uploaders) > 0 && !allowed(s.cfg.uploaders, id) {
+			log.Warn("Rejected request", "permission", "manage", "identity", id.name, "path", r.URL.Path)
+			http.Error(w, fmt.Sprintf("Forbidden, %s may not manage packages", id.name), http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPost && !sameOrigin(r) {
+			// Browsers send Basic auth credentials along with cross-site form posts
+			log.Warn("Rejected cross-site request", "identity", id.name, "path", r.URL.Path, "origin", r.Header.Get("Origin"))
+			http.Error(w, "Forbidden, cross-site request", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), identityKey, id)))
+	}
+}
+
+// requestIdentity returns the identity stored in ctx by requireManager
+func requestIdentity(ctx context.Context) identity {
+	id, _ := ctx.Value(identityKey).(identity)
+	return id
+}
+
+// sameOrigin reports whether r was sent by a page served by gopi itself
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(origin)
+	return err == nil && origin != "" && u.Host == r.Host
+}
+
+// unauthorized asks the client to identify itself, with a password if users are configured
+func (s *server) unauthorized(w http.ResponseWriter) {
+	if len(s.cfg.users) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gopi", charset="UTF-8"`)
+		http.Error(w, "Unauthorized, log in or present a client certificate", http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, "Unauthorized, a client certificate is required", http.StatusUnauthorized)
+}
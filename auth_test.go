@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testUsers returns users with bcrypt hashes of their passwords
+func testUsers(t *testing.T, passwords map[string]string) map[string][]byte {
+	t.Helper()
+	users := make(map[string][]byte, len(passwords))
+	for name, password := range passwords {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("Failed to hash password, %s", err)
+		}
+		users[name] = hash
+	}
+	return users
+}
+
+func TestCheckPassword(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{users: testUsers(t, map[string]string{"alice": "secret"})})
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{user: "alice", password: "secret", want: true},
+		{user: "alice", password: "wrong", want: false},
+		{user: "bob", password: "secret", want: false},
+		{user: "alice", password: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := s.checkPassword(tt.user, tt.password); got != tt.want {
+			t.Errorf("checkPassword(%q, %q) is %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+
+	// Checked passwords are remembered instead of running bcrypt again
+	s.cfg.users["alice"] = testUsers(t, map[string]string{"alice": "changed"})["alice"]
+	if !s.checkPassword("alice", "secret") {
+		t.Error("checkPassword of a recently checked password is false, want it cached")
+	}
+	if s.checkPassword("alice", "wrong") {
+		t.Error("checkPassword of a wrong password is true after caching the right one")
+	}
+}
+
+func TestPackageTokens(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestServer(t, serverConfig{users: testUsers(t, map[string]string{"alice": "secret"})})
+	alice := identity{name: "alice", method: authPassword}
+	if err := s.storeUpload(ctx, testPkg("demo-1.0.tar.gz", "1.0", ""), bytes.NewReader([]byte("demo")), alice); err != nil {
+		t.Fatalf("Failed to upload demo, %s", err)
+	}
+	token, err := s.createToken(ctx, "demo", "ci", "alice")
+	if err != nil {
+		t.Fatalf("Failed to create token, %s", err)
+	}
+
+	id, ok := s.identifyToken(ctx, token)
+	if !ok || id != (identity{name: "alice", method: authToken, project: "demo"}) {
+		t.Errorf("identity of the token is %+v, %v, want alice limited to demo", id, ok)
+	}
+	for _, bad := range []string{token + "0", "gopi.other." + token[len("gopi.demo."):], "demo", ""} {
+		if id, ok := s.identifyToken(ctx, bad); ok {
+			t.Errorf("token %q identifies %+v, want it rejected", bad, id)
+		}
+	}
+
+	// Tokens only upload the project they were created for
+	if err := s.storeUpload(ctx, testPkg("demo-1.1.tar.gz", "1.1", ""), bytes.NewReader([]byte("demo")), id); err != nil {
+		t.Errorf("Failed to upload demo with its token, %s", err)
+	}
+	other := testPkg("other-1.0.tar.gz", "1.0", "")
+	other.Name, other.URL = "other", "/other/other-1.0.tar.gz"
+	if err := s.storeUpload(ctx, other, bytes.NewReader([]byte("other")), id); !errors.Is(err, NotAllowed) {
+		t.Errorf("uploading another project with the token returned %v, want %v", err, NotAllowed)
+	}
+
+	// and can't be used to manage it
+	req := httptest.NewRequest(http.MethodGet, "/manage/", nil)
+	req.SetBasicAuth(tokenUsername, token)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("/manage/ with a token returned %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	pa, err := s.readAccess(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read access, %s", err)
+	}
+	if err := s.revokeToken(ctx, "demo", pa.Tokens[0].ID); err != nil {
+		t.Fatalf("Failed to revoke token, %s", err)
+	}
+	if _, ok := s.identifyToken(ctx, token); ok {
+		t.Error("revoked token still identifies its creator")
+	}
+}
+
+// testWheel returns a wheel with the core metadata of name and version
+func testWheel(t *testing.T, name, version string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(name + "-" + version + ".dist-info/METADATA")
+	if err != nil {
+		t.Fatalf("Failed to create wheel, %s", err)
+	}
+	w.Write([]byte("Metadata-Version: 2.1\nName: " + name + "\nVersion: " + version + "\nSummary: a wheel\n"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to create wheel, %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestManageUpload(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{users: testUsers(t, map[string]string{"alice": "secret"})})
+	wheel := testWheel(t, "demo", "1.0")
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("content", "demo-1.0-py3-none-any.whl")
+	fw.Write(wheel)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "http://gopi/manage/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Origin", "http://gopi")
+	req.SetBasicAuth("alice", "secret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("upload returned %d %q, want a redirect", w.Code, w.Body.String())
+	}
+
+	o, ok := f.get("demo/demo-1.0-py3-none-any.whl")
+	if !ok || !bytes.Equal(o.data, wheel) {
+		t.Fatal("the uploaded wheel wasn't stored")
+	}
+	p, err := s.findFile(context.Background(), "demo", "demo-1.0-py3-none-any.whl")
+	if err != nil {
+		t.Fatalf("Failed to find file, %s", err)
+	}
+	md5Sum, sha256Sum := md5.Sum(wheel), sha256.Sum256(wheel)
+	if p.MD5 != hex.EncodeToString(md5Sum[:]) || p.SHA256 != hex.EncodeToString(sha256Sum[:]) {
+		t.Errorf("digests are %s %s, want the ones of the wheel", p.MD5, p.SHA256)
+	}
+	if p.Version != "1.0" || p.Summary != "a wheel" || p.Uploader != "alice" {
+		t.Errorf("file is version %q with summary %q uploaded by %q, want the metadata of the wheel uploaded by alice", p.Version, p.Summary, p.Uploader)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{users: testUsers(t, map[string]string{"alice": "secret"})})
+	withCert := func(r *http.Request, commonName string) *http.Request {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return r
+	}
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		want    identity
+		wantOK  bool
+	}{
+		{
+			name:    "anonymous",
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "/", nil) },
+		},
+		{
+			name: "client certificate",
+			request: func() *http.Request {
+				return withCert(httptest.NewRequest(http.MethodGet, "/", nil), "ci-bot")
+			},
+			want:   identity{name: "ci-bot", method: authMTLS},
+			wantOK: true,
+		},
+		{
+			name: "unverified client certificate",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "ci-bot"}}}}
+				return r
+			},
+		},
+		{
+			name: "client certificate wins over password",
+			request: func() *http.Request {
+				r := withCert(httptest.NewRequest(http.MethodGet, "/", nil), "ci-bot")
+				r.SetBasicAuth("alice", "secret")
+				return r
+			},
+			want:   identity{name: "ci-bot", method: authMTLS},
+			wantOK: true,
+		},
+		{
+			name: "password",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.SetBasicAuth("alice", "secret")
+				return r
+			},
+			want:   identity{name: "alice", method: authPassword},
+			wantOK: true,
+		},
+		{
+			name: "wrong password",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.SetBasicAuth("alice", "wrong")
+				return r
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := s.identify(tt.request())
+			if id != tt.want || ok != tt.wantOK {
+				t.Errorf("identity is %+v, %v, want %+v, %v", id, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestUploadCredentials(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{identified: true, users: testUsers(t, map[string]string{"alice": "secret"})})
+	tests := []struct {
+		name       string
+		user       string
+		password   string
+		wantStatus int
+	}{
+		{name: "wrong password", user: "alice", password: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "unknown user", user: "mallory", password: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "right password", user: "alice", password: "secret", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &bytes.Buffer{}
+			mw := multipart.NewWriter(body)
+			mw.WriteField(":action", "file_upload")
+			mw.WriteField("name", "demo")
+			mw.WriteField("version", "1.0")
+			fw, _ := mw.CreateFormFile("content", "demo-1.0.tar.gz")
+			fw.Write([]byte("demo-1.0.tar.gz"))
+			mw.Close()
+			req := httptest.NewRequest(http.MethodPost, "/simple/", body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			req.SetBasicAuth(tt.user, tt.password)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("upload is %d, want %d", w.Code, tt.wantStatus)
+			}
+			if _, stored := f.get("demo/demo-1.0.tar.gz"); stored != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("object stored is %v after a %d upload", stored, w.Code)
+			}
+		})
+	}
+}
+
+func TestRequireRead(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{
+		users:   testUsers(t, map[string]string{"alice": "secret", "bob": "secret"}),
+		readers: []string{"alice"},
+	})
+	tests := []struct {
+		user       string
+		wantStatus int
+	}{
+		{user: "", wantStatus: http.StatusUnauthorized},
+		{user: "bob", wantStatus: http.StatusForbidden},
+		{user: "alice", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/simple/", nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, "secret")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("/simple/ as %q returned %d, want %d", tt.user, w.Code, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Error("/simple/ without credentials doesn't ask for them")
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables overriding the config
+// file. The rest of the name is the path of the setting in the file in
+// upper snake case, e.g. storage.accessKey is GOPI_STORAGE_ACCESS_KEY.
+const envPrefix = "GOPI_"
+
+// config holds every setting of gopi. Settings are read from the defaults,
+// the config file, GOPI_* environment variables and command line flags, each
+// overriding the ones before.
+type config struct {
+	Storage storageSection `yaml:"storage"`
+	// Listen is the address to serve on, host:port
+	Listen    string           `yaml:"listen"`
+	TLS       tlsSection       `yaml:"tls"`
+	Auth      authSection      `yaml:"auth"`
+	Index     indexSection     `yaml:"index"`
+	Downloads downloadsSection `yaml:"downloads"`
+	Stats     statsSection     `yaml:"stats"`
+	Log       logSection       `yaml:"log"`
+	Tracing   tracingSection   `yaml:"tracing"`
+	Limits    limitsSection    `yaml:"limits"`
+	Uploads   uploadsSection   `yaml:"uploads"`
+	Timeouts  timeoutsSection  `yaml:"timeouts"`
+	UI        uiSection        `yaml:"ui"`
+}
+
+type storageSection struct {
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+	// Proxy is the HTTP proxy gopi reaches the storage backend through,
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY are used when it's empty
+	Proxy string `yaml:"proxy"`
+	// NoProxy lists the hosts reached without Proxy, a host also matches
+	// its subdomains
+	NoProxy []string `yaml:"noProxy"`
+}
+
+type tlsSection struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ClientCAFile verifies client certificates, the identity of a client is
+	// the common name of its certificate
+	ClientCAFile string `yaml:"clientCAFile"`
+	// ClientAuth is "none", "optional" or "require"
+	ClientAuth string `yaml:"clientAuth"`
+}
+
+type authSection struct {
+	AdminToken string `yaml:"adminToken"`
+	// Users log in with a password, each entry is "name:bcrypt hash"
+	Users []string `yaml:"users"`
+	// Read and Upload list the identities allowed to download and upload
+	// packages, "*" allows any authenticated client. Anyone may when empty.
+	Read   []string `yaml:"read"`
+	Upload []string `yaml:"upload"`
+}
+
+type indexSection struct {
+	RefreshInterval time.Duration `yaml:"refreshInterval"`
+}
+
+type downloadsSection struct {
+	Mode string `yaml:"mode"`
+}
+
+type statsSection struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+type logSection struct {
+	Format string `yaml:"format"`
+	Level  string `yaml:"level"`
+}
+
+type tracingSection struct {
+	OTLPEndpoint string `yaml:"otlpEndpoint"`
+}
+
+type limitsSection struct {
+	// MaxUploadSize is the largest upload request accepted in bytes, 0 means no limit
+	MaxUploadSize int64 `yaml:"maxUploadSize"`
+}
+
+type uploadsSection struct {
+	// AllowOverwrite lets uploads replace files of the same name and reuse the
+	// names of deleted files, for development indexes. Released files can
+	// never change otherwise, like on PyPI.
+	AllowOverwrite bool `yaml:"allowOverwrite"`
+}
+
+// timeoutsSection bounds how long connections may take, 0 means no limit
+type timeoutsSection struct {
+	// ReadHeader is how long clients have to send the request headers
+	ReadHeader time.Duration `yaml:"readHeader"`
+	// Read and Write cover the whole request and response, except for
+	// uploads and streamed downloads which take as long as the file needs
+	Read  time.Duration `yaml:"read"`
+	Write time.Duration `yaml:"write"`
+	// Idle is how long keep-alive connections are kept open between requests
+	Idle time.Duration `yaml:"idle"`
+	// Drain is how long gopi keeps serving on SIGTERM after failing its
+	// readiness check, so load balancers stop sending it new requests
+	Drain time.Duration `yaml:"drain"`
+	// Shutdown is how long in-flight requests get to finish on SIGTERM
+	Shutdown time.Duration `yaml:"shutdown"`
+}
+
+type uiSection struct {
+	// ThemeDir holds templates and assets replacing the built-in ones, laid
+	// out as the templates and assets directories of the repo
+	ThemeDir string `yaml:"themeDir"`
+}
+
+func defaultConfig() config {
+	var c config
+	c.Storage.Endpoint = "http://localhost:9000"
+	c.Listen = "0.0.0.0:8080"
+	c.TLS.ClientAuth = clientAuthOptional
+	c.Index.RefreshInterval = 30 * time.Second
+	c.Downloads.Mode = downloadRedirect
+	c.Stats.Interval = time.Minute
+	c.Log.Format = logText
+	c.Log.Level = "info"
+	c.Timeouts.ReadHeader = 10 * time.Second
+	c.Timeouts.Read = 10 * time.Minute
+	c.Timeouts.Write = 10 * time.Minute
+	c.Timeouts.Idle = 2 * time.Minute
+	c.Timeouts.Drain = 5 * time.Second
+	c.Timeouts.Shutdown = 30 * time.Second
+	return c
+}
+
+// loadConfig returns the defaults overridden by the config file at path, if
+// any, and then by the environment
+func loadConfig(path string) (config, error) {
+	c := defaultConfig()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return c, fmt.Errorf("Failed to read config file, %s", err.Error())
+		}
+		defer f.Close()
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(&c)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return c, fmt.Errorf("Failed to parse config file %s, %s", path, err.Error())
+		}
+	}
+	err := applyEnv(reflect.ValueOf(&c).Elem(), envPrefix)
+	if err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// applyEnv sets the fields of v from the environment variables named after their yaml keys
+func applyEnv(v reflect.Value, prefix string) error {
+	var errs []error
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + envName(v.Type().Field(i).Tag.Get("yaml"))
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name+"_"); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid value %q for %s, %s", value, name, err.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// envName turns a camel case yaml key into upper snake case
+func envName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(rune(key[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		field.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("must be a duration such as 30s or 5m")
+		}
+		field.SetInt(int64(d))
+	case []string:
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	case int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		field.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// identifiesClients reports whether clients can identify themselves with client certificates or passwords
+func (c config) identifiesClients() bool {
+	return (c.TLS.ClientCAFile != "" && c.TLS.ClientAuth != clientAuthNone) || len(c.Auth.Users) > 0
+}
+
+// validate checks every setting and returns all the problems found at once
+func (c config) validate() error {
+	var errs []error
+	if strings.TrimSpace(c.Storage.Bucket) == "" {
+		errs = append(errs, errors.New(`storage.bucket cannot be empty, please provide it in the config file, GOPI_STORAGE_BUCKET or 'gopi -bucket "mybucket"'`))
+	}
+	if strings.TrimSpace(c.Storage.Endpoint) == "" {
+		errs = append(errs, errors.New(`storage.endpoint cannot be empty, please provide it in the config file, GOPI_STORAGE_ENDPOINT or 'gopi -endpoint "http://localhost:9000/"'`))
+	} else if u, err := url.Parse(c.Storage.Endpoint); err != nil || u.Host == "" {
+		errs = append(errs, fmt.Errorf("storage.endpoint %q must be a URL such as http://localhost:9000", c.Storage.Endpoint))
+	}
+	if (c.Storage.AccessKey == "") != (c.Storage.SecretKey == "") {
+		errs = append(errs, errors.New("storage.accessKey and storage.secretKey must be set together"))
+	}
+	if c.Storage.Proxy != "" {
+		if u, err := url.Parse(c.Storage.Proxy); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("storage.proxy %q must be a URL such as http://proxy:3128", c.Storage.Proxy))
+		}
+	}
+	if len(c.Storage.NoProxy) > 0 && c.Storage.Proxy == "" {
+		errs = append(errs, errors.New("storage.noProxy needs storage.proxy, use NO_PROXY with the proxy of the environment"))
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen %q must be host:port, e.g. 0.0.0.0:8080", c.Listen))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls.certFile and tls.keyFile must be set together"))
+	}
+	switch c.TLS.ClientAuth {
+	case clientAuthNone, clientAuthOptional, clientAuthRequire:
+	default:
+		errs = append(errs, fmt.Errorf("tls.clientAuth must be %q, %q or %q, not %q", clientAuthNone, clientAuthOptional, clientAuthRequire, c.TLS.ClientAuth))
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		errs = append(errs, errors.New("tls.clientCAFile needs tls.certFile and tls.keyFile, client certificates are only used over TLS"))
+	}
+	if _, err := parseUsers(c.Auth.Users); err != nil {
+		errs = append(errs, fmt.Errorf("auth.users: %w", err))
+	}
+	identified := c.identifiesClients()
+	if len(c.Auth.Read) > 0 && !identified {
+		errs = append(errs, errors.New("auth.read needs tls.clientCAFile or auth.users to identify clients"))
+	}
+	if len(c.Auth.Upload) > 0 && !identified {
+		errs = append(errs, errors.New("auth.upload needs tls.clientCAFile or auth.users to identify clients"))
+	}
+	if c.Index.RefreshInterval < 0 {
+		errs = append(errs, errors.New("index.refreshInterval cannot be negative, use 0 to disable refreshing"))
+	}
+	if c.Downloads.Mode != downloadRedirect && c.Downloads.Mode != downloadStream {
+		errs = append(errs, fmt.Errorf("downloads.mode must be %q or %q, not %q", downloadRedirect, downloadStream, c.Downloads.Mode))
+	}
+	if c.Stats.Interval <= 0 {
+		errs = append(errs, errors.New("stats.interval must be greater than 0"))
+	}
+	if c.Log.Format != logText && c.Log.Format != logJSON {
+		errs = append(errs, fmt.Errorf("log.format must be %q or %q, not %q", logText, logJSON, c.Log.Format))
+	}
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %s", err.Error()))
+	}
+	if c.Tracing.OTLPEndpoint != "" {
+		if u, err := url.Parse(c.Tracing.OTLPEndpoint); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.otlpEndpoint %q must be a URL such as http://localhost:4318", c.Tracing.OTLPEndpoint))
+		}
+	}
+	if c.Limits.MaxUploadSize < 0 {
+		errs = append(errs, errors.New("limits.maxUploadSize cannot be negative, use 0 for no limit"))
+	}
+	// In a fixed order so the errors are always reported the same way
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"readHeader", c.Timeouts.ReadHeader},
+		{"read", c.Timeouts.Read},
+		{"write", c.Timeouts.Write},
+		{"idle", c.Timeouts.Idle},
+		{"drain", c.Timeouts.Drain},
+		{"shutdown", c.Timeouts.Shutdown},
+	} {
+		if t.d < 0 {
+			errs = append(errs, fmt.Errorf("timeouts.%s cannot be negative, use 0 for no limit", t.name))
+		}
+	}
+	if c.UI.ThemeDir != "" {
+		if info, err := os.Stat(c.UI.ThemeDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("ui.themeDir %q must be a directory", c.UI.ThemeDir))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
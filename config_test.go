@@ -0,0 +1,304 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "bucket", want: "BUCKET"},
+		{key: "accessKey", want: "ACCESS_KEY"},
+		{key: "clientCAFile", want: "CLIENT_CAFILE"},
+		{key: "otlpEndpoint", want: "OTLP_ENDPOINT"},
+		{key: "maxUploadSize", want: "MAX_UPLOAD_SIZE"},
+	}
+	for _, tt := range tests {
+		if got := envName(tt.key); got != tt.want {
+			t.Errorf("envName(%q) is %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+// writeConfigFile writes a config file with content and returns its path
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gopi.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file, %s", err)
+	}
+	return path
+}
+
+// parseTestFlags parses args as gopi's command line for applyFlags
+func parseTestFlags(t *testing.T, args ...string) {
+	t.Helper()
+	saved, savedBucket, savedListen, savedPort, savedDebug := flag.CommandLine, bucket, listen, port, debug
+	t.Cleanup(func() {
+		flag.CommandLine, bucket, listen, port, debug = saved, savedBucket, savedListen, savedPort, savedDebug
+	})
+	flag.CommandLine = flag.NewFlagSet("gopi", flag.ContinueOnError)
+	flag.StringVar(&bucket, "bucket", "", "")
+	flag.StringVar(&listen, "listen", "0.0.0.0:8080", "")
+	flag.StringVar(&port, "port", "8080", "")
+	flag.BoolVar(&debug, "debug", false, "")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatalf("Failed to parse flags, %s", err)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+storage:
+  bucket: file-bucket
+  accessKey: file-key
+  proxy: http://file-proxy:3128
+  noProxy: [minio.internal]
+listen: 127.0.0.1:9090
+index:
+  refreshInterval: 1m
+stats:
+  interval: 5m
+auth:
+  read: [alice]
+log:
+  level: warn
+`)
+	t.Setenv("GOPI_STORAGE_ACCESS_KEY", "env-key")
+	t.Setenv("GOPI_STATS_INTERVAL", "10m")
+	t.Setenv("GOPI_STORAGE_PROXY", "http://env-proxy:3128")
+	t.Setenv("GOPI_AUTH_READ", "bob, carol,")
+	t.Setenv("GOPI_TIMEOUTS_READ_HEADER", "3s")
+	t.Setenv("GOPI_UPLOADS_ALLOW_OVERWRITE", "true")
+	t.Setenv("GOPI_LOG_LEVEL", "error")
+	parseTestFlags(t, "-bucket", "flag-bucket", "-port", "7070", "-debug")
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config, %s", err)
+	}
+	applyFlags(&c)
+
+	tests := []struct {
+		setting string
+		got     interface{}
+		want    interface{}
+	}{
+		{setting: "storage.endpoint from the defaults", got: c.Storage.Endpoint, want: "http://localhost:9000"},
+		{setting: "downloads.mode from the defaults", got: c.Downloads.Mode, want: downloadRedirect},
+		{setting: "storage.bucket from the flags over the file", got: c.Storage.Bucket, want: "flag-bucket"},
+		{setting: "storage.accessKey from the environment over the file", got: c.Storage.AccessKey, want: "env-key"},
+		{setting: "listen from the file with the port of the flags", got: c.Listen, want: "127.0.0.1:7070"},
+		{setting: "storage.proxy from the environment over the file", got: c.Storage.Proxy, want: "http://env-proxy:3128"},
+		{setting: "storage.noProxy from the file", got: c.Storage.NoProxy, want: []string{"minio.internal"}},
+		{setting: "index.refreshInterval from the file", got: c.Index.RefreshInterval, want: time.Minute},
+		{setting: "stats.interval from the environment over the file", got: c.Stats.Interval, want: 10 * time.Minute},
+		{setting: "auth.read from the environment over the file", got: c.Auth.Read, want: []string{"bob", "carol"}},
+		{setting: "timeouts.readHeader from the environment", got: c.Timeouts.ReadHeader, want: 3 * time.Second},
+		{setting: "uploads.allowOverwrite from the environment", got: c.Uploads.AllowOverwrite, want: true},
+		{setting: "log.level from -debug over the environment", got: c.Log.Level, want: "debug"},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s is %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	t.Setenv("GOPI_STORAGE_BUCKET", "env-bucket")
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to load config, %s", err)
+	}
+	want := defaultConfig()
+	want.Storage.Bucket = "env-bucket"
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("config is %+v, want the defaults with the bucket from the environment", c)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		want []string
+	}{
+		{
+			name: "unknown setting",
+			file: "storage:\n  bucket: demo\n  buckett: typo\n",
+			want: []string{"field buckett not found"},
+		},
+		{
+			name: "wrong type",
+			file: "stats:\n  interval: often\n",
+			want: []string{"Failed to parse config file"},
+		},
+		{
+			name: "every invalid environment variable",
+			env: map[string]string{
+				"GOPI_STATS_INTERVAL":          "often",
+				"GOPI_UPLOADS_ALLOW_OVERWRITE": "maybe",
+				"GOPI_LIMITS_MAX_UPLOAD_SIZE":  "1GB",
+			},
+			want: []string{
+				`Invalid value "often" for GOPI_STATS_INTERVAL, must be a duration`,
+				`Invalid value "maybe" for GOPI_UPLOADS_ALLOW_OVERWRITE, must be true or false`,
+				`Invalid value "1GB" for GOPI_LIMITS_MAX_UPLOAD_SIZE, must be a whole number`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = writeConfigFile(t, tt.file)
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := loadConfig(path)
+			if err == nil {
+				t.Fatal("Loading the config succeeded, want an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't contain %q", err, want)
+				}
+			}
+		})
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Loading a missing config file succeeded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := defaultConfig()
+	valid.Storage.Bucket = "demo"
+	if err := valid.validate(); err != nil {
+		t.Errorf("defaults with a bucket are invalid, %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *config)
+		want   []string
+	}{
+		{
+			name: "every problem is reported",
+			change: func(c *config) {
+				c.Storage.Bucket = " "
+				c.Downloads.Mode = "copy"
+				c.Stats.Interval = 0
+				c.Timeouts.Read = -time.Second
+				c.Timeouts.Drain = -time.Second
+				c.Timeouts.Shutdown = -time.Second
+			},
+			want: []string{
+				"storage.bucket cannot be empty",
+				`downloads.mode must be "redirect" or "stream", not "copy"`,
+				"stats.interval must be greater than 0",
+				"timeouts.read cannot be negative",
+				"timeouts.drain cannot be negative",
+				"timeouts.shutdown cannot be negative",
+			},
+		},
+		{
+			name:   "allowlists need a way to identify clients",
+			change: func(c *config) { c.Auth.Upload = []string{"alice"} },
+			want:   []string{"auth.upload needs tls.clientCAFile or auth.users"},
+		},
+		{
+			name: "client certificates need TLS",
+			change: func(c *config) {
+				c.TLS.ClientCAFile = "ca.pem"
+				c.Auth.Read = []string{"*"}
+			},
+			want: []string{"tls.clientCAFile needs tls.certFile"},
+		},
+		{
+			name: "storage proxy",
+			change: func(c *config) {
+				c.Storage.Proxy = "proxy:3128"
+				c.Index.RefreshInterval = -time.Second
+			},
+			want: []string{`storage.proxy "proxy:3128" must be a URL`, "index.refreshInterval cannot be negative"},
+		},
+		{
+			name:   "hosts without a proxy need a proxy",
+			change: func(c *config) { c.Storage.NoProxy = []string{"minio.internal"} },
+			want:   []string{"storage.noProxy needs storage.proxy"},
+		},
+		{
+			name:   "log settings",
+			change: func(c *config) { c.Log.Format, c.Log.Level = "xml", "loud" },
+			want:   []string{`log.format must be "text" or "json"`, "log.level"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.change(&c)
+			err := c.validate()
+			if err == nil {
+				t.Fatal("validate succeeded, want an error")
+			}
+			// Problems are reported in the order of the settings
+			last := -1
+			for _, want := range tt.want {
+				i := strings.Index(err.Error(), want)
+				if i < 0 {
+					t.Errorf("error %q doesn't contain %q", err, want)
+				} else if i < last {
+					t.Errorf("error %q reports %q out of order", err, want)
+				}
+				last = i
+			}
+		})
+	}
+}
+
+func TestStorageProxy(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  s3Config
+		url  string
+		want string
+	}{
+		{name: "configured proxy", cfg: s3Config{proxy: "http://proxy:3128"}, url: "https://s3.amazonaws.com/gopi", want: "http://proxy:3128"},
+		{name: "host without proxy", cfg: s3Config{proxy: "http://proxy:3128", noProxy: []string{"minio.internal"}}, url: "http://minio.internal:9000/gopi", want: ""},
+		{name: "subdomain without proxy", cfg: s3Config{proxy: "http://proxy:3128", noProxy: []string{".internal"}}, url: "http://minio.internal:9000/gopi", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyFunc, err := tt.cfg.proxyFunc()
+			if err != nil {
+				t.Fatalf("Failed to get proxy, %s", err)
+			}
+			r, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			proxy, err := proxyFunc(r)
+			if err != nil {
+				t.Fatalf("Failed to get proxy of %s, %s", tt.url, err)
+			}
+			got := ""
+			if proxy != nil {
+				got = proxy.String()
+			}
+			if got != tt.want {
+				t.Errorf("proxy of %s is %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"log/slog"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+// Description content types, https://packaging.python.org/specifications/core-metadata/#description-content-type
+const (
+	contentTypeMarkdown = "text/markdown"
+	contentTypeRST      = "text/x-rst"
+	contentTypePlain    = "text/plain"
+)
+
+var (
+	// markdown renders GitHub flavoured Markdown. Raw HTML is kept, READMEs
+	// often use it for badges, and removed by descriptionPolicy if unsafe.
+	markdown = goldmark.New(
+		goldmark.WithExtensions(extension.GFM),
+		goldmark.WithRendererOptions(gmhtml.WithUnsafe()),
+	)
+
+	// descriptionPolicy strips anything that could run scripts from rendered descriptions
+	descriptionPolicy = newDescriptionPolicy()
+)
+
+func newDescriptionPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+-]+$`)).OnElements("code")
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}
+
+// renderDescription turns the long description of a package into sanitised
+// HTML. Descriptions without a content type are reStructuredText, as on PyPI.
+func renderDescription(description, contentType string) template.HTML {
+	if strings.TrimSpace(description) == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentTypeRST
+	}
+	var rendered string
+	switch mediaType {
+	case contentTypeMarkdown:
+		var buf bytes.Buffer
+		err = markdown.Convert([]byte(description), &buf)
+		if err != nil {
+			slog.Warn("Failed to render Markdown description, showing it as plain text", "err", err)
+			rendered = plainHTML(description)
+			break
+		}
+		rendered = buf.String()
+	case contentTypePlain:
+		rendered = plainHTML(description)
+	default:
+		rendered = rstHTML(description)
+	}
+	return template.HTML(descriptionPolicy.Sanitize(rendered))
+}
+
+func plainHTML(text string) string {
+	return "<pre>" + html.EscapeString(text) + "</pre>"
+}
+
+// rstHTML renders the parts of reStructuredText used in READMEs: section
+// titles, paragraphs, bullet and enumerated lists, literal and code blocks,
+// block quotes and inline markup. Directives other than code blocks are
+// skipped and tables are shown as they are written.
+func rstHTML(text string) string {
+	r := &rstRenderer{
+		lines:   strings.Split(strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\t", "        "), "\n"),
+		targets: map[string]string{},
+	}
+	r.collectTargets()
+	r.render()
+	return r.out.String()
+}
+
+var (
+	rstTarget = regexp.MustCompile(`^\.\.\s+_([^:]+):\s*(\S+)\s*$`)
+	rstCode   = regexp.MustCompile(`^\.\.\s+(code|code-block|sourcecode)::\s*(\S*)`)
+	rstBullet = regexp.MustCompile(`^([-*+•])\s+`)
+	rstEnum   = regexp.MustCompile(`^(\d+|#|[a-zA-Z])[.)]\s+`)
+	rstInline = regexp.MustCompile("``(.+?)``" +
+		"|`([^`<]+?)\\s*<([^`>]+)>`__?" +
+		"|:[\\w-]+:`([^`]+)`" +
+		"|`([^`]+)`(?:__?)?" +
+		"|\\*\\*([^*]+)\\*\\*" +
+		"|\\*([^*\\s][^*]*)\\*" +
+		"|(https?://[^\\s<>\"]*[^\\s<>\".,;:!?)'])")
+)
+
+// isAdornment reports whether line underlines or overlines a title, a
+// repeated punctuation character
+func isAdornment(line string) bool {
+	line = strings.TrimRight(line, " ")
+	if len(line) < 2 || !strings.ContainsRune(`=-~^"'`+"`"+`#*+:._`, rune(line[0])) {
+		return false
+	}
+	return strings.Count(line, line[:1]) == len(line)
+}
+
+type rstRenderer struct {
+	lines   []string
+	pos     int
+	out     strings.Builder
+	targets map[string]string
+	// styles are the title adornments in the order they were first used, the
+	// index of a style is the level of its titles
+	styles []string
+}
+
+// collectTargets finds the ".. _name: url" hyperlink targets used by named references
+func (r *rstRenderer) collectTargets() {
+	for _, line := range r.lines {
+		if m := rstTarget.FindStringSubmatch(line); m != nil {
+			r.targets[strings.ToLower(strings.TrimSpace(m[1]))] = m[2]
+		}
+	}
+}
+
+func (r *rstRenderer) render() {
+	for r.pos < len(r.lines) {
+		line := r.lines[r.pos]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			r.pos++
+		case r.title():
+		case isAdornment(line) && len(trimmed) >= 4:
+			r.out.WriteString("<hr>\n")
+			r.pos++
+		case rstCode.MatchString(line):
+			lang := rstCode.FindStringSubmatch(line)[2]
+			r.pos++
+			r.skipOptions()
+			r.literal(lang)
+		case strings.HasPrefix(line, ".."):
+			// Comments, hyperlink targets and directives we don't render
+			r.pos++
+			r.indented()
+		case strings.HasPrefix(line, ">>>"):
+			r.out.WriteString("<pre>" + html.EscapeString(strings.Join(r.block(), "\n")) + "</pre>\n")
+		case strings.HasPrefix(trimmed, "+-") || strings.HasPrefix(trimmed, "==="):
+			r.out.WriteString("<pre>" + html.EscapeString(strings.Join(r.block(), "\n")) + "</pre>\n")
+		case line[0] == ' ':
+			r.out.WriteString("<blockquote>")
+			r.paragraphs(r.indented())
+			r.out.WriteString("</blockquote>\n")
+		case rstBullet.MatchString(line):
+			r.list("ul", rstBullet)
+		case rstEnum.MatchString(line):
+			r.list("ol", rstEnum)
+		default:
+			r.paragraph()
+		}
+	}
+}
+
+// title renders a section title underlined, and optionally overlined, by adornment characters
+func (r *rstRenderer) title() bool {
+	line := r.lines[r.pos]
+	var overline, text, underline string
+	next := r.pos + 1
+	if isAdornment(line) && next+1 < len(r.lines) && strings.TrimSpace(r.lines[next]) != "" && isAdornment(r.lines[next+1]) {
+		overline, text, underline = line, r.lines[next], r.lines[next+1]
+		next += 2
+	} else if next < len(r.lines) && !isAdornment(line) && isAdornment(r.lines[next]) &&
+		len(strings.TrimSpace(r.lines[next])) >= len(strings.TrimSpace(line)) && line[0] != ' ' {
+		text, underline = line, r.lines[next]
+		next++
+	} else {
+		return false
+	}
+	style := string(strings.TrimSpace(underline)[0])
+	if overline != "" {
+		style = "over" + style
+	}
+	level := -1
+	for i, s := range r.styles {
+		if s == style {
+			level = i
+		}
+	}
+	if level < 0 {
+		r.styles = append(r.styles, style)
+		level = len(r.styles) - 1
+	}
+	// The page already has an h1, the name of the package
+	h := string(rune('2' + min(level, 4)))
+	r.out.WriteString("<h" + h + ">" + r.inline(strings.TrimSpace(text)) + "</h" + h + ">\n")
+	r.pos = next
+	return true
+}
+
+// block returns the lines up to the next blank line
+func (r *rstRenderer) block() []string {
+	var lines []string
+	for r.pos < len(r.lines) && strings.TrimSpace(r.lines[r.pos]) != "" {
+		lines = append(lines, r.lines[r.pos])
+		r.pos++
+	}
+	return lines
+}
+
+// indented returns the following indented lines, blank lines included, with the common indentation removed
+func (r *rstRenderer) indented() []string {
+	var lines []string
+	for r.pos < len(r.lines) {
+		line := r.lines[r.pos]
+		if strings.TrimSpace(line) != "" && line[0] != ' ' {
+			break
+		}
+		lines = append(lines, line)
+		r.pos++
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	indent := -1
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if n := len(line) - len(strings.TrimLeft(line, " ")); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	for i, line := range lines {
+		if len(line) >= indent && indent > 0 {
+			lines[i] = line[indent:]
+		} else {
+			lines[i] = strings.TrimSpace(line)
+		}
+	}
+	return lines
+}
+
+// skipOptions skips the ":option: value" lines of a directive
+func (r *rstRenderer) skipOptions() {
+	for r.pos < len(r.lines) && strings.HasPrefix(strings.TrimSpace(r.lines[r.pos]), ":") {
+		r.pos++
+	}
+}
+
+// literal renders the following indented lines as preformatted text
+func (r *rstRenderer) literal(lang string) {
+	for r.pos < len(r.lines) && strings.TrimSpace(r.lines[r.pos]) == "" {
+		r.pos++
+	}
+	lines := r.indented()
+	if len(lines) == 0 {
+		return
+	}
+	class := ""
+	if lang != "" {
+		class = ` class="language-` + html.EscapeString(lang) + `"`
+	}
+	r.out.WriteString("<pre><code" + class + ">" + html.EscapeString(strings.Join(lines, "\n")) + "</code></pre>\n")
+}
+
+// paragraph renders a paragraph, a trailing "::" starts a literal block
+func (r *rstRenderer) paragraph() {
+	text := strings.Join(r.block(), "\n")
+	r.writeParagraph(text)
+	if strings.HasSuffix(text, "::") {
+		r.literal("")
+	}
+}
+
+func (r *rstRenderer) writeParagraph(text string) {
+	if strings.HasSuffix(text, "::") {
+		text = strings.TrimSuffix(text, "::")
+		if strings.HasSuffix(text, " ") || text == "" {
+			text = strings.TrimRight(text, " ")
+		} else {
+			text += ":"
+		}
+	}
+	if text != "" {
+		r.out.WriteString("<p>" + r.inline(text) + "</p>\n")
+	}
+}
+
+// paragraphs renders lines already taken from the document as paragraphs
+func (r *rstRenderer) paragraphs(lines []string) {
+	var para []string
+	for _, line := range append(lines, "") {
+		if strings.TrimSpace(line) == "" {
+			if len(para) > 0 {
+				r.writeParagraph(strings.Join(para, "\n"))
+			}
+			para = nil
+			continue
+		}
+		para = append(para, line)
+	}
+}
+
+// list renders consecutive list items starting with marker
+func (r *rstRenderer) list(tag string, marker *regexp.Regexp) {
+	r.out.WriteString("<" + tag + ">\n")
+	for r.pos < len(r.lines) {
+		line := r.lines[r.pos]
+		loc := marker.FindStringIndex(line)
+		if loc == nil {
+			break
+		}
+		item := []string{line[loc[1]:]}
+		r.pos++
+		for r.pos < len(r.lines) {
+			next := r.lines[r.pos]
+			if strings.TrimSpace(next) == "" {
+				// Items can be separated by blank lines
+				if r.pos+1 < len(r.lines) && marker.MatchString(r.lines[r.pos+1]) {
+					r.pos++
+				}
+				break
+			}
+			if next[0] != ' ' {
+				break
+			}
+			item = append(item, strings.TrimSpace(next))
+			r.pos++
+		}
+		r.out.WriteString("<li>" + r.inline(strings.Join(item, "\n")) + "</li>\n")
+	}
+	r.out.WriteString("</" + tag + ">\n")
+}
+
+// inline renders inline markup and escapes everything else
+func (r *rstRenderer) inline(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range rstInline.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(html.EscapeString(text[last:m[0]]))
+		last = m[1]
+		group := func(i int) string {
+			if m[2*i] < 0 {
+				return ""
+			}
+			return text[m[2*i]:m[2*i+1]]
+		}
+		switch {
+		case m[2] >= 0:
+			b.WriteString("<code>" + html.EscapeString(group(1)) + "</code>")
+		case m[4] >= 0:
+			b.WriteString(`<a href="` + html.EscapeString(group(3)) + `">` + html.EscapeString(group(2)) + "</a>")
+		case m[8] >= 0:
+			b.WriteString("<code>" + html.EscapeString(group(4)) + "</code>")
+		case m[10] >= 0:
+			name := group(5)
+			if url, ok := r.targets[strings.ToLower(name)]; ok && strings.HasSuffix(text[m[0]:m[1]], "_") {
+				b.WriteString(`<a href="` + html.EscapeString(url) + `">` + html.EscapeString(name) + "</a>")
+			} else {
+				b.WriteString("<em>" + html.EscapeString(name) + "</em>")
+			}
+		case m[12] >= 0:
+			b.WriteString("<strong>" + html.EscapeString(group(6)) + "</strong>")
+		case m[14] >= 0:
+			b.WriteString("<em>" + html.EscapeString(group(7)) + "</em>")
+		case m[16] >= 0:
+			url := html.EscapeString(group(8))
+			b.WriteString(`<a href="` + url + `">` + url + "</a>")
+		}
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
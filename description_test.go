@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestRSTHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		rst  string
+		want string
+	}{
+		{
+			name: "titles",
+			rst:  "Title\n=====\n\nSection\n-------\n",
+			want: "<h2>Title</h2>\n<h3>Section</h3>\n",
+		},
+		{
+			name: "inline markup",
+			rst:  "Hello *world* and **bold** and ``code``.",
+			want: "<p>Hello <em>world</em> and <strong>bold</strong> and <code>code</code>.</p>\n",
+		},
+		{
+			name: "bullet list",
+			rst:  "- one\n- two\n",
+			want: "<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n",
+		},
+		{
+			name: "enumerated list",
+			rst:  "1. one\n2. two\n",
+			want: "<ol>\n<li>one</li>\n<li>two</li>\n</ol>\n",
+		},
+		{
+			name: "literal block",
+			rst:  "Example::\n\n    print(1)\n\nafter",
+			want: "<p>Example:</p>\n<pre><code>print(1)</code></pre>\n<p>after</p>\n",
+		},
+		{
+			name: "code block",
+			rst:  ".. code-block:: python\n\n    x = 1\n",
+			want: "<pre><code class=\"language-python\">x = 1</code></pre>\n",
+		},
+		{
+			name: "links",
+			rst:  "See `gopi <https://github.com/leosunmo/gopi>`_ or https://example.com.",
+			want: "<p>See <a href=\"https://github.com/leosunmo/gopi\">gopi</a> or <a href=\"https://example.com\">https://example.com</a>.</p>\n",
+		},
+		{
+			name: "link target",
+			rst:  "Read `the docs`_.\n\n.. _the docs: https://docs.example.com\n",
+			want: "<p>Read <a href=\"https://docs.example.com\">the docs</a>.</p>\n",
+		},
+		{
+			name: "skipped directive",
+			rst:  ".. image:: https://example.com/badge.png\n   :alt: badge\n\ntext",
+			want: "<p>text</p>\n",
+		},
+		{
+			name: "block quote",
+			rst:  "    quoted\n",
+			want: "<blockquote><p>quoted</p>\n</blockquote>\n",
+		},
+		{
+			name: "html is escaped",
+			rst:  "<script>alert(1)</script>",
+			want: "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rstHTML(tt.rst); got != tt.want {
+				t.Errorf("rstHTML(%q) = %q, want %q", tt.rst, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBucket = "gopi"
+
+// fakeObject is an object stored by fakeS3
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+// fakeS3 implements the parts of the S3 API gopi uses, in memory
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	// parts holds the parts of multipart uploads by upload ID and part number
+	parts   map[string]map[int][]byte
+	uploads int
+	// denyPut makes uploads of the keys it returns true for fail
+	denyPut func(key string) bool
+	// denyGet makes reads of the keys it returns true for fail
+	denyGet func(key string) bool
+	// url is the endpoint of the fake server
+	url string
+	// beforePut is called before a put is stored, to let another writer get
+	// in between a read and a conditional write
+	beforePut func(key string)
+	// beforeList is called before objects are listed
+	beforeList func(prefix string)
+}
+
+// newFakeS3 starts a fake S3 server that's stopped when the test ends
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: make(map[string]fakeObject), parts: make(map[string]map[int][]byte)}
+	ts := httptest.NewServer(f)
+	f.url = ts.URL
+	t.Cleanup(ts.Close)
+	return f, ts
+}
+
+// newTestServer returns a gopi server backed by a fake S3 server
+func newTestServer(t *testing.T, cfg serverConfig) (*server, *fakeS3) {
+	f, _ := newFakeS3(t)
+	return newReplica(t, f, cfg), f
+}
+
+// newReplica returns another gopi server using the bucket of f, with every
+// project indexed for search like runBackground does at startup
+func newReplica(t *testing.T, f *fakeS3, cfg serverConfig) *server {
+	s, err := newServer(s3Config{
+		endpoint:  f.url,
+		bucket:    testBucket,
+		accessKey: "test",
+		secretKey: "test",
+	}, cfg)
+	if err != nil {
+		t.Fatalf("Failed to create server, %s", err)
+	}
+	if err := s.indexUnloadedProjects(context.Background()); err != nil {
+		t.Fatalf("Failed to index projects for search, %s", err)
+	}
+	return s
+}
+
+func (f *fakeS3) put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sum := md5.Sum(data)
+	f.objects[key] = fakeObject{data: data, etag: `"` + hex.EncodeToString(sum[:]) + `"`, modified: time.Now().UTC()}
+}
+
+// putIf stores data under key if the If-Match or If-None-Match condition in
+// header holds, reporting whether it did
+func (f *fakeS3) putIf(key string, data []byte, header http.Header) bool {
+	if f.beforePut != nil {
+		f.beforePut(key)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, exists := f.objects[key]
+	if header.Get("If-None-Match") == "*" && exists {
+		return false
+	}
+	if etag := header.Get("If-Match"); etag != "" && (!exists || strings.Trim(etag, `"`) != strings.Trim(o.etag, `"`)) {
+		return false
+	}
+	sum := md5.Sum(data)
+	f.objects[key] = fakeObject{data: data, etag: `"` + hex.EncodeToString(sum[:]) + `"`, modified: time.Now().UTC()}
+	return true
+}
+
+func (f *fakeS3) get(key string) (fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[key]
+	return o, ok
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != testBucket {
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	switch {
+	case key == "" && r.URL.Query().Has("location"):
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+	case key == "" && r.URL.Query().Get("list-type") == "2":
+		if f.beforeList != nil {
+			f.beforeList(r.URL.Query().Get("prefix"))
+		}
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("start-after"))
+	case key == "":
+		w.WriteHeader(http.StatusOK)
+	case r.URL.Query().Has("uploads") || r.URL.Query().Has("uploadId"):
+		f.multipart(w, r, key)
+	case r.Method == http.MethodPut:
+		if f.denyPut != nil && f.denyPut(key) {
+			s3Error(w, r, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		data, err := readPayload(r)
+		if err != nil {
+			s3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		if !f.putIf(key, data, r.Header) {
+			s3Error(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		o, _ := f.get(key)
+		w.Header().Set("ETag", o.etag)
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		if f.denyGet != nil && f.denyGet(key) {
+			s3Error(w, r, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		o, ok := f.get(key)
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", o.etag)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, key, o.modified, bytes.NewReader(o.data))
+	}
+}
+
+// multipart handles the requests of a multipart upload of key
+func (f *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string) {
+	uploadID := r.URL.Query().Get("uploadId")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && uploadID == "":
+		f.uploads++
+		uploadID = strconv.Itoa(f.uploads)
+		f.parts[uploadID] = make(map[int][]byte)
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, testBucket, key, uploadID)
+	case r.Method == http.MethodPut:
+		if f.denyPut != nil && f.denyPut(key) {
+			s3Error(w, r, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		data, err := readPayload(r)
+		if err != nil {
+			s3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		n, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		f.parts[uploadID][n] = data
+		sum := md5.Sum(data)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == http.MethodPost:
+		var data []byte
+		for n := 1; n <= len(f.parts[uploadID]); n++ {
+			data = append(data, f.parts[uploadID][n]...)
+		}
+		delete(f.parts, uploadID)
+		sum := md5.Sum(data)
+		etag := `"` + hex.EncodeToString(sum[:]) + `-1"`
+		f.objects[key] = fakeObject{data: data, etag: etag, modified: time.Now().UTC()}
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`, testBucket, key, etag)
+	case r.Method == http.MethodDelete:
+		delete(f.parts, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// readPayload reads the body of a PUT, decoding the chunks of a streaming signed upload
+func readPayload(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	body := bufio.NewReader(r.Body)
+	for {
+		header, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		chunk := make([]byte, n+2)
+		_, err = io.ReadFull(body, chunk)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return data, nil
+		}
+		data = append(data, chunk[:n]...)
+	}
+}
+
+type fakeListResult struct {
+	XMLName     xml.Name          `xml:"ListBucketResult"`
+	Name        string            `xml:"Name"`
+	Prefix      string            `xml:"Prefix"`
+	KeyCount    int               `xml:"KeyCount"`
+	MaxKeys     int               `xml:"MaxKeys"`
+	IsTruncated bool              `xml:"IsTruncated"`
+	Contents    []fakeListContent `xml:"Contents"`
+}
+
+type fakeListContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, startAfter string) {
+	f.mu.Lock()
+	result := fakeListResult{Name: testBucket, Prefix: prefix, MaxKeys: 1000}
+	for key, o := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > startAfter {
+			result.Contents = append(result.Contents, fakeListContent{
+				Key:          key,
+				LastModified: o.modified.Format(time.RFC3339),
+				ETag:         o.etag,
+				Size:         len(o.data),
+			})
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message><Resource>%s</Resource></Error>`, code, code, r.URL.Path)
+	}
+}
+
+// testPkg returns a file of the demo project
+func testPkg(fileName, version, summary string) pkg {
+	return pkg{
+		Name:            "demo",
+		FileName:        fileName,
+		Version:         version,
+		URL:             "/demo/" + fileName,
+		releaseMetadata: releaseMetadata{Summary: summary},
+	}
+}
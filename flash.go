@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// flashCookie carries flash messages across the redirect after a form is posted
+const flashCookie = "gopi_flash"
+
+// Flash message kinds, named after the Bootstrap alert they're shown as
+const (
+	flashSuccess = "success"
+	flashWarning = "warning"
+	flashError   = "danger"
+)
+
+// flash is a message shown once on the next page
+type flash struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// setFlashes shows flashes on the next page the client loads
+func setFlashes(w http.ResponseWriter, flashes ...flash) {
+	data, err := json.Marshal(flashes)
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(data),
+		Path:     "/",
+		MaxAge:   60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// takeFlashes returns the flashes set by the previous response and clears them
+func takeFlashes(w http.ResponseWriter, r *http.Request) []flash {
+	c, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{Name: flashCookie, Path: "/", MaxAge: -1})
+	data, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return nil
+	}
+	var flashes []flash
+	if json.Unmarshal(data, &flashes) != nil {
+		return nil
+	}
+	return flashes
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fsckOptions controls what the consistency check verifies and fixes
+type fsckOptions struct {
+	// hashes downloads every file to verify its MD5 and SHA256 digests
+	hashes bool
+	// repair fixes the index where possible, objects in the bucket are never changed
+	repair bool
+}
+
+// fsckProblem is a single inconsistency found between the index and the bucket
+type fsckProblem struct {
+	Project  string `json:"project"`
+	File     string `json:"file,omitempty"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+// fsckReport is the result of a consistency check
+type fsckReport struct {
+	Projects int           `json:"projects"`
+	Files    int           `json:"files"`
+	Problems []fsckProblem `json:"problems"`
+}
+
+// fsckProject collects the problems of one project and tracks whether its index needs rewriting
+type fsckProject struct {
+	name     string
+	problems []fsckProblem
+	changed  bool
+	repair   bool
+}
+
+// problem records a problem, fixed reports whether it has been repaired
+func (fp *fsckProject) problem(file string, fixed bool, format string, a ...interface{}) {
+	fixed = fixed && fp.repair
+	fp.problems = append(fp.problems, fsckProblem{
+		Project:  fp.name,
+		File:     file,
+		Problem:  fmt.Sprintf(format, a...),
+		Repaired: fixed,
+	})
+	if fixed {
+		fp.changed = true
+	}
+}
+
+// fsck cross-checks every file in the index with the objects in the bucket.
+// With repair set entries without an object are dropped, sizes and (when
+// verified) hashes are updated from the object, duplicate files are removed,
+// duplicate releases are merged, mismatched project names are corrected,
+// reservations of uploads that never finished are dropped,
+// index documents that list files are converted to releases and the project
+// list is rebuilt from the project index documents.
+func (s *server) fsck(ctx context.Context, opts fsckOptions) (fsckReport, error) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	report := fsckReport{Problems: []fsckProblem{}}
+	objects, err := s.listObjects(ctx, "")
+	if err != nil {
+		return report, err
+	}
+
+	list, err := s.readProjectList(ctx)
+	if errors.Is(err, NoSuchKey) {
+		list, err = make(projectList), nil
+	}
+	if err != nil {
+		return report, err
+	}
+	// Names whose entry in the project list is repaired
+	listChanged := make(map[string]struct{})
+
+	names := make(map[string]struct{})
+	for name := range list {
+		names[name] = struct{}{}
+	}
+	for _, name := range indexDocNames(objects) {
+		names[name] = struct{}{}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	all := make(projectMap)
+	for _, name := range sorted {
+		fp := &fsckProject{name: name, repair: opts.repair}
+		pr, legacy, etag, err := s.readProjectDocument(ctx, name)
+		if err != nil {
+			return report, fmt.Errorf("Failed to read index of project %s, %s", name, err.Error())
+		}
+		report.Projects++
+		if legacy {
+			fp.problem("", true, "%s lists files instead of releases", projectIndexKey(name))
+		} else if pr.Name != name {
+			fp.problem("", true, "%s is named %q", projectIndexKey(name), pr.Name)
+		}
+		seenReleases := make(map[string]struct{})
+		for _, r := range pr.Releases {
+			if _, ok := seenReleases[r.Version]; ok {
+				fp.problem("", true, "duplicate release %s", r.Version)
+			}
+			seenReleases[r.Version] = struct{}{}
+		}
+		checked := pkgs{}
+		seenFiles := make(map[string]struct{})
+		for _, p := range pr.files() {
+			report.Files++
+			if _, ok := seenFiles[p.FileName]; ok {
+				fp.problem(p.FileName, true, "duplicate entry for file")
+				if opts.repair {
+					continue
+				}
+			}
+			seenFiles[p.FileName] = struct{}{}
+			if _, err := parseVersion(p.Version); err != nil {
+				fp.problem(p.FileName, false, "version %q isn't a valid PEP 440 version", p.Version)
+			}
+
+			key := strings.TrimPrefix(p.URL, "/")
+			info, err := s.statObject(ctx, key)
+			if errors.Is(err, NoSuchKey) {
+				fp.problem(p.FileName, true, "object %s doesn't exist", key)
+				if opts.repair {
+					continue
+				}
+				checked = append(checked, p)
+				continue
+			}
+			if err != nil {
+				return report, fmt.Errorf("Failed to stat %s, %s", key, err.Error())
+			}
+			if p.Size != 0 && p.Size != info.Size {
+				fp.problem(p.FileName, true, "size in index is %d but object is %d bytes", p.Size, info.Size)
+			}
+			p.Size = info.Size
+
+			if opts.hashes {
+				md5, sha256, err := s.objectDigests(ctx, key)
+				if err != nil {
+					return report, fmt.Errorf("Failed to download %s, %s", key, err.Error())
+				}
+				if p.MD5 != "" && p.MD5 != md5 {
+					fp.problem(p.FileName, true, "MD5 in index is %s but object is %s", p.MD5, md5)
+				}
+				if p.SHA256 != "" && p.SHA256 != sha256 {
+					fp.problem(p.FileName, true, "SHA256 in index is %s but object is %s", p.SHA256, sha256)
+				}
+				p.MD5, p.SHA256 = md5, sha256
+			} else if etag := strings.Trim(info.ETag, `"`); p.MD5 != "" && !strings.Contains(etag, "-") && etag != p.MD5 {
+				// Objects that weren't uploaded in parts have their MD5 as ETag
+				fp.problem(p.FileName, false, "MD5 in index is %s but object ETag is %s, verify with -hashes", p.MD5, etag)
+			}
+			checked = append(checked, p)
+		}
+
+		fixed := newProject(name, checked)
+		now := time.Now()
+		for _, p := range pr.Pending {
+			if p.stale(now) {
+				fp.problem(p.FileName, true, "upload started at %s never finished", p.UploadTime.Format(time.RFC3339))
+				continue
+			}
+			fixed.Pending = append(fixed.Pending, p)
+		}
+		summary, listed := list[name]
+		switch {
+		case len(checked) == 0 && listed:
+			fp.problem("", true, "listed in %s without any files", projectListFile)
+			delete(list, name)
+			listChanged[name] = struct{}{}
+		case len(checked) > 0 && !listed:
+			fp.problem("", true, "missing from %s", projectListFile)
+			list[name] = newProjectSummary(fixed, time.Now().UTC())
+			listChanged[name] = struct{}{}
+		case len(checked) > 0 && summary.Version != checked.GetLatestVersionPackage().Version:
+			fp.problem("", true, "latest version in %s is %s instead of %s", projectListFile, summary.Version, checked.GetLatestVersionPackage().Version)
+			list[name] = newProjectSummary(fixed, time.Now().UTC())
+			listChanged[name] = struct{}{}
+		}
+
+		report.Problems = append(report.Problems, fp.problems...)
+		all[name] = fixed
+		if opts.repair && fp.changed {
+			// Other gopi servers don't hold s.indexMu, only repair what was checked
+			err := s.putProjectIf(ctx, name, fixed, etag)
+			if errors.Is(err, PreconditionFailed) {
+				return report, fmt.Errorf("Failed to write index for project %s, it changed while it was checked, run fsck again", name)
+			}
+			if err != nil {
+				return report, fmt.Errorf("Failed to write index for project %s, %s", name, err.Error())
+			}
+			s.logChange(ctx, name, "", actionRepair)
+		}
+	}
+
+	if opts.repair && len(listChanged) > 0 {
+		// Only the repaired entries are written, other entries may have
+		// changed since the list was read
+		repaired := list
+		list, err = s.updateProjectList(ctx, func(current projectList) {
+			for name := range listChanged {
+				if ps, ok := repaired[name]; ok {
+					current[name] = ps
+				} else {
+					delete(current, name)
+				}
+			}
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	if opts.repair {
+		s.index.reset(list, all)
+		s.search.reset(all)
+	}
+	return report, nil
+}
+
+func (r fsckReport) print() {
+	for _, p := range r.Problems {
+		slog.Info("Index problem", "project", p.Project, "file", p.File, "problem", p.Problem, "repaired", p.Repaired)
+	}
+	slog.Info("Checked index", "files", r.Files, "projects", r.Projects, "problems", len(r.Problems))
+}
+
+// runFsck implements the "gopi fsck" command
+func runFsck(s3cfg s3Config, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	hashes := fs.Bool("hashes", false, "Download every file to verify its MD5 and SHA256 digests")
+	repair := fs.Bool("repair", false, "Fix the problems found in the index where possible")
+	fs.Parse(args)
+
+	s, err := newStorageServer(s3cfg)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	err = s.loadJournal(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to load journal, %s", err.Error())
+	}
+	report, err := s.fsck(ctx, fsckOptions{hashes: *hashes, repair: *repair})
+	if err != nil {
+		return err
+	}
+	report.print()
+	if len(report.Problems) > 0 && !*repair {
+		return fmt.Errorf("Found %d problems, run with -repair to fix them", len(report.Problems))
+	}
+	return nil
+}
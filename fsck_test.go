@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// putProjectDoc stores pr as the index document of name, with an object for every file
+func putProjectDoc(t *testing.T, f *fakeS3, name string, pr project) {
+	t.Helper()
+	data, err := json.Marshal(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.put(projectIndexKey(name), data)
+	for _, r := range pr.Releases {
+		for _, file := range r.Files {
+			f.put(name+pathSeparator+file.FileName, []byte(file.FileName))
+		}
+	}
+}
+
+// testRelease returns a release of demo with a source distribution per file name
+func testRelease(version string, fileNames ...string) release {
+	r := release{Version: version}
+	for _, name := range fileNames {
+		r.Files = append(r.Files, distFile{FileName: name, URL: "/demo/" + name, Size: int64(len(name))})
+	}
+	return r
+}
+
+// problems returns the problem descriptions of a report
+func problems(r fsckReport) []string {
+	var ps []string
+	for _, p := range r.Problems {
+		ps = append(ps, p.Problem)
+	}
+	return ps
+}
+
+func TestFsckProjectName(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	putProjectDoc(t, f, "demo", project{Name: "other", Releases: []release{testRelease("1.0", "demo-1.0.tar.gz")}})
+	if err := s.writeProjectList(ctx, projectList{"demo": {Version: "1.0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.fsck(ctx, fsckOptions{})
+	if err != nil {
+		t.Fatalf("fsck() error = %s", err)
+	}
+	want := `demo/index.json is named "other"`
+	if ps := problems(report); len(ps) != 1 || ps[0] != want || report.Problems[0].Repaired {
+		t.Fatalf("Problems are %+v, want %q", report.Problems, want)
+	}
+
+	report, err = s.fsck(ctx, fsckOptions{repair: true})
+	if err != nil {
+		t.Fatalf("fsck() error = %s", err)
+	}
+	if len(report.Problems) != 1 || !report.Problems[0].Repaired {
+		t.Fatalf("Problems are %+v, want the name repaired", report.Problems)
+	}
+	pr, _, _, err := s.readProjectDocument(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read project, %s", err)
+	}
+	if pr.Name != "demo" {
+		t.Errorf("Project is named %q after the repair, want demo", pr.Name)
+	}
+	if report, _ := s.fsck(ctx, fsckOptions{}); len(report.Problems) != 0 {
+		t.Errorf("Problems after the repair are %v, want none", problems(report))
+	}
+}
+
+func TestFsckDuplicateReleases(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	putProjectDoc(t, f, "demo", project{Name: "demo", Releases: []release{
+		testRelease("1.0", "demo-1.0.tar.gz"),
+		testRelease("1.0", "demo-1.0-py3-none-any.whl"),
+	}})
+	if err := s.writeProjectList(ctx, projectList{"demo": {Version: "1.0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.fsck(ctx, fsckOptions{})
+	if err != nil {
+		t.Fatalf("fsck() error = %s", err)
+	}
+	want := "duplicate release 1.0"
+	if ps := problems(report); len(ps) != 1 || ps[0] != want {
+		t.Fatalf("Problems are %v, want %q", ps, want)
+	}
+
+	_, err = s.fsck(ctx, fsckOptions{repair: true})
+	if err != nil {
+		t.Fatalf("fsck() error = %s", err)
+	}
+	pr, err := s.readProject(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read project, %s", err)
+	}
+	if len(pr.Releases) != 1 || len(pr.Releases[0].Files) != 2 {
+		t.Fatalf("Releases after the repair are %+v, want one with both files", pr.Releases)
+	}
+	if report, _ := s.fsck(ctx, fsckOptions{}); len(report.Problems) != 0 {
+		t.Errorf("Problems after the repair are %v, want none", problems(report))
+	}
+}
+
+func TestFsckStaleUpload(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	stale := testPkg("demo-1.0.tar.gz", "1.0", "first")
+	stale.UploadTime = time.Now().Add(-pendingUploadTimeout - time.Minute)
+	running := testPkg("demo-1.0-py3-none-any.whl", "1.0", "first")
+	running.UploadTime = time.Now()
+	putProjectDoc(t, f, "demo", project{Name: "demo", Releases: []release{}, Pending: []pkg{stale, running}})
+
+	report, err := s.fsck(ctx, fsckOptions{repair: true})
+	if err != nil {
+		t.Fatalf("fsck() error = %s", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].File != stale.FileName || !report.Problems[0].Repaired {
+		t.Fatalf("Problems are %+v, want the stale upload repaired", report.Problems)
+	}
+	pr, err := s.readProject(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read project, %s", err)
+	}
+	if len(pr.Pending) != 1 || pr.Pending[0].FileName != running.FileName {
+		t.Errorf("Pending uploads are %+v, want only %s", pr.Pending, running.FileName)
+	}
+}
+
+func TestFsckRepairKeepsConcurrentChanges(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	replica := newReplica(t, f, serverConfig{})
+	putProjectDoc(t, f, "demo", project{Name: "demo", Releases: []release{testRelease("1.0", "demo-1.0.tar.gz")}})
+	f.put(projectListFile, []byte(`{"other":{"version":"1.0"}}`))
+
+	// The replica uploads just before fsck repairs the project
+	f.beforePut = func(key string) {
+		if key != projectIndexKey("demo") {
+			return
+		}
+		f.beforePut = nil
+		storeTestPkg(t, replica, testPkg("demo-1.1.tar.gz", "1.1", ""))
+	}
+	if _, err := s.fsck(ctx, fsckOptions{repair: true}); err == nil {
+		t.Fatal("fsck repaired a project that changed while it was checked, want an error")
+	}
+	pr, err := s.readProject(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read project, %s", err)
+	}
+	if pr.findRelease("1.1") == nil {
+		t.Errorf("releases are %+v, want the upload of the replica kept", pr.Releases)
+	}
+
+	// Run again the project list is repaired, keeping the entry the replica wrote
+	if _, err := s.fsck(ctx, fsckOptions{repair: true}); err != nil {
+		t.Fatalf("fsck() error = %s", err)
+	}
+	list, err := s.readProjectList(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read project list, %s", err)
+	}
+	if _, ok := list["other"]; ok || list["demo"].Version != "1.1" {
+		t.Errorf("project list is %+v, want only demo 1.1", list)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	md5Sum, sha256Sum := fileDigests([]byte("demo-1.0.tar.gz"))
+	tests := []struct {
+		name string
+		// change alters the index document and the project list of a consistent project
+		change func(pr *project, list projectList)
+		opts   fsckOptions
+		want   []fsckProblem
+	}{
+		{
+			name:   "consistent",
+			change: func(pr *project, list projectList) {},
+		},
+		{
+			name: "missing object",
+			change: func(pr *project, list projectList) {
+				pr.Releases = append(pr.Releases, testRelease("0.9", "demo-0.9.tar.gz"))
+			},
+			want: []fsckProblem{{File: "demo-0.9.tar.gz", Problem: "object demo/demo-0.9.tar.gz doesn't exist", Repaired: true}},
+		},
+		{
+			name: "size mismatch",
+			change: func(pr *project, list projectList) {
+				pr.findRelease("1.0").Files[0].Size = 1
+			},
+			want: []fsckProblem{{File: "demo-1.0.tar.gz", Problem: "size in index is 1 but object is 15 bytes", Repaired: true}},
+		},
+		{
+			name: "hash mismatch",
+			change: func(pr *project, list projectList) {
+				pr.findRelease("1.0").Files[0].SHA256 = "bad"
+			},
+			opts: fsckOptions{hashes: true},
+			want: []fsckProblem{{File: "demo-1.0.tar.gz", Problem: "SHA256 in index is bad but object is " + sha256Sum, Repaired: true}},
+		},
+		{
+			name: "ETag mismatch",
+			change: func(pr *project, list projectList) {
+				pr.findRelease("1.0").Files[0].MD5 = "bad"
+			},
+			want: []fsckProblem{{File: "demo-1.0.tar.gz", Problem: "MD5 in index is bad but object ETag is " + md5Sum + ", verify with -hashes"}},
+		},
+		{
+			name: "duplicate file",
+			change: func(pr *project, list projectList) {
+				r := pr.findRelease("1.0")
+				r.Files = append(r.Files, r.Files[0])
+			},
+			want: []fsckProblem{{File: "demo-1.0.tar.gz", Problem: "duplicate entry for file", Repaired: true}},
+		},
+		{
+			name: "legacy index document",
+			change: func(pr *project, list projectList) {
+				pr.Name = ""
+			},
+			want: []fsckProblem{{Problem: "demo/index.json lists files instead of releases", Repaired: true}},
+		},
+		{
+			name: "missing from project list",
+			change: func(pr *project, list projectList) {
+				delete(list, "demo")
+			},
+			want: []fsckProblem{{Problem: "missing from projects.json", Repaired: true}},
+		},
+		{
+			name: "outdated project list",
+			change: func(pr *project, list projectList) {
+				list["demo"] = projectSummary{Version: "0.1"}
+			},
+			want: []fsckProblem{{Problem: "latest version in projects.json is 0.1 instead of 1.1", Repaired: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, f := newTestServer(t, serverConfig{})
+			pr := project{Name: "demo", Releases: []release{
+				testRelease("1.1", "demo-1.1.tar.gz"),
+				testRelease("1.0", "demo-1.0.tar.gz"),
+			}}
+			putProjectDoc(t, f, "demo", pr)
+			pr.findRelease("1.0").Files[0].MD5 = md5Sum
+			pr.findRelease("1.0").Files[0].SHA256 = sha256Sum
+			list := projectList{"demo": {Version: "1.1"}}
+			tt.change(&pr, list)
+
+			var data []byte
+			var err error
+			if pr.Name == "" {
+				data, err = json.Marshal(pr.files())
+			} else {
+				data, err = json.Marshal(pr)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.put(projectIndexKey("demo"), data)
+			if err := s.writeProjectList(ctx, list); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, repair := range []bool{false, true} {
+				opts := tt.opts
+				opts.repair = repair
+				report, err := s.fsck(ctx, opts)
+				if err != nil {
+					t.Fatalf("fsck() error = %s", err)
+				}
+				want := []fsckProblem{}
+				for _, p := range tt.want {
+					p.Project = "demo"
+					p.Repaired = p.Repaired && repair
+					want = append(want, p)
+				}
+				if !reflect.DeepEqual(report.Problems, want) {
+					t.Errorf("problems with repair %v are %+v, want %+v", repair, report.Problems, want)
+				}
+				if report.Projects != 1 {
+					t.Errorf("checked %d projects, want 1", report.Projects)
+				}
+			}
+
+			// Only the problems that can't be repaired are left
+			report, err := s.fsck(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("fsck() error = %s", err)
+			}
+			for _, p := range report.Problems {
+				if p.Repaired || fixable(tt.want, p.Problem) {
+					t.Errorf("problem %q is left after the repair", p.Problem)
+				}
+			}
+		})
+	}
+}
+
+// fixable reports whether problem is one of the repairable problems in ps
+func fixable(ps []fsckProblem, problem string) bool {
+	for _, p := range ps {
+		if p.Problem == problem && p.Repaired {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,11 +19,10 @@ import (
 	"github.com/gorilla/rpc"
 
 	"github.com/minio/minio-go"
-	"github.com/minio/minio/pkg/console"
 )
 
 func (s *server) RPCRequestInfo(i *rpc.RequestInfo) {
-	console.Debugf("[RPC2Handler] path %s hit by method %s\n", i.Request.URL.Path, i.Method)
+	logger(i.Request.Context()).Debug("RPC call", "path", i.Request.URL.Path, "method", i.Method)
 }
 
 func (s *server) NotFoundHandler() http.HandlerFunc {
@@ -26,128 +31,634 @@ func (s *server) NotFoundHandler() http.HandlerFunc {
 	}
 }
 
+// HomeHandler lists the packages, filtered by the "q" query parameter, sorted
+// by "sort" and paged by "page"
 func (s *server) HomeHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := s.templates.ExecuteTemplate(w, "home.tpl.html", s.packages)
+		page, err := s.listProjects(r.Context(), parseListQuery(r.URL.Query()))
 		if err != nil {
-			console.Errorf("Failed to execute template, %s\n", err.Error())
+			logger(r.Context()).Error("Failed to list packages", "err", err)
+			http.Error(w, "Failed to list packages", http.StatusInternalServerError)
+			return
+		}
+		err = s.templates.ExecuteTemplate(w, "home.tpl.html", page)
+		if err != nil {
+			logger(r.Context()).Error("Failed to execute template", "err", err)
+		}
+	}
+}
+
+// detailsPage is the template data of the package and version details pages
+type detailsPage struct {
+	Name      string
+	Packages  packageMap
+	Downloads *projectStats
+	// Version is the version shown, the latest one on the package page
+	Version string
+	Latest  string
+	// Newer and Older are the neighbouring versions of Version, if any
+	Newer    string
+	Older    string
+	Releases []release
+	// Release is the release of Version
+	Release     release
+	Description template.HTML
+	ProjectURLs []projectURL
+	// Owners and Maintainers may upload and manage the package
+	Owners      []string
+	Maintainers []string
+	// IndexURL is the simple index to install from
+	IndexURL string
+}
+
+// projectURL is a labelled link of a project, such as its homepage or issue tracker
+type projectURL struct {
+	Label string
+	URL   string
+}
+
+// projectURLs returns the homepage and "label, url" project URLs of a release
+func projectURLs(md releaseMetadata) []projectURL {
+	var urls []projectURL
+	if md.HomePage != "" {
+		urls = append(urls, projectURL{Label: "Homepage", URL: md.HomePage})
+	}
+	for _, u := range md.ProjectURLs {
+		label, link, ok := strings.Cut(u, ",")
+		if !ok {
+			label, link = u, u
 		}
+		urls = append(urls, projectURL{Label: strings.TrimSpace(label), URL: strings.TrimSpace(link)})
 	}
+	return urls
 }
 
+// DetailsHandler shows the latest version of a package, or the version in the path
 func (s *server) DetailsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if vars["package"] == "" {
+		if vars["package"] == "" || !s.index.exists(vars["package"]) {
 			http.Error(w, "Package not found", http.StatusNotFound)
+			return
+		}
+		if v := r.URL.Query().Get("version"); v != "" && vars["version"] == "" {
+			http.Redirect(w, r, fmt.Sprintf("/package/%s/%s/", vars["package"], url.PathEscape(v)), http.StatusFound)
+			return
+		}
+		pr, err := s.project(r.Context(), vars["package"])
+		if err != nil {
+			logger(r.Context()).Error("Failed to load package", "package", vars["package"], "err", err)
+			http.Error(w, "Failed to load package", http.StatusInternalServerError)
+			return
+		}
+		latest := pr.latest().Version
+		version := vars["version"]
+		if version == "" {
+			version = latest
+		}
+		current := pr.findRelease(version)
+		if current == nil && vars["version"] != "" {
+			http.Error(w, "Version not found", http.StatusNotFound)
+			return
+		}
+		stats, err := s.projectStats(r.Context(), vars["package"])
+		if err != nil {
+			// The page is still useful without download counts
+			logger(r.Context()).Error("Failed to load download stats", "package", vars["package"], "err", err)
+			stats = newProjectStats()
+		}
+		data := detailsPage{
+			Name:      vars["package"],
+			Packages:  packageMap{vars["package"]: pr.files()},
+			Downloads: stats,
+			Version:   version,
+			Latest:    latest,
+			Releases:  pr.Releases,
+			IndexURL:  baseURL(r) + "/simple/",
+		}
+		for i, release := range data.Releases {
+			if release.Version != version {
+				continue
+			}
+			if i > 0 {
+				data.Newer = data.Releases[i-1].Version
+			}
+			if i+1 < len(data.Releases) {
+				data.Older = data.Releases[i+1].Version
+			}
+		}
+		if current != nil {
+			data.Release = *current
+			data.Description = renderDescription(current.Description, current.DescriptionContentType)
+			data.ProjectURLs = projectURLs(current.releaseMetadata)
+		}
+		access, err := s.readAccess(r.Context(), vars["package"])
+		if err != nil {
+			logger(r.Context()).Error("Failed to read project access", "package", vars["package"], "err", err)
+		}
+		data.Owners, data.Maintainers = access.Owners, access.Maintainers
+		err = s.templates.ExecuteTemplate(w, "details.tpl.html", data)
+		if err != nil {
+			logger(r.Context()).Error("Failed to execute template", "err", err)
 		}
-		p := packageMap{vars["package"]: s.packages[vars["package"]]}
-		s.templates.ExecuteTemplate(w, "details.tpl.html", p)
 	}
 }
 
-func (s *server) SimpleHandler() http.HandlerFunc {
-	err := s.readPackagesJSON()
-	if err != nil {
-		if !errors.Is(err, NoSuchKey) {
-			console.Fatalf("Failed to read package JSON from bucket: %s\n", err.Error())
+// baseURL returns the scheme and host clients use to reach gopi, honouring
+// the X-Forwarded-Proto header of a proxy terminating TLS in front of it
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// StatsHandler returns the download stats of a package as JSON
+func (s *server) StatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := normalisePackageName(mux.Vars(r)["package"])
+		if !s.index.exists(name) {
+			http.Error(w, "Package not found", http.StatusNotFound)
+			return
+		}
+		stats, err := s.projectStats(r.Context(), name)
+		if err != nil {
+			logger(r.Context()).Error("Failed to load download stats", "package", name, "err", err)
+			http.Error(w, "Failed to load download stats", http.StatusInternalServerError)
+			return
 		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"name":          name,
+			"total":         stats.Total,
+			"last_download": stats.LastDownload(),
+			"versions":      stats.Versions(),
+			"files":         stats.Files,
+		})
 	}
-	list, err := template.ParseFiles("templates/packages.tpl.html")
-	if err != nil {
-		console.Fatalf("Failed to parse package list HTML template: %s\n", err.Error())
+}
+
+// projectDownloads is the download summary of a project in the stats overview
+type projectDownloads struct {
+	Name         string `json:"name"`
+	Total        int    `json:"total"`
+	LastDownload string `json:"last_download"`
+}
+
+// StatsOverviewHandler returns the total downloads of every package as JSON,
+// least downloaded first to make unused packages easy to spot
+func (s *server) StatsOverviewHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		summaries, err := s.downloadSummaries(r.Context())
+		if err != nil {
+			logger(r.Context()).Error("Failed to load download stats", "err", err)
+			http.Error(w, "Failed to load download stats", http.StatusInternalServerError)
+			return
+		}
+		projects := []projectDownloads{}
+		for _, name := range s.index.projectList().sortedNames() {
+			projects = append(projects, projectDownloads{
+				Name:         name,
+				Total:        summaries[name].Total,
+				LastDownload: summaries[name].LastDownload,
+			})
+		}
+		sort.SliceStable(projects, func(i, j int) bool {
+			return projects[i].Total < projects[j].Total
+		})
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"projects": projects,
+		})
 	}
-	singlePackage, err := template.ParseFiles("templates/package.tpl.html")
+}
+
+// searchPage is the template data of the search page
+type searchPage struct {
+	Query   string
+	Results []searchResult
+}
+
+func (s *server) SearchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		data := searchPage{Query: q, Results: s.search.search(q, searchResultLimit(r))}
+		err := s.templates.ExecuteTemplate(w, "search.tpl.html", data)
+		if err != nil {
+			logger(r.Context()).Error("Failed to execute template", "err", err)
+		}
+	}
+}
+
+func (s *server) SearchAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		results := s.search.search(q, searchResultLimit(r))
+		if results == nil {
+			results = []searchResult{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"query":   q,
+			"results": results,
+		})
+	}
+}
+
+// searchResultLimit reads the "limit" query parameter, defaulting to 50 results
+func searchResultLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return 50
+	}
+	return limit
+}
+
+// writeJSON encodes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
 	if err != nil {
-		console.Fatalf("Failed to parse package HTML template: %s\n", err.Error())
+		slog.Error("Failed to encode JSON response", "err", err)
 	}
+}
+
+func (s *server) SimpleHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		vars := mux.Vars(r)
 		if vars["package"] == "" {
-			list.Execute(w, s.packages)
+			w.Header().Set("X-PyPI-Last-Serial", strconv.Itoa(s.changelog.lastSerial()))
+			s.templates.ExecuteTemplate(w, "packages.tpl.html", s.index.projectList().sortedNames())
 		} else {
-			p := packageMap{vars["package"]: s.packages[vars["package"]]}
-			singlePackage.Execute(w, p)
+			pr, err := s.project(r.Context(), vars["package"])
+			if err != nil {
+				logger(r.Context()).Error("Failed to load package", "package", vars["package"], "err", err)
+				http.Error(w, "Failed to load package", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("X-PyPI-Last-Serial", strconv.Itoa(s.changelog.projectSerial(vars["package"])))
+			p := packageMap{vars["package"]: pr.files().sorted()}
+			s.templates.ExecuteTemplate(w, "package.tpl.html", p)
 		}
 		return
 	}
 }
 
+// ChangelogHandler returns the journal entries after the "since" serial as JSON
+func (s *server) ChangelogHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since := 0
+		if v := r.URL.Query().Get("since"); v != "" {
+			var err error
+			since, err = strconv.Atoi(v)
+			if err != nil || since < 0 {
+				http.Error(w, fmt.Sprintf("Invalid since serial %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		lastSerial := s.changelog.lastSerial()
+		entries := s.changelog.since(since)
+		w.Header().Set("X-PyPI-Last-Serial", strconv.Itoa(lastSerial))
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"last_serial": lastSerial,
+			"entries":     entries,
+		})
+	}
+}
+
+// ReindexHandler starts rebuilding the package index from the bucket in the
+// background and returns its status as JSON, 409 Conflict if a reindex is
+// running already. Setting the "extract" query parameter re-reads metadata
+// from every file, "dryRun" doesn't write anything.
+func (s *server) ReindexHandler() http.HandlerFunc {
+	return s.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		opts := reindexOptions{
+			extract: queryBool(r, "extract"),
+			dryRun:  queryBool(r, "dryRun"),
+		}
+		// The reindex outlives the request
+		status, started := s.startReindex(context.WithoutCancel(r.Context()), opts)
+		if !started {
+			writeJSON(w, http.StatusConflict, status)
+			return
+		}
+		w.Header().Set("Location", "/admin/reindex")
+		writeJSON(w, http.StatusAccepted, status)
+	})
+}
+
+// ReindexStatusHandler returns the status of the last reindex started by
+// ReindexHandler as JSON, with its report once it's done
+func (s *server) ReindexStatusHandler() http.HandlerFunc {
+	return s.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.reindexStatus())
+	})
+}
+
+// RefreshHandler reloads the index from the bucket straight away, for use
+// as a notification hook when another gopi server changes the index
+func (s *server) RefreshHandler() http.HandlerFunc {
+	return s.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		err := s.refreshIndex(r.Context())
+		if err != nil {
+			logger(r.Context()).Error("Failed to refresh index", "err", err)
+			http.Error(w, fmt.Sprintf("Failed to refresh index: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.indexStatus())
+	})
+}
+
+// OwnersHandler makes the "user" query parameter an owner of the "package"
+// one and returns its owners and maintainers as JSON. It's how projects
+// nobody has claimed get an owner.
+func (s *server) OwnersHandler() http.HandlerFunc {
+	return s.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		name := normalisePackageName(r.URL.Query().Get("package"))
+		user := strings.TrimSpace(r.URL.Query().Get("user"))
+		if name == "" || user == "" {
+			http.Error(w, "The package and user query parameters are required", http.StatusBadRequest)
+			return
+		}
+		if !s.index.exists(name) {
+			http.Error(w, "Package not found", http.StatusNotFound)
+			return
+		}
+		err := s.addRole(r.Context(), name, user, roleOwner)
+		if err != nil {
+			logger(r.Context()).Error("Failed to add owner", "package", name, "user", user, "err", err)
+			http.Error(w, fmt.Sprintf("Failed to add owner: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		logger(r.Context()).Info("Added owner", "package", name, "owner", user)
+		access, err := s.readAccess(r.Context(), name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read owners: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"package":     name,
+			"owners":      access.Owners,
+			"maintainers": access.Maintainers,
+		})
+	})
+}
+
+// IndexStatusHandler reports how up to date the in-memory index is
+func (s *server) IndexStatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.indexStatus())
+	}
+}
+
+// queryBool reads a boolean query parameter, a parameter without a value counts as true
+func queryBool(r *http.Request, name string) bool {
+	values, ok := r.URL.Query()[name]
+	if !ok {
+		return false
+	}
+	if len(values) == 0 || values[0] == "" {
+		return true
+	}
+	b, _ := strconv.ParseBool(values[0])
+	return b
+}
+
 // Path is "/simple(/)?" POSTs only
 func (s *server) UploadHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
+		allowLongTransfer(w, r)
+		uploader, ok := s.identify(r)
+		if _, _, sent := r.BasicAuth(); !ok && sent && s.cfg.identified {
+			// Wrong credentials aren't taken for an anonymous upload
+			s.unauthorized(w)
+			return
+		}
+		if s.cfg.maxUploadSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, s.cfg.maxUploadSize)
+		}
+		err := r.ParseMultipartForm(32 << 20)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.metrics.uploadFailed(err)
+			logger(r.Context()).Warn("Upload too large", "limit", tooLarge.Limit)
+			http.Error(w, fmt.Sprintf("Upload is larger than the limit of %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
 		action := r.FormValue(":action")
 		switch action {
 		case "file_upload":
-			console.Debugf("Path: %s\tPackage: %s\tVersion: %s\n", vars["pkg"], r.FormValue("name"), r.FormValue("version"))
-			err := r.ParseForm()
+			log := logger(r.Context())
+			err = r.ParseForm()
 			if err != nil {
-				console.Errorf("Failed to parse form, err: %s\n", err.Error())
+				log.Error("Failed to parse form", "err", err)
 				http.Error(w, fmt.Sprintf("Failed to parse form"), http.StatusInternalServerError)
 				return
 			}
-			console.Debugf("FormValues:\n%+v\n\n", r.PostForm)
 			packageName := normalisePackageName(r.FormValue("name"))
-			console.Debugf("packageName %s\n", packageName)
-			r.ParseMultipartForm(32 << 20) // limit your max input length!
+			log.Debug("Upload form", "package", packageName, formAttr("form", r.PostForm))
 
 			version := r.FormValue("version")
-			summary := r.FormValue("summary")
-			md5 := r.FormValue("md5_digest")
 
 			file, header, err := r.FormFile("content")
+			if err != nil {
+				log.Error("Failed to read file from form", "err", err)
+				s.metrics.uploadFailed(InvalidFormat)
+				http.Error(w, "Missing distribution file in form field \"content\"", http.StatusBadRequest)
+				return
+			}
 
 			if packageName == "" {
-				console.Infoln("No package name detected in form, using filename as package name")
+				log.Info("No package name detected in form, using filename as package name")
 				name := strings.Split(header.Filename, ".")
 				packageName = normalisePackageName(name[0])
 			}
 			s3Location := fmt.Sprintf("%s%s%s", packageName, pathSeparator, header.Filename)
-			// Save to package list in server
-			err = s.addPackage(newPkg(header.Filename, version, summary, md5, s3Location))
+			p := newPkg(header.Filename, s3Location, r.Form)
+			p.Size = header.Size
+			err = s.storeUpload(r.Context(), p, file, uploader)
 			if err != nil {
-				if errors.Is(err, AlreadyExists) {
-					console.Errorf("Package %s, version %s already exists\n", header.Filename, version)
-					http.Error(w, fmt.Sprintf("Package already exists"), http.StatusConflict)
-					return
-				}
-				console.Errorf("Failed to write package list, err: %s\n", header.Filename, err.Error())
-				http.Error(w, fmt.Sprintf("Failed to upload file %s", header.Filename), http.StatusInternalServerError)
+				s.metrics.uploadFailed(err)
+				status, msg := uploadError(err, header.Filename)
+				log.Warn("Failed to upload file", "file", header.Filename, "version", version, "status", status, "err", err)
+				http.Error(w, msg, status)
 				return
 			}
-			uploadedSize, err := s.s3.PutObject(s.s3cfg.bucket, s3Location, file, -1, minio.PutObjectOptions{ContentType: "application/octet-stream"})
-			if err != nil {
-				console.Errorf("Failed to upload file %s, err %s\n", header.Filename, err.Error())
-				http.Error(w, fmt.Sprintf("Failed to upload file %s", header.Filename), http.StatusInternalServerError)
-				return
-			}
-			console.Infof("Put object %s, size %d\n", header.Filename, uploadedSize)
 		default:
-			console.Errorf("Form action %s not supported\n", action)
+			logger(r.Context()).Warn("Form action not supported", "action", action)
 			http.Error(w, fmt.Sprintf("Unsupported form action %s", action), http.StatusNotFound)
 			return
 		}
 	}
 }
 
+// storeUpload adds an uploaded distribution file to the index and stores it
+// in the bucket. Only owners and maintainers may upload to a claimed project
+// and the first identified uploader of a new project claims it once the file
+// is published, see authorizeUpload. A file that loses the race for the
+// claim is withdrawn. uploader is the zero identity for anonymous uploads.
+func (s *server) storeUpload(ctx context.Context, p pkg, file io.Reader, uploader identity) error {
+	if p.Name == "" || p.Version == "" {
+		return InvalidFormat
+	}
+	if uploader.project != "" && uploader.project != p.Name {
+		// Package tokens can only upload their own project
+		return NotAllowed
+	}
+	claim, err := s.authorizeUpload(ctx, p.Name, uploader)
+	if err != nil {
+		return err
+	}
+	p.UploadTime = time.Now().UTC()
+	p.Uploader = uploader.name
+	err = s.reservePackage(ctx, p)
+	if err != nil {
+		return err
+	}
+	key := strings.TrimPrefix(p.URL, "/")
+	putCtx, done := s.storageCall(ctx, "put", key)
+	uploadedSize, err := s.s3.PutObjectWithContext(putCtx, s.s3cfg.bucket, key, file, -1, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	if err != nil {
+		err = toS3Error(err)
+	}
+	done(err)
+	if err != nil {
+		// The put may have failed because the client went away, the cancellation mustn't
+		if cancelErr := s.cancelReservation(context.WithoutCancel(ctx), p); cancelErr != nil {
+			logger(ctx).Error("Failed to free the name of a file that couldn't be stored, it's reserved until the upload times out", "file", p.FileName, "timeout", pendingUploadTimeout, "err", cancelErr)
+		}
+		return err
+	}
+	// Only published once the object is there, so installers never see a file they can't download
+	err = s.publishPackage(context.WithoutCancel(ctx), p)
+	if err != nil {
+		return err
+	}
+	// Claimed once the file is published so failed uploads don't take the name
+	if claim {
+		err = s.claimProject(context.WithoutCancel(ctx), p.Name, uploader)
+		if err != nil {
+			if withdrawErr := s.withdrawPackage(context.WithoutCancel(ctx), p); withdrawErr != nil {
+				logger(ctx).Error("Failed to withdraw a file uploaded to a project claimed by someone else", "file", p.FileName, "err", withdrawErr)
+			}
+			return err
+		}
+	}
+	s.metrics.uploadSize.Observe(float64(uploadedSize))
+	logger(ctx).Info("Put object", "file", p.FileName, "size", uploadedSize, "uploader", p.Uploader)
+	return nil
+}
+
+// uploadError returns the status code and message telling the client why an upload failed
+func uploadError(err error, fileName string) (int, string) {
+	switch {
+	case errors.Is(err, InvalidFormat):
+		return http.StatusBadRequest, fmt.Sprintf("%s isn't a distribution file with a name and version", fileName)
+	case errors.Is(err, AlreadyExists):
+		return http.StatusConflict, fmt.Sprintf("File %s already exists", fileName)
+	case errors.Is(err, FileNameReused):
+		return http.StatusConflict, fmt.Sprintf("File %s was deleted and file names can't be reused, upload it with a new version", fileName)
+	case errors.Is(err, errAnonymousProject):
+		return http.StatusForbidden, fmt.Sprintf("Not allowed to upload %s anonymously, log in to upload a new project", fileName)
+	case errors.Is(err, errUnownedProject):
+		return http.StatusForbidden, fmt.Sprintf("Not allowed to upload %s, the project has no owner yet, ask an admin to assign one", fileName)
+	case errors.Is(err, NotAllowed):
+		return http.StatusForbidden, fmt.Sprintf("Not allowed to upload %s, only owners and maintainers of the project may", fileName)
+	}
+	return http.StatusInternalServerError, fmt.Sprintf("Failed to upload file %s", fileName)
+}
+
 func (s *server) DownloadHander() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		p := vars["package"]
 		f := vars["file"]
-		loc := fmt.Sprintf("%s/%s", p, f)
+		p, err := s.findFile(r.Context(), normalisePackageName(vars["package"]), f)
+		if err != nil {
+			logger(r.Context()).Error("Failed to load package", "package", vars["package"], "err", err)
+			http.Error(w, "Failed to load package", http.StatusInternalServerError)
+			return
+		}
+		if p.FileName == "" {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		loc := strings.TrimPrefix(p.URL, "/")
+		// Only count the first request of ranged downloads
+		count := r.Method == http.MethodGet && (r.Header.Get("Range") == "" || strings.HasPrefix(r.Header.Get("Range"), "bytes=0-"))
+		if s.cfg.downloadMode == downloadStream {
+			allowLongTransfer(w, r)
+			sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			s.streamObject(sr, r, loc, f)
+			// Nothing was downloaded by requests answered with 304 Not Modified or an error
+			if count && (sr.status == http.StatusOK || sr.status == http.StatusPartialContent) {
+				s.countDownload(p, r.UserAgent())
+			}
+			return
+		}
+		if count {
+			s.countDownload(p, r.UserAgent())
+		}
 		reqParams := make(url.Values)
 		reqParams.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%s", f))
+		_, done := s.storageCall(r.Context(), "presign", loc)
 		presignURL, err := s.s3.PresignedGetObject(s.s3cfg.bucket, loc, 5*time.Minute, reqParams)
+		done(err)
 		if err != nil {
-			console.Errorf("Failed generate presigned url for %s, err %s\n", loc, err.Error())
+			logger(r.Context()).Error("Failed to generate presigned URL", "key", loc, "err", err)
 			http.Error(w, fmt.Sprintf("Failed to generate download url"), http.StatusInternalServerError)
 			return
 		}
-		console.Debugf("presignURL: %s\n", presignURL)
+		logger(r.Context()).Debug("Redirecting to presigned URL", urlAttr("url", presignURL))
 		http.Redirect(w, r, presignURL.String(), http.StatusTemporaryRedirect)
 	}
 }
+
+// allowLongTransfer lifts timeouts.read and timeouts.write for a request
+// transferring a distribution file, they're meant for ordinary requests and
+// would cut off large files on slow connections
+func allowLongTransfer(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	err := errors.Join(rc.SetReadDeadline(time.Time{}), rc.SetWriteDeadline(time.Time{}))
+	if err != nil {
+		logger(r.Context()).Debug("Failed to lift the timeouts of a transfer", "err", err)
+	}
+}
+
+// streamObject serves the object at key from S3 through gopi. Range,
+// If-None-Match and If-Modified-Since requests are handled by http.ServeContent.
+func (s *server) streamObject(w http.ResponseWriter, r *http.Request, key, fileName string) {
+	info, err := s.statObject(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, NoSuchKey) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		logger(r.Context()).Error("Failed to stat object", "key", key, "err", err)
+		http.Error(w, "Failed to download file", http.StatusInternalServerError)
+		return
+	}
+	ctx, done := s.storageCall(r.Context(), "get", key)
+	o, err := s.s3.GetObjectWithContext(ctx, s.s3cfg.bucket, key, minio.GetObjectOptions{})
+	done(err)
+	if err != nil {
+		logger(r.Context()).Error("Failed to get object", "key", key, "err", err)
+		http.Error(w, "Failed to download file", http.StatusInternalServerError)
+		return
+	}
+	defer o.Close()
+
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	if info.ETag != "" {
+		w.Header().Set("ETag", fmt.Sprintf("%q", strings.Trim(info.ETag, `"`)))
+	}
+	http.ServeContent(w, r, fileName, info.LastModified, o)
+}
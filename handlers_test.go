@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamObject(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{downloadMode: downloadStream})
+	storeTestPkg(t, s, testPkg("demo-1.0.tar.gz", "1.0", ""))
+	o, _ := f.get("demo/demo-1.0.tar.gz")
+	etag := `"` + strings.Trim(o.etag, `"`) + `"`
+
+	tests := []struct {
+		name       string
+		method     string
+		header     map[string]string
+		wantStatus int
+		wantBody   string
+		wantHeader map[string]string
+		wantCount  int
+	}{
+		{
+			name:       "whole file",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   "demo-1.0.tar.gz",
+			wantHeader: map[string]string{
+				"Content-Length":      "15",
+				"Content-Disposition": `attachment; filename="demo-1.0.tar.gz"`,
+				"ETag":                etag,
+			},
+			wantCount: 1,
+		},
+		{
+			name:       "first range",
+			method:     http.MethodGet,
+			header:     map[string]string{"Range": "bytes=0-3"},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "demo",
+			wantHeader: map[string]string{"Content-Length": "4", "Content-Range": "bytes 0-3/15"},
+			wantCount:  1,
+		},
+		{
+			name:       "later range",
+			method:     http.MethodGet,
+			header:     map[string]string{"Range": "bytes=5-"},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "1.0.tar.gz",
+			wantHeader: map[string]string{"Content-Length": "10", "Content-Range": "bytes 5-14/15"},
+		},
+		{
+			name:       "unchanged",
+			method:     http.MethodGet,
+			header:     map[string]string{"If-None-Match": etag},
+			wantStatus: http.StatusNotModified,
+			wantHeader: map[string]string{"ETag": etag},
+		},
+		{
+			name:       "changed",
+			method:     http.MethodGet,
+			header:     map[string]string{"If-None-Match": `"other"`},
+			wantStatus: http.StatusOK,
+			wantBody:   "demo-1.0.tar.gz",
+			wantCount:  1,
+		},
+		{
+			name:       "head",
+			method:     http.MethodHead,
+			wantStatus: http.StatusOK,
+			wantHeader: map[string]string{"Content-Length": "15"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := s.stats.peek("demo").Total
+			r := httptest.NewRequest(tt.method, "/api/demo/demo-1.0.tar.gz", nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus || w.Body.String() != tt.wantBody {
+				t.Errorf("response is %d %q, want %d %q", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			for name, want := range tt.wantHeader {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s is %q, want %q", name, got, want)
+				}
+			}
+			if got := s.stats.peek("demo").Total - before; got != tt.wantCount {
+				t.Errorf("%d downloads were counted, want %d", got, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestDownloadNotFound(t *testing.T) {
+	for _, mode := range []string{downloadRedirect, downloadStream} {
+		s, f := newTestServer(t, serverConfig{downloadMode: mode})
+		storeTestPkg(t, s, testPkg("demo-1.0.tar.gz", "1.0", ""))
+		storeTestPkg(t, s, testPkg("demo-0.9.tar.gz", "0.9", ""))
+		if err := s.deleteRelease(context.Background(), "demo", "0.9"); err != nil {
+			t.Fatalf("Failed to delete release, %s", err)
+		}
+
+		for _, path := range []string{
+			"/api/unknown/unknown-1.0.tar.gz",
+			"/api/demo/demo-2.0.tar.gz",
+			"/api/demo/demo-0.9.tar.gz",
+		} {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("GET %s in %s mode is %d, want 404", path, mode, w.Code)
+			}
+		}
+		if got := s.stats.peek("demo").Total; got != 0 {
+			t.Errorf("%d downloads were counted in %s mode, want 0", got, mode)
+		}
+
+		// Names are normalised like the project names in the index
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/Demo/demo-1.0.tar.gz", nil))
+		if w.Code == http.StatusNotFound {
+			t.Errorf("GET of a file under the project name as written in %s mode is 404, want it found", mode)
+		}
+
+		// Only streaming finds out that the object of an indexed file is gone
+		if mode == downloadStream {
+			f.mu.Lock()
+			delete(f.objects, "demo/demo-1.0.tar.gz")
+			f.mu.Unlock()
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/demo/demo-1.0.tar.gz", nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("GET of an indexed file without its object is %d, want 404", w.Code)
+			}
+		}
+	}
+}
+
+func TestTransfersOutliveTimeouts(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{downloadMode: downloadStream})
+	storeTestPkg(t, s, testPkg("demo-1.0.tar.gz", "1.0", ""))
+	srv := httptest.NewUnstartedServer(s)
+	srv.Config.ReadTimeout = 50 * time.Millisecond
+	srv.Config.WriteTimeout = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	// S3 takes longer to answer than the write timeout
+	f.denyGet = func(key string) bool {
+		time.Sleep(100 * time.Millisecond)
+		return false
+	}
+	resp, err := http.Get(srv.URL + "/api/demo/demo-1.0.tar.gz")
+	if err != nil {
+		t.Fatalf("Streamed download was cut off, %s", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || string(body) != "demo-1.0.tar.gz" {
+		t.Errorf("streamed download is %d %q, %v, want the whole file", resp.StatusCode, body, err)
+	}
+	f.denyGet = nil
+
+	// The client sends the file slower than the read timeout
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		mw.WriteField(":action", "file_upload")
+		mw.WriteField("name", "demo")
+		mw.WriteField("version", "1.1")
+		fw, _ := mw.CreateFormFile("content", "demo-1.1.tar.gz")
+		fw.Write([]byte("demo"))
+		time.Sleep(100 * time.Millisecond)
+		fw.Write([]byte("-1.1.tar.gz"))
+		pw.CloseWithError(mw.Close())
+	}()
+	resp, err = http.Post(srv.URL+"/simple/", mw.FormDataContentType(), pr)
+	if err != nil {
+		t.Fatalf("Slow upload was cut off, %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("slow upload is %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds how long the readiness check waits for the bucket
+const readyTimeout = 5 * time.Second
+
+// staleRefreshes is how many refresh intervals may pass without a successful
+// check of the bucket before the index is reported stale
+const staleRefreshes = 3
+
+// healthCheck is the result of a single readiness check
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// readiness is the JSON body of /readyz
+type readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// HealthzHandler reports that the process is up, it doesn't check any dependencies
+func (s *server) HealthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+	}
+}
+
+// ReadyzHandler reports whether gopi can serve requests: the bucket must be
+// reachable and accessible, the index must have been refreshed recently and
+// gopi mustn't be shutting down.
+// It responds with 503 Service Unavailable if any check fails.
+func (s *server) ReadyzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		rd := readiness{Ready: true, Checks: map[string]healthCheck{
+			"storage":  s.checkStorage(ctx),
+			"index":    s.checkIndex(),
+			"shutdown": s.checkShutdown(),
+		}}
+		status := http.StatusOK
+		for _, c := range rd.Checks {
+			if !c.OK {
+				rd.Ready = false
+				status = http.StatusServiceUnavailable
+			}
+		}
+		writeJSON(w, status, rd)
+	}
+}
+
+func (s *server) checkStorage(ctx context.Context) healthCheck {
+	errc := make(chan error, 1)
+	go func() { errc <- s.bucketExists(ctx) }()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	switch {
+	case err == nil:
+		return healthCheck{OK: true, Detail: fmt.Sprintf("bucket %s is accessible", s.s3cfg.bucket)}
+	case errors.Is(err, NoSuchBucket):
+		return healthCheck{Detail: fmt.Sprintf("bucket %s doesn't exist", s.s3cfg.bucket)}
+	case errors.Is(err, AccessDenied):
+		return healthCheck{Detail: fmt.Sprintf("access to bucket %s is denied", s.s3cfg.bucket)}
+	case errors.Is(err, context.DeadlineExceeded):
+		return healthCheck{Detail: fmt.Sprintf("storage didn't respond within %s", readyTimeout)}
+	}
+	return healthCheck{Detail: fmt.Sprintf("storage is unreachable, %s", err.Error())}
+}
+
+// checkIndex fails until the index has been loaded and every project has
+// been indexed for search, and once the bucket hasn't been checked for changes
+// made by other gopi servers for staleRefreshes refresh intervals
+func (s *server) checkIndex() healthCheck {
+	if !s.index.isLoaded() {
+		return healthCheck{Detail: "index hasn't been loaded yet"}
+	}
+	if !s.search.isBuilt() {
+		return healthCheck{Detail: "search index is being built"}
+	}
+	s.refresh.mu.RLock()
+	interval, lastCheck := s.refresh.interval, s.refresh.lastCheck
+	s.refresh.mu.RUnlock()
+	projects := len(s.index.projectList())
+	if interval == 0 {
+		return healthCheck{OK: true, Detail: fmt.Sprintf("%d projects, refreshing is disabled", projects)}
+	}
+	since := time.Since(lastCheck).Round(time.Second)
+	if since > staleRefreshes*interval {
+		return healthCheck{Detail: fmt.Sprintf("index hasn't been refreshed for %s, changes made by other servers may be missing", since)}
+	}
+	return healthCheck{OK: true, Detail: fmt.Sprintf("%d projects, refreshed %s ago", projects, since)}
+}
+
+func (s *server) checkShutdown() healthCheck {
+	if s.draining.Load() {
+		return healthCheck{Detail: "gopi is shutting down"}
+	}
+	return healthCheck{OK: true}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// readyz returns the status and body of /readyz
+func readyz(t *testing.T, s *server) (int, readiness) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var rd readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &rd); err != nil {
+		t.Fatalf("Failed to parse /readyz response %q, %s", w.Body.String(), err)
+	}
+	return w.Code, rd
+}
+
+// waitReady polls /readyz until gopi is ready
+func waitReady(t *testing.T, s *server) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, rd := readyz(t, s)
+		if code == http.StatusOK {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gopi isn't ready, %+v", rd.Checks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckIndexWaitsForLoadAndSearch(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	waitReady(t, s)
+
+	s.index = newPackageIndex()
+	if c := s.checkIndex(); c.OK || c.Detail != "index hasn't been loaded yet" {
+		t.Errorf("index check before loading is %+v, want not loaded", c)
+	}
+	s.index.markLoaded()
+	s.search = newSearchIndex()
+	if c := s.checkIndex(); c.OK || c.Detail != "search index is being built" {
+		t.Errorf("index check while building search index is %+v, want building", c)
+	}
+	s.search.reset(projectMap{})
+	if c := s.checkIndex(); !c.OK {
+		t.Errorf("index check with refreshing disabled is %+v, want OK", c)
+	}
+}
+
+func TestCheckIndexStale(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	waitReady(t, s)
+
+	s.refresh.mu.Lock()
+	s.refresh.interval = time.Second
+	s.refresh.lastCheck = time.Now().Add(-time.Minute)
+	s.refresh.mu.Unlock()
+	if c := s.checkIndex(); c.OK {
+		t.Errorf("index check after a minute without refreshing is %+v, want stale", c)
+	}
+}
+
+func TestShutdownDrainsBeforeClosing(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	waitReady(t, s)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen, %s", err)
+	}
+	srv := &http.Server{Handler: s}
+	go srv.Serve(l)
+	url := "http://" + l.Addr().String() + "/readyz"
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.shutdown(srv, 500*time.Millisecond, time.Second, func() {})
+	}()
+	// The listener stays open while draining so probes see gopi isn't ready
+	deadline := time.Now().Add(400 * time.Millisecond)
+	var status int
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("/readyz failed while draining, %s", err)
+		}
+		resp.Body.Close()
+		status = resp.StatusCode
+		if status == http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while draining is %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("shutdown failed, %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't finish")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Errorf("/readyz responded after shutdown")
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	// projectListFile lists every project with its latest version, the
+	// files of each project are stored in <project>/index.json
+	projectListFile  = "projects.json"
+	projectIndexFile = "index.json"
+
+	// internalPrefix holds gopi's own objects such as the journal. Normalised
+	// package names never start with a dot so this can't clash with a package.
+	internalPrefix = ".gopi/"
+)
+
+// searchIndexRetryInterval is how often indexing the projects that haven't
+// been loaded for search is retried after it failed
+const searchIndexRetryInterval = 10 * time.Second
+
+// projectSummary is the entry of a project in the project list
+type projectSummary struct {
+	Version  string    `json:"version"`
+	Summary  string    `json:"summary"`
+	Updated  time.Time `json:"updated"`
+	Releases int       `json:"releases"`
+	Files    int       `json:"files"`
+	Keywords string    `json:"keywords,omitempty"`
+	// Uploaded is when the newest file of the project was uploaded
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// release returns the latest release as far as the summary tells, it's what
+// the search index holds for projects that haven't been loaded
+func (ps projectSummary) release() release {
+	return release{Version: ps.Version, releaseMetadata: releaseMetadata{Summary: ps.Summary, Keywords: ps.Keywords}}
+}
+
+// LastUpload returns when a file was last uploaded to the project, falling
+// back to when its index last changed for summaries written before upload
+// times were recorded
+func (ps projectSummary) LastUpload() time.Time {
+	if ps.Uploaded.IsZero() {
+		return ps.Updated
+	}
+	return ps.Uploaded
+}
+
+type projectList map[string]projectSummary
+
+// projectMap holds projects by name
+type projectMap map[string]project
+
+// sortedNames returns the names of all projects in alphabetical order
+func (pl projectList) sortedNames() []string {
+	names := make([]string, 0, len(pl))
+	for name := range pl {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// packageIndex holds the project list and caches the project documents
+// that have been loaded from the bucket so far
+type packageIndex struct {
+	mu       sync.RWMutex
+	list     projectList
+	projects projectMap
+	// loaded is set once the project list has been read from the bucket
+	loaded bool
+}
+
+func newPackageIndex() *packageIndex {
+	return &packageIndex{
+		list:     make(projectList),
+		projects: make(projectMap),
+	}
+}
+
+// projectList returns a copy of the project list
+func (pi *packageIndex) projectList() projectList {
+	pi.mu.RLock()
+	defer pi.mu.RUnlock()
+	list := make(projectList, len(pi.list))
+	for name, p := range pi.list {
+		list[name] = p
+	}
+	return list
+}
+
+// exists reports whether the project is in the project list
+func (pi *packageIndex) exists(name string) bool {
+	pi.mu.RLock()
+	defer pi.mu.RUnlock()
+	_, ok := pi.list[name]
+	return ok
+}
+
+func (pi *packageIndex) cached(name string) (project, bool) {
+	pi.mu.RLock()
+	defer pi.mu.RUnlock()
+	ps, ok := pi.projects[name]
+	return ps, ok
+}
+
+func (pi *packageIndex) setList(list projectList) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	pi.list = list
+}
+
+func (pi *packageIndex) markLoaded() {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	pi.loaded = true
+}
+
+func (pi *packageIndex) isLoaded() bool {
+	pi.mu.RLock()
+	defer pi.mu.RUnlock()
+	return pi.loaded
+}
+
+// reset replaces the project list and every cached project
+func (pi *packageIndex) reset(list projectList, projects projectMap) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	pi.list = list
+	pi.projects = projects
+}
+
+// invalidate drops the cached copy of a project so it's read from the bucket when it's next needed
+func (pi *packageIndex) invalidate(name string) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	delete(pi.projects, name)
+}
+
+func (pi *packageIndex) setProject(name string, pr project) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	pi.projects[name] = pr
+}
+
+func projectIndexKey(name string) string {
+	return name + pathSeparator + projectIndexFile
+}
+
+// isIndexObject reports whether key is one of gopi's own objects rather than a distribution file
+func isIndexObject(key string) bool {
+	if key == projectListFile || key == packageListFile || strings.HasPrefix(key, internalPrefix) {
+		return true
+	}
+	parts := strings.Split(key, pathSeparator)
+	return len(parts) == 2 && parts[1] == projectIndexFile
+}
+
+// indexDocNames returns the projects that have an index document among objects
+func indexDocNames(objects []minio.ObjectInfo) []string {
+	var names []string
+	for _, o := range objects {
+		if parts := strings.Split(o.Key, pathSeparator); len(parts) == 2 && parts[1] == projectIndexFile {
+			names = append(names, parts[0])
+		}
+	}
+	return names
+}
+
+// loadIndex reads the project list from the bucket, migrating the old
+// packages.json if the bucket hasn't got a project list yet
+func (s *server) loadIndex(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "index.load")
+	defer func() { endSpan(span, err) }()
+	info, err := s.statObject(ctx, projectListFile)
+	if errors.Is(err, NoSuchKey) {
+		err = s.migratePackagesJSON(ctx)
+		if err == nil {
+			s.index.markLoaded()
+			s.refresh.mu.Lock()
+			s.refresh.lastCheck = time.Now()
+			s.refresh.mu.Unlock()
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	list, err := s.readProjectList(ctx)
+	if err != nil {
+		return err
+	}
+	s.index.setList(list)
+	s.index.markLoaded()
+	s.refresh.mu.Lock()
+	s.refresh.etag = info.ETag
+	s.refresh.lastModified = info.LastModified
+	s.refresh.lastCheck = time.Now()
+	s.refresh.lastReload = time.Now()
+	s.refresh.mu.Unlock()
+	logger(ctx).Debug("Loaded project list", "projects", len(list))
+	return nil
+}
+
+// project returns the releases of a project, loading its index document
+// from the bucket the first time the project is requested
+func (s *server) project(ctx context.Context, name string) (project, error) {
+	if pr, ok := s.index.cached(name); ok {
+		return pr, nil
+	}
+	if !s.index.exists(name) {
+		return project{Name: name, Releases: []release{}}, nil
+	}
+	pr, err := s.readProject(ctx, name)
+	if err != nil {
+		return pr, err
+	}
+	s.index.setProject(name, pr)
+	// Replace the summary the project was indexed by with its releases
+	s.search.resetProject(name, pr)
+	return pr, nil
+}
+
+// findFile returns the file called fileName of a project, or an empty pkg if
+// the project doesn't exist or has no such file
+func (s *server) findFile(ctx context.Context, name, fileName string) (pkg, error) {
+	pr, err := s.project(ctx, name)
+	if err != nil {
+		return pkg{}, err
+	}
+	for _, p := range pr.files() {
+		if p.FileName == fileName {
+			return p, nil
+		}
+	}
+	return pkg{}, nil
+}
+
+// buildSearchIndex seeds the search index with the projects in the project
+// list. Projects that haven't been loaded are indexed by their summary so
+// they can be found straight away, indexUnloadedProjects replaces it with
+// their releases.
+func (s *server) buildSearchIndex(ctx context.Context) {
+	list := s.index.projectList()
+	projects := make(projectMap, len(list))
+	for name, ps := range list {
+		if pr, ok := s.index.cached(name); ok {
+			projects[name] = pr
+			continue
+		}
+		projects[name] = project{Name: name, Releases: []release{ps.release()}}
+	}
+	s.search.seed(projects)
+	logger(ctx).Debug("Indexed projects for search", "projects", len(projects))
+}
+
+// indexUnloadedProjects reads the index document of every project that
+// hasn't been loaded and indexes its releases for search, the project list
+// has no authors, classifiers, descriptions or older versions. The documents
+// aren't cached so projects are still loaded when they're first needed.
+// Readiness fails until it's done.
+func (s *server) indexUnloadedProjects(ctx context.Context) error {
+	indexed := 0
+	for name := range s.index.projectList() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, ok := s.index.cached(name); ok {
+			continue
+		}
+		pr, err := s.readProject(ctx, name)
+		if err != nil {
+			return fmt.Errorf("Failed to read project %s, %s", name, err.Error())
+		}
+		s.indexMu.Lock()
+		// A project loaded in the meantime was indexed with its latest releases
+		if _, ok := s.index.cached(name); !ok {
+			s.search.resetProject(name, pr)
+			indexed++
+		}
+		s.indexMu.Unlock()
+	}
+	s.search.markBuilt()
+	logger(ctx).Debug("Indexed unloaded projects for search", "projects", indexed)
+	return nil
+}
+
+// indexUnloadedProjectsUntilDone runs indexUnloadedProjects, trying again
+// every interval until it succeeds or ctx is done
+func (s *server) indexUnloadedProjectsUntilDone(ctx context.Context, interval time.Duration) {
+	for {
+		err := s.indexUnloadedProjects(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		logger(ctx).Error("Failed to index projects for search, trying again", "err", err, "interval", interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *server) readProjectList(ctx context.Context) (_ projectList, err error) {
+	ctx, span := startSpan(ctx, "index.read_list")
+	defer func() { endSpan(span, err) }()
+	data, err := s.getObject(ctx, projectListFile)
+	if err != nil {
+		return nil, err
+	}
+	list := make(projectList)
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, %s", projectListFile, err.Error())
+	}
+	return list, nil
+}
+
+// readProject reads the index document of a project from the bucket, a
+// project without an index document has no releases. Documents written by
+// older versions of gopi, a list of files, are converted.
+func (s *server) readProject(ctx context.Context, name string) (_ project, err error) {
+	ctx, span := startSpan(ctx, "index.read_project", attribute.String("gopi.project", name))
+	defer func() { endSpan(span, err) }()
+	pr, _, _, err := s.readProjectDocument(ctx, name)
+	pr.Name = name
+	return pr, err
+}
+
+// readProjectDocument is readProject, legacy reports whether the document
+// is still a list of files and etag is its ETag, empty if there's no
+// document. The name is left as stored for fsck to check.
+func (s *server) readProjectDocument(ctx context.Context, name string) (_ project, legacy bool, etag string, _ error) {
+	data, etag, err := s.getObjectETag(ctx, projectIndexKey(name))
+	if errors.Is(err, NoSuchKey) {
+		return project{Name: name, Releases: []release{}}, false, "", nil
+	}
+	if err != nil {
+		return project{Name: name, Releases: []release{}}, false, "", err
+	}
+	pr, legacy, err := parseProjectDocument(name, data)
+	return pr, legacy, etag, err
+}
+
+// parseProjectDocument parses the index document of a project, see readProjectDocument
+func parseProjectDocument(name string, data []byte) (project, bool, error) {
+	pr := project{Name: name, Releases: []release{}}
+	if data = bytes.TrimSpace(data); bytes.HasPrefix(data, []byte("[")) {
+		ps := pkgs{}
+		err := json.Unmarshal(data, &ps)
+		if err != nil {
+			return pr, true, fmt.Errorf("Failed to parse %s, %s", projectIndexKey(name), err.Error())
+		}
+		return newProject(name, ps), true, nil
+	}
+	err := json.Unmarshal(data, &pr)
+	if err != nil {
+		return pr, false, fmt.Errorf("Failed to parse %s, %s", projectIndexKey(name), err.Error())
+	}
+	if pr.Releases == nil {
+		pr.Releases = []release{}
+	}
+	pr.sort()
+	return pr, false, nil
+}
+
+// writeProject stores the releases of a project and updates its entry in
+// the project list. Projects without releases are dropped from the list.
+// The project list is re-read first so changes made by other gopi servers
+// aren't lost.
+// Callers must hold s.indexMu.
+func (s *server) writeProject(ctx context.Context, name string, pr project) (err error) {
+	ctx, span := startSpan(ctx, "index.write_project", attribute.String("gopi.project", name))
+	defer func() { endSpan(span, err) }()
+	err = s.putProject(ctx, name, pr)
+	if err != nil {
+		return err
+	}
+
+	list, err := s.updateProjectList(ctx, func(list projectList) {
+		if len(pr.Releases) == 0 {
+			delete(list, name)
+		} else {
+			list[name] = newProjectSummary(pr, time.Now().UTC())
+		}
+	})
+	if err != nil {
+		// The project document has been written, read it again when it's next needed
+		s.index.invalidate(name)
+		return err
+	}
+	s.index.setProject(name, pr)
+	s.index.setList(list)
+	return nil
+}
+
+// putProject writes the index document of a project to the bucket
+func (s *server) putProject(ctx context.Context, name string, pr project) error {
+	data, err := encodeProject(name, pr)
+	if err != nil {
+		return err
+	}
+	return s.putObject(ctx, projectIndexKey(name), data, "application/json")
+}
+
+// putProjectIf writes the index document of a project only if it still has
+// the given ETag, or only if there's none when etag is empty
+func (s *server) putProjectIf(ctx context.Context, name string, pr project, etag string) error {
+	data, err := encodeProject(name, pr)
+	if err != nil {
+		return err
+	}
+	return s.putObjectIf(ctx, projectIndexKey(name), data, "application/json", etag)
+}
+
+// updateProject replaces the index document of a project with what update
+// returns for the current one, only writing it if no other gopi server
+// changed it in the meantime. update is called again if one did, the project
+// written is returned.
+func (s *server) updateProject(ctx context.Context, name string, update func(current project) project) (project, error) {
+	var pr project
+	err := s.updateObject(ctx, projectIndexKey(name), "application/json", func(data []byte) ([]byte, error) {
+		current := project{Name: name, Releases: []release{}}
+		if data != nil {
+			var err error
+			current, _, err = parseProjectDocument(name, data)
+			if err != nil {
+				return nil, err
+			}
+			current.Name = name
+		}
+		pr = update(current)
+		return encodeProject(name, pr)
+	})
+	return pr, err
+}
+
+func encodeProject(name string, pr project) ([]byte, error) {
+	pr.Name = name
+	if pr.Releases == nil {
+		pr.Releases = []release{}
+	}
+	return json.Marshal(pr)
+}
+
+// updateProjectList changes the project list with update, only writing it if
+// no other gopi server changed it since it was read. update is called again
+// if one did, the list written is returned.
+func (s *server) updateProjectList(ctx context.Context, update func(list projectList)) (projectList, error) {
+	var list projectList
+	err := s.updateObject(ctx, projectListFile, "application/json", func(data []byte) ([]byte, error) {
+		list = make(projectList)
+		if data != nil {
+			err := json.Unmarshal(data, &list)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse %s, %s", projectListFile, err.Error())
+			}
+		}
+		update(list)
+		return json.Marshal(list)
+	})
+	return list, err
+}
+
+func newProjectSummary(pr project, updated time.Time) projectSummary {
+	latest := pr.latest()
+	var uploaded time.Time
+	for _, r := range pr.Releases {
+		for _, f := range r.Files {
+			if f.UploadTime.After(uploaded) {
+				uploaded = f.UploadTime
+			}
+		}
+	}
+	return projectSummary{
+		Version:  latest.Version,
+		Summary:  latest.Summary,
+		Updated:  updated,
+		Releases: len(pr.Releases),
+		Files:    pr.fileCount(),
+		Keywords: latest.Keywords,
+		Uploaded: uploaded,
+	}
+}
+
+func (s *server) writeProjectList(ctx context.Context, list projectList) (err error) {
+	ctx, span := startSpan(ctx, "index.write_list", attribute.Int("gopi.projects", len(list)))
+	defer func() { endSpan(span, err) }()
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return s.putObject(ctx, projectListFile, data, "application/json")
+}
+
+// migratePackagesJSON splits the single packages.json used by older
+// versions of gopi into per-project index documents and a project list.
+// packages.json is left in place as a backup.
+func (s *server) migratePackagesJSON(ctx context.Context) error {
+	data, err := s.getObject(ctx, packageListFile)
+	if errors.Is(err, NoSuchKey) {
+		// Nothing has been uploaded yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	old := packageMap{}
+	err = json.Unmarshal(data, &old)
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s for migration, %s", packageListFile, err.Error())
+	}
+	logger(ctx).Info("Migrating projects to per-project index files", "projects", len(old), "from", packageListFile)
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	list := make(projectList)
+	now := time.Now().UTC()
+	for _, name := range old.sortedNames() {
+		if len(old[name]) == 0 {
+			continue
+		}
+		pr := newProject(name, old[name])
+		err := s.putProject(ctx, name, pr)
+		if err != nil {
+			return fmt.Errorf("Failed to write index for project %s, %s", name, err.Error())
+		}
+		s.index.setProject(name, pr)
+		list[name] = newProjectSummary(pr, now)
+	}
+	// The project list is written last so an interrupted migration is retried on the next start
+	err = s.writeProjectList(ctx, list)
+	if err != nil {
+		return err
+	}
+	s.index.setList(list)
+	logger(ctx).Info("Migration done, the old package list is no longer used and can be removed", "file", packageListFile)
+	return nil
+}
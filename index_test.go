@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSearchIndexesUnloadedProjects(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	old := testPkg("demo-0.9.tar.gz", "0.9", "an older demo")
+	old.Author = "Ada Lovelace"
+	p := testPkg("demo-1.0.tar.gz", "1.0", "a demo package")
+	p.Keywords = "example"
+	p.Description = "handles widgets"
+	p.Classifiers = []string{"Topic :: Software Development"}
+	for _, p := range []pkg{old, p} {
+		if err := s.addPackage(ctx, p); err != nil {
+			t.Fatalf("Failed to add %s, %s", p.FileName, err)
+		}
+	}
+
+	replica := newReplica(t, f, serverConfig{})
+	if _, ok := replica.index.cached("demo"); ok {
+		t.Fatal("demo was loaded at startup, want it loaded when it's first needed")
+	}
+	if !replica.search.isBuilt() {
+		t.Error("search index isn't built once every project has been indexed")
+	}
+	if results := replica.search.search("widgets", 10); len(results) != 1 || results[0].Version != "1.0" {
+		t.Errorf("search for the description is %+v, want demo 1.0", results)
+	}
+	for _, term := range []fieldTerm{
+		{field: fieldAuthor, term: "lovelace"},
+		{field: fieldClassifiers, term: "software development"},
+		{field: fieldDescription, term: "widgets"},
+		{field: fieldVersion, term: "0.9"},
+	} {
+		if got := replica.search.query([]fieldTerm{term}, "and"); len(got) != 1 || got[0].Name != "demo" {
+			t.Errorf("search by %+v is %+v, want demo", term, got)
+		}
+	}
+
+	// Until then projects are only found by their summary and readiness fails
+	replica.buildSearchIndex(ctx)
+	if replica.search.isBuilt() {
+		t.Error("search index is built before every project has been indexed")
+	}
+	if results := replica.search.search("example", 10); len(results) != 1 {
+		t.Errorf("search for the keywords before demo is indexed is %+v, want demo from its summary", results)
+	}
+}
+
+func TestWriteProjectKeepsConcurrentListChanges(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	replica := newReplica(t, f, serverConfig{})
+
+	other := testPkg("other-1.0.tar.gz", "1.0", "")
+	other.Name = "other"
+	other.URL = "/other/other-1.0.tar.gz"
+	// The replica adds its project between the read and the write of the project list
+	f.beforePut = func(key string) {
+		if key != projectListFile {
+			return
+		}
+		f.beforePut = nil
+		if err := replica.addPackage(ctx, other); err != nil {
+			t.Errorf("Failed to add other, %s", err)
+		}
+	}
+	if err := s.addPackage(ctx, testPkg("demo-1.0.tar.gz", "1.0", "")); err != nil {
+		t.Fatalf("Failed to add demo, %s", err)
+	}
+
+	list, err := s.readProjectList(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read project list, %s", err)
+	}
+	for _, name := range []string{"demo", "other"} {
+		if _, ok := list[name]; !ok {
+			t.Errorf("%s is missing from %s, %v", name, projectListFile, list.sortedNames())
+		}
+	}
+	if !s.index.exists("other") {
+		t.Error("other is missing from the project list of the server, want the list it wrote")
+	}
+}
+
+func TestWriteProjectFailedListKeepsCache(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	if err := s.addPackage(ctx, testPkg("demo-1.0.tar.gz", "1.0", "")); err != nil {
+		t.Fatalf("Failed to add demo, %s", err)
+	}
+
+	f.denyPut = func(key string) bool { return key == projectListFile }
+	if err := s.addPackage(ctx, testPkg("demo-2.0.tar.gz", "2.0", "")); err == nil {
+		t.Fatal("Adding a release succeeded although the project list couldn't be written")
+	}
+	if got := s.index.projectList()["demo"].Version; got != "1.0" {
+		t.Errorf("latest version in the project list is %s, want 1.0", got)
+	}
+	if pr, ok := s.index.cached("demo"); ok && pr.findRelease("2.0") != nil {
+		t.Error("the cached project has release 2.0, want the project list and cache to only change once both are written")
+	}
+}
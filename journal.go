@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// journalPrefix is where every journal entry is stored, one object per serial
+	journalPrefix = internalPrefix + "journal/"
+	// journalCheckpointFile holds a copy of the journal up to a recent
+	// serial, so starting gopi doesn't read every entry one by one
+	journalCheckpointFile = internalPrefix + "journal-checkpoint.json"
+)
+
+// journalCheckpointEvery is how many serials apart journal checkpoints are written
+const journalCheckpointEvery = 100
+
+// journalRetryInterval is how often changes that couldn't be written to the journal are retried
+const journalRetryInterval = 10 * time.Second
+
+// Journal actions, named after the actions in the PyPI changelog
+const (
+	actionNewRelease     = "new release"
+	actionNewReleaseFile = "new release with file %s"
+	actionAddFile        = "add file %s"
+	actionReplaceFile    = "replace file %s"
+	actionRemoveRelease  = "remove release"
+	actionRemoveFile     = "remove file %s"
+	actionYankRelease    = "yank release"
+	actionUnyankRelease  = "unyank release"
+	actionAddRole        = "add %s %s"
+	actionRemoveRole     = "remove %s %s"
+	actionReindex        = "reindex"
+	actionRepair         = "repair"
+)
+
+// journalEntry is a single change to the package index
+type journalEntry struct {
+	Serial    int       `json:"serial"`
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	// Replica is the gopi server that recorded the change
+	Replica string `json:"replica,omitempty"`
+}
+
+// sameChange reports whether e and o record the same change by the same server
+func (e journalEntry) sameChange(o journalEntry) bool {
+	return e.Name == o.Name && e.Version == o.Version && e.Action == o.Action &&
+		e.Replica == o.Replica && e.Timestamp.Equal(o.Timestamp)
+}
+
+// changelog is the in-memory copy of the journal, ordered by serial
+type changelog struct {
+	mu       sync.RWMutex
+	entries  []journalEntry
+	projects map[string]int
+}
+
+func newChangelog() *changelog {
+	return &changelog{
+		projects: make(map[string]int),
+	}
+}
+
+// lastSerial returns the serial of the latest change, 0 if nothing has changed yet
+func (c *changelog) lastSerial() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.entries) == 0 {
+		return 0
+	}
+	return c.entries[len(c.entries)-1].Serial
+}
+
+// projectSerial returns the serial of the latest change to a package
+func (c *changelog) projectSerial(name string) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.projects[name]
+}
+
+// since returns every change with a serial greater than serial
+func (c *changelog) since(serial int) []journalEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	i := sort.Search(len(c.entries), func(i int) bool {
+		return c.entries[i].Serial > serial
+	})
+	return append([]journalEntry{}, c.entries[i:]...)
+}
+
+// sinceTime returns every change made after t
+func (c *changelog) sinceTime(t time.Time) []journalEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var entries []journalEntry
+	for _, e := range c.entries {
+		if e.Timestamp.After(t) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// append adds an entry after the last one, entries that are already in the
+// changelog are skipped
+func (c *changelog) append(e journalEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) > 0 && e.Serial <= c.entries[len(c.entries)-1].Serial {
+		return
+	}
+	c.entries = append(c.entries, e)
+	c.projects[e.Name] = e.Serial
+}
+
+// entry returns the entry with the given serial
+func (c *changelog) entry(serial int) (journalEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	i := sort.Search(len(c.entries), func(i int) bool {
+		return c.entries[i].Serial >= serial
+	})
+	if i < len(c.entries) && c.entries[i].Serial == serial {
+		return c.entries[i], true
+	}
+	return journalEntry{}, false
+}
+
+func journalKey(serial int) string {
+	return fmt.Sprintf("%s%012d.json", journalPrefix, serial)
+}
+
+// journalSerial returns the serial of a journal key, ok is false for other objects
+func journalSerial(key string) (serial int, ok bool) {
+	serial, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(key, journalPrefix), ".json"))
+	return serial, err == nil && strings.HasPrefix(key, journalPrefix)
+}
+
+// loadJournal reads the journal from the bucket, starting from the latest
+// checkpoint if there is one
+func (s *server) loadJournal(ctx context.Context) error {
+	c := newChangelog()
+	data, err := s.getObject(ctx, journalCheckpointFile)
+	if err != nil && !errors.Is(err, NoSuchKey) {
+		return err
+	}
+	if err == nil {
+		var entries []journalEntry
+		err = json.Unmarshal(data, &entries)
+		if err != nil {
+			return fmt.Errorf("Failed to parse %s, %s", journalCheckpointFile, err.Error())
+		}
+		for _, e := range entries {
+			c.append(e)
+		}
+	}
+	err = s.loadNewJournalEntries(ctx, c)
+	if err != nil {
+		return err
+	}
+	s.changelog = c
+	logger(ctx).Debug("Loaded journal", "entries", len(c.entries), "last_serial", c.lastSerial())
+	return nil
+}
+
+// loadNewJournalEntries adds the entries after the last serial of c to it.
+// Serials are only ever written in order so nothing before it can be missing.
+func (s *server) loadNewJournalEntries(ctx context.Context, c *changelog) error {
+	startAfter := ""
+	if last := c.lastSerial(); last > 0 {
+		startAfter = journalKey(last)
+	}
+	objects, err := s.listObjectsAfter(ctx, journalPrefix, startAfter)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if _, ok := journalSerial(o.Key); !ok {
+			logger(ctx).Warn("Ignoring unexpected object in journal", "key", o.Key)
+			continue
+		}
+		e, err := s.readJournalEntry(ctx, o.Key)
+		if err != nil {
+			return err
+		}
+		c.append(e)
+	}
+	return nil
+}
+
+func (s *server) readJournalEntry(ctx context.Context, key string) (journalEntry, error) {
+	var e journalEntry
+	data, err := s.getObject(ctx, key)
+	if err != nil {
+		return e, err
+	}
+	err = json.Unmarshal(data, &e)
+	if err != nil {
+		return e, fmt.Errorf("Failed to parse journal entry %s, %s", key, err.Error())
+	}
+	return e, nil
+}
+
+// recordChange appends a change to the journal under the next serial, after
+// any earlier changes that couldn't be written yet. If it can't be written
+// either it's kept to be retried with them, see retryJournal.
+func (s *server) recordChange(ctx context.Context, name, version, action string) error {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	s.unrecorded = append(s.unrecorded, journalEntry{
+		Name:      name,
+		Version:   version,
+		Timestamp: time.Now().UTC(),
+		Action:    action,
+		Replica:   s.replica,
+	})
+	return s.writeUnrecorded(ctx)
+}
+
+// writeUnrecorded writes the changes that haven't been written to the
+// journal yet in order, stopping at the first one that fails.
+// Callers must hold s.journalMu.
+func (s *server) writeUnrecorded(ctx context.Context) error {
+	defer func() { s.metrics.journalBacklog.Set(float64(len(s.unrecorded))) }()
+	for len(s.unrecorded) > 0 {
+		err := s.writeJournalEntry(ctx, s.unrecorded[0])
+		if err != nil {
+			s.metrics.journalFailures.Inc()
+			return err
+		}
+		s.unrecorded = s.unrecorded[1:]
+	}
+	return nil
+}
+
+// writeJournalEntry writes e under the next serial. The entry is only written
+// if no other gopi has taken the serial, otherwise their entries are loaded
+// and the next serial tried, so serials are unique and every entry is written
+// after the ones before it.
+// Callers must hold s.journalMu.
+func (s *server) writeJournalEntry(ctx context.Context, e journalEntry) error {
+	for attempt := 1; ; attempt++ {
+		e.Serial = s.changelog.lastSerial() + 1
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		err = s.putObjectIf(ctx, journalKey(e.Serial), data, "application/json", "")
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, PreconditionFailed) || attempt == maxUpdateAttempts {
+			return err
+		}
+		err = s.loadNewJournalEntries(ctx, s.changelog)
+		if err != nil {
+			return err
+		}
+		// The put that failed may have been a retry of one that went through
+		if taken, ok := s.changelog.entry(e.Serial); ok && taken.sameChange(e) {
+			return nil
+		}
+	}
+	s.changelog.append(e)
+	if e.Serial%journalCheckpointEvery == 0 {
+		s.writeJournalCheckpoint(ctx)
+	}
+	return nil
+}
+
+// retryJournal writes the changes that couldn't be written to the journal
+// when they were made
+func (s *server) retryJournal(ctx context.Context) error {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	n := len(s.unrecorded)
+	if n == 0 {
+		return nil
+	}
+	err := s.writeUnrecorded(ctx)
+	if err != nil {
+		return err
+	}
+	logger(ctx).Info("Recorded changes in the journal after retrying", "changes", n)
+	return nil
+}
+
+// retryJournalEvery retries writing unrecorded changes to the journal every interval until ctx is done
+func (s *server) retryJournalEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.retryJournal(ctx)
+			if err != nil {
+				logger(ctx).Error("Failed to record changes in journal", "err", err)
+			}
+		}
+	}
+}
+
+// writeJournalCheckpoint stores every entry loaded so far in one object.
+// Checkpoints are only an optimisation, one overwritten by an older one
+// just leaves more entries to read on the next start.
+func (s *server) writeJournalCheckpoint(ctx context.Context) {
+	entries := s.changelog.since(0)
+	data, err := json.Marshal(entries)
+	if err == nil {
+		err = s.putObject(ctx, journalCheckpointFile, data, "application/json")
+	}
+	if err != nil {
+		logger(ctx).Warn("Failed to write journal checkpoint", "err", err)
+		return
+	}
+	logger(ctx).Debug("Wrote journal checkpoint", "last_serial", entries[len(entries)-1].Serial)
+}
+
+// logChange records a change in the journal. The change itself has already
+// been made so it doesn't fail, changes that can't be written are retried in
+// the background and counted by the gopi_journal_unrecorded_changes metric.
+func (s *server) logChange(ctx context.Context, name, version, action string) {
+	err := s.recordChange(ctx, name, version, action)
+	if err != nil {
+		logger(ctx).Error("Failed to record change in journal, retrying in the background", "action", action, "package", name, "version", version, "err", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// serials returns the serials of entries
+func serials(entries []journalEntry) []int {
+	var serials []int
+	for _, e := range entries {
+		serials = append(serials, e.Serial)
+	}
+	return serials
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRecordChangeAcrossReplicas(t *testing.T) {
+	a, f := newTestServer(t, serverConfig{})
+	b := newReplica(t, f, serverConfig{})
+	ctx := context.Background()
+
+	// b hasn't seen the entries of a, it has to skip the serials they took
+	for _, name := range []string{"one", "two"} {
+		if err := a.recordChange(ctx, name, "1.0", actionNewRelease); err != nil {
+			t.Fatalf("Failed to record change on a, %s", err)
+		}
+	}
+	if err := b.recordChange(ctx, "three", "1.0", actionNewRelease); err != nil {
+		t.Fatalf("Failed to record change on b, %s", err)
+	}
+	if err := a.recordChange(ctx, "four", "1.0", actionNewRelease); err != nil {
+		t.Fatalf("Failed to record change on a, %s", err)
+	}
+	if err := b.refreshJournal(ctx); err != nil {
+		t.Fatalf("Failed to refresh journal of b, %s", err)
+	}
+
+	want := []string{"one", "two", "three", "four"}
+	for _, s := range []*server{a, b} {
+		entries := s.changelog.since(0)
+		if got := serials(entries); !equalInts(got, []int{1, 2, 3, 4}) {
+			t.Fatalf("Serials are %v, want 1 to 4", got)
+		}
+		for i, e := range entries {
+			if e.Name != want[i] {
+				t.Errorf("Entry %d is for %s, want %s", e.Serial, e.Name, want[i])
+			}
+		}
+	}
+	var keys []string
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key := range f.objects {
+		if strings.HasPrefix(key, journalPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) != 4 {
+		t.Errorf("Journal has objects %v, want 4", keys)
+	}
+}
+
+func TestRecordChangeLosingRace(t *testing.T) {
+	a, f := newTestServer(t, serverConfig{})
+	b := newReplica(t, f, serverConfig{})
+	ctx := context.Background()
+
+	// b writes serial 1 between a picking it and writing it
+	raced := false
+	f.beforePut = func(key string) {
+		if key == journalKey(1) && !raced {
+			raced = true
+			if err := b.recordChange(ctx, "other", "1.0", actionNewRelease); err != nil {
+				t.Errorf("Failed to record change on b, %s", err)
+			}
+		}
+	}
+	if err := a.recordChange(ctx, "demo", "1.0", actionNewRelease); err != nil {
+		t.Fatalf("Failed to record change on a, %s", err)
+	}
+	entries := a.changelog.since(0)
+	if got := serials(entries); !equalInts(got, []int{1, 2}) {
+		t.Fatalf("Serials are %v, want 1 and 2", got)
+	}
+	if entries[0].Name != "other" || entries[1].Name != "demo" {
+		t.Errorf("Entries are %+v, want other then demo", entries)
+	}
+}
+
+func TestLoadJournalFromCheckpoint(t *testing.T) {
+	a, f := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	for i := 0; i < journalCheckpointEvery+2; i++ {
+		if err := a.recordChange(ctx, "demo", "1.0", actionNewRelease); err != nil {
+			t.Fatalf("Failed to record change, %s", err)
+		}
+	}
+	if _, ok := f.get(journalCheckpointFile); !ok {
+		t.Fatalf("No checkpoint was written")
+	}
+	// Entries in the checkpoint aren't read again
+	f.mu.Lock()
+	delete(f.objects, journalKey(1))
+	f.mu.Unlock()
+
+	b := newReplica(t, f, serverConfig{})
+	if got := b.changelog.lastSerial(); got != journalCheckpointEvery+2 {
+		t.Fatalf("Last serial is %d, want %d", got, journalCheckpointEvery+2)
+	}
+	if got := len(b.changelog.since(0)); got != journalCheckpointEvery+2 {
+		t.Fatalf("Loaded %d entries, want %d", got, journalCheckpointEvery+2)
+	}
+}
+
+func TestChangelogHandler(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	for _, name := range []string{"one", "two", "three"} {
+		if err := s.recordChange(ctx, name, "1.0", actionNewRelease); err != nil {
+			t.Fatalf("Failed to record change, %s", err)
+		}
+	}
+
+	tests := []struct {
+		since      string
+		wantStatus int
+		want       []int
+	}{
+		{since: "", wantStatus: http.StatusOK, want: []int{1, 2, 3}},
+		{since: "1", wantStatus: http.StatusOK, want: []int{2, 3}},
+		{since: "3", wantStatus: http.StatusOK, want: nil},
+		{since: "-1", wantStatus: http.StatusBadRequest},
+		{since: "x", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run("since="+tt.since, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ChangelogHandler()(w, httptest.NewRequest(http.MethodGet, "/changelog?since="+tt.since, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Status is %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var body struct {
+				LastSerial int            `json:"last_serial"`
+				Entries    []journalEntry `json:"entries"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode response, %s", err)
+			}
+			if body.LastSerial != 3 || w.Header().Get("X-PyPI-Last-Serial") != "3" {
+				t.Errorf("Last serial is %d, header %q, want 3", body.LastSerial, w.Header().Get("X-PyPI-Last-Serial"))
+			}
+			if got := serials(body.Entries); !equalInts(got, tt.want) {
+				t.Errorf("Serials are %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogChangeRetriesFailedWrites(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	f.denyPut = func(key string) bool { return strings.HasPrefix(key, journalPrefix) }
+	s.logChange(ctx, "one", "1.0", actionReindex)
+	s.logChange(ctx, "two", "1.0", actionReindex)
+	if got := s.changelog.lastSerial(); got != 0 {
+		t.Fatalf("Last serial is %d while the journal can't be written, want 0", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.journalBacklog); got != 2 {
+		t.Errorf("Unrecorded changes are %v, want 2", got)
+	}
+
+	f.denyPut = nil
+	if err := s.retryJournal(ctx); err != nil {
+		t.Fatalf("Failed to retry journal, %s", err)
+	}
+	entries := s.changelog.since(0)
+	if got := serials(entries); !equalInts(got, []int{1, 2}) {
+		t.Fatalf("Serials are %v, want 1 and 2", got)
+	}
+	if entries[0].Name != "one" || entries[1].Name != "two" {
+		t.Errorf("Entries are %+v, want one then two", entries)
+	}
+	if got := testutil.ToFloat64(s.metrics.journalBacklog); got != 0 {
+		t.Errorf("Unrecorded changes are %v after retrying, want 0", got)
+	}
+}
+
+func TestPublishPackageJournal(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	for _, p := range []pkg{
+		testPkg("demo-1.0.tar.gz", "1.0", ""),
+		testPkg("demo-1.0-py3-none-any.whl", "1.0", ""),
+	} {
+		if err := s.addPackage(ctx, p); err != nil {
+			t.Fatalf("Failed to add %s, %s", p.FileName, err)
+		}
+	}
+	var actions []string
+	for _, e := range s.changelog.since(0) {
+		actions = append(actions, e.Action)
+	}
+	want := []string{"new release with file demo-1.0.tar.gz", "add file demo-1.0-py3-none-any.whl"}
+	if strings.Join(actions, "|") != strings.Join(want, "|") {
+		t.Errorf("Actions are %q, want %q", actions, want)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// projectInfo is the "info" object of the PyPI JSON API, the metadata of a release
+type projectInfo struct {
+	Name                   string            `json:"name"`
+	Version                string            `json:"version"`
+	Summary                string            `json:"summary"`
+	Description            string            `json:"description"`
+	DescriptionContentType string            `json:"description_content_type"`
+	Author                 string            `json:"author"`
+	License                string            `json:"license"`
+	HomePage               string            `json:"home_page"`
+	Keywords               string            `json:"keywords"`
+	Classifiers            []string          `json:"classifiers"`
+	ProjectURLs            map[string]string `json:"project_urls"`
+	RequiresPython         string            `json:"requires_python"`
+	RequiresDist           []string          `json:"requires_dist"`
+	Yanked                 bool              `json:"yanked"`
+	YankedReason           string            `json:"yanked_reason"`
+	PackageURL             string            `json:"package_url"`
+	ReleaseURL             string            `json:"release_url"`
+}
+
+// releaseFile is a distribution file in the PyPI JSON API
+type releaseFile struct {
+	FileName       string            `json:"filename"`
+	URL            string            `json:"url"`
+	Digests        map[string]string `json:"digests"`
+	MD5            string            `json:"md5_digest"`
+	Size           int64             `json:"size"`
+	PackageType    string            `json:"packagetype"`
+	PythonVersion  string            `json:"python_version"`
+	RequiresPython string            `json:"requires_python"`
+	UploadTime     string            `json:"upload_time_iso_8601,omitempty"`
+	Yanked         bool              `json:"yanked"`
+	YankedReason   string            `json:"yanked_reason"`
+}
+
+// packageType returns the PyPI package type of a distribution file
+func packageType(fileName string) string {
+	switch {
+	case strings.HasSuffix(fileName, ".whl"):
+		return "bdist_wheel"
+	case strings.HasSuffix(fileName, ".egg"):
+		return "bdist_egg"
+	case strings.HasSuffix(fileName, ".exe"):
+		return "bdist_wininst"
+	}
+	return "sdist"
+}
+
+// releaseFiles returns the files of a release as in the PyPI JSON API, base is the URL of gopi
+func releaseFiles(r release, base string) []releaseFile {
+	files := []releaseFile{}
+	for _, f := range r.Files {
+		rf := releaseFile{
+			FileName:       f.FileName,
+			URL:            base + "/api" + f.URL,
+			Digests:        map[string]string{"md5": f.MD5},
+			MD5:            f.MD5,
+			Size:           f.Size,
+			PackageType:    packageType(f.FileName),
+			PythonVersion:  f.PyVer,
+			RequiresPython: r.RequiresPython,
+			Yanked:         r.Yanked,
+			YankedReason:   r.YankedReason,
+		}
+		if f.SHA256 != "" {
+			rf.Digests["sha256"] = f.SHA256
+		}
+		if rf.PythonVersion == "" {
+			rf.PythonVersion = "source"
+		}
+		if !f.UploadTime.IsZero() {
+			rf.UploadTime = f.UploadTime.Format(time.RFC3339)
+		}
+		files = append(files, rf)
+	}
+	return files
+}
+
+// JSONHandler serves the PyPI JSON API. /pypi/<name>/json describes the
+// latest release and lists the files of every release by version,
+// /pypi/<name>/<version>/json describes that release only.
+func (s *server) JSONHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := normalisePackageName(vars["package"])
+		if !s.index.exists(name) {
+			http.Error(w, "Package not found", http.StatusNotFound)
+			return
+		}
+		pr, err := s.project(r.Context(), name)
+		if err != nil {
+			logger(r.Context()).Error("Failed to load package", "package", name, "err", err)
+			http.Error(w, "Failed to load package", http.StatusInternalServerError)
+			return
+		}
+		version := vars["version"]
+		if version == "" {
+			version = pr.latest().Version
+		}
+		current := pr.findRelease(version)
+		if current == nil {
+			http.Error(w, "Version not found", http.StatusNotFound)
+			return
+		}
+		base := baseURL(r)
+		md := current.releaseMetadata
+		info := projectInfo{
+			Name:                   name,
+			Version:                current.Version,
+			Summary:                md.Summary,
+			Description:            md.Description,
+			DescriptionContentType: md.DescriptionContentType,
+			Author:                 md.Author,
+			License:                md.License,
+			HomePage:               md.HomePage,
+			Keywords:               md.Keywords,
+			Classifiers:            md.Classifiers,
+			ProjectURLs:            make(map[string]string),
+			RequiresPython:         md.RequiresPython,
+			RequiresDist:           md.RequiresDist,
+			Yanked:                 current.Yanked,
+			YankedReason:           current.YankedReason,
+			PackageURL:             base + "/package/" + name + "/",
+			ReleaseURL:             base + "/package/" + name + "/" + current.Version + "/",
+		}
+		for _, u := range projectURLs(md) {
+			info.ProjectURLs[u.Label] = u.URL
+		}
+		serial := s.changelog.projectSerial(name)
+		w.Header().Set("X-PyPI-Last-Serial", strconv.Itoa(serial))
+		body := map[string]interface{}{
+			"info":        info,
+			"last_serial": serial,
+			"urls":        releaseFiles(*current, base),
+		}
+		if vars["version"] == "" {
+			releases := make(map[string][]releaseFile)
+			for _, rel := range pr.Releases {
+				releases[rel.Version] = releaseFiles(rel, base)
+			}
+			body["releases"] = releases
+		}
+		writeJSON(w, http.StatusOK, body)
+	}
+}
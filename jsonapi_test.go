@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSONHandler(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	for _, p := range []pkg{
+		testPkg("demo-1.0.tar.gz", "1.0", "first"),
+		testPkg("demo-1.0-py3-none-any.whl", "1.0", "first"),
+		testPkg("demo-2.0.tar.gz", "2.0", "second"),
+	} {
+		if err := s.addPackage(ctx, p); err != nil {
+			t.Fatalf("Failed to add %s, %s", p.FileName, err)
+		}
+	}
+
+	type response struct {
+		Info     projectInfo              `json:"info"`
+		URLs     []releaseFile            `json:"urls"`
+		Releases map[string][]releaseFile `json:"releases"`
+	}
+	get := func(path string) (int, response) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var body response
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode %s, %s", path, err)
+			}
+		}
+		return w.Code, body
+	}
+
+	status, body := get("/pypi/demo/json")
+	if status != http.StatusOK {
+		t.Fatalf("/pypi/demo/json returned %d", status)
+	}
+	if body.Info.Version != "2.0" || body.Info.Summary != "second" {
+		t.Errorf("info is %s %q, want the latest release", body.Info.Version, body.Info.Summary)
+	}
+	if len(body.URLs) != 1 || body.URLs[0].FileName != "demo-2.0.tar.gz" || body.URLs[0].PackageType != "sdist" {
+		t.Errorf("urls are %+v, want the sdist of 2.0", body.URLs)
+	}
+	if len(body.Releases) != 2 || len(body.Releases["1.0"]) != 2 || len(body.Releases["2.0"]) != 1 {
+		t.Errorf("releases are %+v, want 2 files for 1.0 and 1 for 2.0", body.Releases)
+	}
+
+	status, body = get("/pypi/demo/1.0/json")
+	if status != http.StatusOK {
+		t.Fatalf("/pypi/demo/1.0/json returned %d", status)
+	}
+	if body.Info.Version != "1.0" || len(body.URLs) != 2 || body.Releases != nil {
+		t.Errorf("Got version %s with %d files and releases %v, want 1.0 with 2 files only", body.Info.Version, len(body.URLs), body.Releases)
+	}
+
+	if status, _ := get("/pypi/demo/3.0/json"); status != http.StatusNotFound {
+		t.Errorf("Unknown version returned %d, want 404", status)
+	}
+	if status, _ := get("/pypi/nope/json"); status != http.StatusNotFound {
+		t.Errorf("Unknown package returned %d, want 404", status)
+	}
+}
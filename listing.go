@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Orders of the package list
+const (
+	sortName      = "name"
+	sortUpdated   = "updated"
+	sortDownloads = "downloads"
+)
+
+// listPageSize is how many packages are shown per page of the package list
+const listPageSize = 50
+
+// maxListPage is the highest page number accepted, larger ones would overflow
+// the offset into the list
+const maxListPage = 1 << 20
+
+// downloadTotalsTTL is how long the download totals used to sort the package list are cached
+const downloadTotalsTTL = time.Minute
+
+// listQuery is what the package list is filtered, sorted and paged by
+type listQuery struct {
+	Filter string
+	Sort   string
+	Page   int
+}
+
+// parseListQuery reads the "q", "sort" and "page" query parameters
+func parseListQuery(values url.Values) listQuery {
+	q := listQuery{
+		Filter: strings.TrimSpace(values.Get("q")),
+		Sort:   values.Get("sort"),
+		Page:   1,
+	}
+	switch q.Sort {
+	case sortName, sortUpdated, sortDownloads:
+	default:
+		q.Sort = sortName
+	}
+	if page, err := strconv.Atoi(values.Get("page")); err == nil && page > 1 {
+		q.Page = min(page, maxListPage)
+	}
+	return q
+}
+
+// listEntry is a project in the package list
+type listEntry struct {
+	Name string
+	projectSummary
+	Downloads int
+}
+
+// listPage is the template data of the package list
+type listPage struct {
+	Query    listQuery
+	Projects []listEntry
+	// Total is the number of projects matching the filter
+	Total int
+	Pages int
+}
+
+// URL returns the link to page of the list, keeping the filter and order
+func (lp listPage) URL(page int) string {
+	v := url.Values{}
+	if lp.Query.Filter != "" {
+		v.Set("q", lp.Query.Filter)
+	}
+	if lp.Query.Sort != sortName {
+		v.Set("sort", lp.Query.Sort)
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	if len(v) == 0 {
+		return "/"
+	}
+	return "/?" + v.Encode()
+}
+
+// PrevURL links to the page before the current one
+func (lp listPage) PrevURL() string {
+	return lp.URL(max(1, lp.Query.Page-1))
+}
+
+// NextURL links to the page after the current one
+func (lp listPage) NextURL() string {
+	return lp.URL(min(lp.Pages, lp.Query.Page+1))
+}
+
+// PageNumbers returns the pages to link to, a window around the current one
+func (lp listPage) PageNumbers() []int {
+	first := max(1, lp.Query.Page-3)
+	last := min(lp.Pages, lp.Query.Page+3)
+	var pages []int
+	for p := first; p <= last; p++ {
+		pages = append(pages, p)
+	}
+	return pages
+}
+
+// matches reports whether every word of filter is in the name, summary or keywords of the project
+func (e listEntry) matches(filter string) bool {
+	text := strings.ToLower(e.Name + " " + e.Summary + " " + e.Keywords)
+	for _, word := range strings.Fields(strings.ToLower(filter)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// listProjects filters, sorts and pages the project list. Ties are broken by
+// name so the order is the same on every request.
+func (s *server) listProjects(ctx context.Context, q listQuery) (listPage, error) {
+	page := listPage{Query: q}
+	var downloads map[string]int
+	if q.Sort == sortDownloads {
+		var err error
+		downloads, err = s.downloadTotals(ctx)
+		if err != nil {
+			return page, err
+		}
+	}
+	list := s.index.projectList()
+	var entries []listEntry
+	for _, name := range list.sortedNames() {
+		e := listEntry{Name: name, projectSummary: list[name], Downloads: downloads[name]}
+		if e.matches(q.Filter) {
+			entries = append(entries, e)
+		}
+	}
+	switch q.Sort {
+	case sortUpdated:
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].LastUpload().After(entries[j].LastUpload())
+		})
+	case sortDownloads:
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Downloads > entries[j].Downloads
+		})
+	}
+	page.Total = len(entries)
+	page.Pages = (len(entries) + listPageSize - 1) / listPageSize
+	// Pages past the end show the last one
+	page.Query.Page = max(1, min(q.Page, page.Pages))
+	start := (page.Query.Page - 1) * listPageSize
+	if start < len(entries) {
+		page.Projects = entries[start:min(start+listPageSize, len(entries))]
+	}
+	return page, nil
+}
+
+// downloadTotals caches the stored download totals of every project, reading
+// them all from the bucket on every request would be too slow. Flushing the
+// stats updates the totals it writes, and the rest are read again in the
+// background once they're downloadTotalsTTL old.
+type downloadTotals struct {
+	mu     sync.Mutex
+	totals map[string]projectDownloads
+	read   time.Time
+	// reading is closed when the read in progress is done, nil if there's none
+	reading chan struct{}
+	err     error
+}
+
+// set records the stored stats of a project after they were written
+func (dt *downloadTotals) set(name string, stats *projectStats) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.totals != nil {
+		dt.totals[name] = newProjectDownloads(name, stats)
+	}
+}
+
+// downloadTotals returns the total downloads of every project
+func (s *server) downloadTotals(ctx context.Context) (map[string]int, error) {
+	summaries, err := s.downloadSummaries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[string]int, len(summaries))
+	for name, d := range summaries {
+		totals[name] = d.Total
+	}
+	return totals, nil
+}
+
+// downloadSummaries returns the total downloads and last download day of every
+// project that has been downloaded. Only the first call waits for them to be
+// read, later ones get the cached summaries while they're read again.
+func (s *server) downloadSummaries(ctx context.Context) (map[string]projectDownloads, error) {
+	s.totals.mu.Lock()
+	if s.totals.reading == nil && (s.totals.totals == nil || time.Since(s.totals.read) >= downloadTotalsTTL) {
+		s.totals.reading = make(chan struct{})
+		go s.readDownloadTotals(context.WithoutCancel(ctx), s.totals.reading)
+	}
+	reading := s.totals.reading
+	cached := s.totals.totals != nil
+	s.totals.mu.Unlock()
+
+	if !cached {
+		select {
+		case <-reading:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	s.totals.mu.Lock()
+	defer s.totals.mu.Unlock()
+	if s.totals.totals == nil {
+		return nil, s.totals.err
+	}
+	summaries := make(map[string]projectDownloads, len(s.totals.totals))
+	for name, d := range s.totals.totals {
+		summaries[name] = d
+	}
+	for name, pending := range s.stats.summaries() {
+		d := summaries[name]
+		d.Name = name
+		d.Total += pending.Total
+		d.LastDownload = max(d.LastDownload, pending.LastDownload)
+		summaries[name] = d
+	}
+	return summaries, nil
+}
+
+// readDownloadTotals reads the stored stats of every project and closes done
+func (s *server) readDownloadTotals(ctx context.Context, done chan struct{}) {
+	totals := make(map[string]projectDownloads)
+	var err error
+	for _, name := range s.index.projectList().sortedNames() {
+		var stats *projectStats
+		stats, err = s.readStats(ctx, name)
+		if err != nil {
+			break
+		}
+		totals[name] = newProjectDownloads(name, stats)
+	}
+
+	s.totals.mu.Lock()
+	defer s.totals.mu.Unlock()
+	defer close(done)
+	s.totals.reading = nil
+	s.totals.err = err
+	if err != nil {
+		logger(ctx).Error("Failed to read download totals", "err", err)
+		return
+	}
+	// A flush during the read may have written a newer total, totals only grow
+	for name, d := range s.totals.totals {
+		if t, ok := totals[name]; ok && d.Total > t.Total {
+			totals[name] = d
+		}
+	}
+	s.totals.totals = totals
+	s.totals.read = time.Now()
+}
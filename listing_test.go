@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestListProjectsPaging(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	list := make(projectList)
+	for i := 0; i < listPageSize+10; i++ {
+		list[fmt.Sprintf("project-%03d", i)] = projectSummary{Version: "1.0"}
+	}
+	s.index.setList(list)
+
+	tests := []struct {
+		page     string
+		wantPage int
+		// wantFirst is the first project shown and wantCount how many are
+		wantFirst string
+		wantCount int
+	}{
+		{page: "", wantPage: 1, wantFirst: "project-000", wantCount: listPageSize},
+		{page: "0", wantPage: 1, wantFirst: "project-000", wantCount: listPageSize},
+		{page: "-5", wantPage: 1, wantFirst: "project-000", wantCount: listPageSize},
+		{page: "nope", wantPage: 1, wantFirst: "project-000", wantCount: listPageSize},
+		{page: "2", wantPage: 2, wantFirst: "project-050", wantCount: 10},
+		{page: "3", wantPage: 2, wantFirst: "project-050", wantCount: 10},
+		{page: strconv.Itoa(math.MaxInt), wantPage: 2, wantFirst: "project-050", wantCount: 10},
+		{page: strconv.Itoa(math.MaxInt/listPageSize + 2), wantPage: 2, wantFirst: "project-050", wantCount: 10},
+	}
+	for _, tt := range tests {
+		t.Run("page="+tt.page, func(t *testing.T) {
+			q := parseListQuery(url.Values{"page": {tt.page}})
+			page, err := s.listProjects(context.Background(), q)
+			if err != nil {
+				t.Fatalf("listProjects() error = %s", err)
+			}
+			if page.Query.Page != tt.wantPage || page.Pages != 2 || page.Total != listPageSize+10 {
+				t.Fatalf("Got page %d of %d with %d projects, want page %d of 2 with %d", page.Query.Page, page.Pages, page.Total, tt.wantPage, listPageSize+10)
+			}
+			if len(page.Projects) != tt.wantCount || page.Projects[0].Name != tt.wantFirst {
+				t.Fatalf("Page shows %d projects starting with %+v, want %d starting with %s", len(page.Projects), page.Projects[0], tt.wantCount, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestListProjectsEmpty(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	page, err := s.listProjects(context.Background(), parseListQuery(url.Values{"page": {"7"}}))
+	if err != nil {
+		t.Fatalf("listProjects() error = %s", err)
+	}
+	if page.Query.Page != 1 || page.Pages != 0 || len(page.Projects) != 0 {
+		t.Fatalf("Got page %d of %d with %d projects, want page 1 of 0 with none", page.Query.Page, page.Pages, len(page.Projects))
+	}
+	if got := page.NextURL(); got != "/" {
+		t.Errorf("NextURL() = %q, want /", got)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log formats
+const (
+	logText = "text"
+	logJSON = "json"
+)
+
+// maxLogValue is the longest string value that's logged in full, longer
+// values such as package descriptions are cut short
+const maxLogValue = 256
+
+// redactedKeys are the parts of attribute and form field names whose values are never logged
+var redactedKeys = []string{"password", "secret", "token", "authorization", "credential", "signature"}
+
+// newLogger returns a logger writing to w in the given format, either logText or logJSON
+func newLogger(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	switch format {
+	case logText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case logJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("Log format must be %q or %q, not %q", logText, logJSON, format)
+}
+
+// parseLogLevel parses one of debug, info, warn or error
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return level, fmt.Errorf("Invalid log level %q, must be debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// redactAttr hides credentials and shortens long strings before they're logged
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if isSensitive(a.Key) {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	if a.Value.Kind() == slog.KindString {
+		a.Value = slog.StringValue(truncate(a.Value.String()))
+	}
+	return a
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range redactedKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func truncate(v string) string {
+	if len(v) <= maxLogValue {
+		return v
+	}
+	return fmt.Sprintf("%s... (%d bytes)", v[:maxLogValue], len(v))
+}
+
+// formAttr logs the fields of a form as a group, the values of each field
+// go through the same redaction as any other attribute
+func formAttr(key string, form url.Values) slog.Attr {
+	attrs := make([]any, 0, len(form))
+	for name, values := range form {
+		attrs = append(attrs, slog.String(name, strings.Join(values, ", ")))
+	}
+	return slog.Group(key, attrs...)
+}
+
+// urlAttr logs a URL without its query, presigned URLs carry their signature in it
+func urlAttr(key string, u *url.URL) slog.Attr {
+	stripped := *u
+	stripped.RawQuery = ""
+	return slog.String(key, stripped.String())
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	identityKey
+)
+
+// requestID returns the ID of the request ctx belongs to, empty outside of requests
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// logger returns the default logger, tagged with the request ID when ctx
+// belongs to a request and the trace ID when it's part of a trace
+func logger(ctx context.Context) *slog.Logger {
+	l := slog.Default()
+	if id := requestID(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+	}
+	return l
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// logRequests gives every request an ID, reusing the X-Request-ID header
+// sent by a proxy in front of gopi, and logs each request once it's served
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r)
+		level := slog.LevelInfo
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			// Probes run every few seconds and would drown out everything else
+			level = slog.LevelDebug
+		}
+		logger(r.Context()).Log(r.Context(), level, "Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sr.status,
+			"bytes", sr.bytes,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
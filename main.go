@@ -1,60 +1,263 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strings"
-
-	"github.com/minio/minio/pkg/console"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
-	endpoint  string
-	accessKey string
-	secretKey string
-	port      string
-	bucket    string
-	debug     bool
+	configFile      string
+	endpoint        string
+	accessKey       string
+	secretKey       string
+	proxy           string
+	port            string
+	listen          string
+	bucket          string
+	debug           bool
+	adminToken      string
+	refreshInterval time.Duration
+	downloadMode    string
+	statsInterval   time.Duration
+	logFormat       string
+	logLevel        string
+	otlpEndpoint    string
+	maxUploadSize   int64
+	allowOverwrite  bool
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsClientCAFile string
+	tlsClientAuth   string
+	drainDelay      time.Duration
+	shutdownTimeout time.Duration
+	themeDir        string
 )
 
 func main() {
 	if err := run(); err != nil {
-		log.Println(err.Error())
+		slog.Error(err.Error())
 		os.Exit(1)
 	}
 }
 
 func run() error {
+	flag.StringVar(&configFile, "config", os.Getenv("GOPI_CONFIG"), "YAML config file, settings in it are overridden by GOPI_* environment variables and flags")
 	flag.StringVar(&endpoint, "endpoint", "http://localhost:9000", "S3 server endpoint")
 	flag.StringVar(&accessKey, "accessKey", "", "Access key of S3 storage")
 	flag.StringVar(&secretKey, "secretKey", "", "Secret key of S3 storage")
 	flag.StringVar(&bucket, "bucket", "", "Bucket name which hosts static files")
-	flag.StringVar(&port, "port", "8080", "Bind to a specific port")
-	flag.BoolVar(&debug, "debug", false, "Enable debug logs")
+	flag.StringVar(&proxy, "proxy", "", "HTTP proxy to reach S3 through, HTTPS_PROXY, HTTP_PROXY and NO_PROXY are used when empty")
+	flag.StringVar(&listen, "listen", "0.0.0.0:8080", "Address to serve on")
+	flag.StringVar(&port, "port", "8080", "Bind to a specific port, overrides the port of -listen")
+	flag.StringVar(&tlsCertFile, "tlsCertFile", "", "Serve over TLS with this certificate, it's reloaded when the file changes")
+	flag.StringVar(&tlsKeyFile, "tlsKeyFile", "", "Private key of -tlsCertFile")
+	flag.StringVar(&tlsClientCAFile, "tlsClientCAFile", "", "CA certificates used to verify client certificates")
+	flag.StringVar(&tlsClientAuth, "tlsClientAuth", clientAuthOptional, `Whether clients must present a certificate, "none", "optional" or "require"`)
+	flag.BoolVar(&debug, "debug", false, "Enable debug logs, same as -logLevel debug")
+	flag.StringVar(&logFormat, "logFormat", logText, `Log format, "text" or "json"`)
+	flag.StringVar(&logLevel, "logLevel", "info", "Log level, one of debug, info, warn or error")
+	flag.StringVar(&otlpEndpoint, "otlpEndpoint", "", "OTLP/HTTP collector to send traces to, e.g. http://localhost:4318, tracing is disabled when empty")
+	flag.StringVar(&adminToken, "adminToken", "", "Bearer token for the /admin endpoints, they are disabled when empty")
+	flag.DurationVar(&refreshInterval, "refreshInterval", 30*time.Second, "How often to check the bucket for index changes made by other gopi servers, 0 disables it")
+	flag.StringVar(&downloadMode, "downloadMode", downloadRedirect, `How files are downloaded, "redirect" to a presigned S3 URL or "stream" through gopi`)
+	flag.DurationVar(&statsInterval, "statsInterval", time.Minute, "How often download stats are written to the bucket")
+	flag.DurationVar(&drainDelay, "drainDelay", 5*time.Second, "How long to keep serving on SIGTERM after failing readiness, so load balancers stop sending requests")
+	flag.DurationVar(&shutdownTimeout, "shutdownTimeout", 30*time.Second, "How long in-flight requests get to finish on SIGTERM")
+	flag.StringVar(&themeDir, "themeDir", "", "Directory with templates and assets replacing the built-in ones of the same name")
+	flag.Int64Var(&maxUploadSize, "maxUploadSize", 0, "Largest upload accepted in bytes, 0 means no limit")
+	flag.BoolVar(&allowOverwrite, "allowOverwrite", false, "Let uploads replace existing files and reuse the names of deleted ones, for development indexes")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  reindex [-extract] [-dryRun]\tRebuild the package index from the files in the bucket\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  fsck [-hashes] [-repair]\tCheck the package index against the files in the bucket\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	if strings.TrimSpace(bucket) == "" {
-		console.Fatalln(`Bucket name cannot be empty, please provide 'gopi -bucket "mybucket"'`)
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
 	}
-	if strings.TrimSpace(endpoint) == "" {
-		console.Fatalln(`Endpoint cannot be empty, please provide 'gopi -endpoint "http://localhost:9000/"'`)
+	applyFlags(&c)
+	err = c.validate()
+	if err != nil {
+		return err
 	}
 
-	console.DebugPrint = debug
+	level, _ := parseLogLevel(c.Log.Level)
+	l, err := newLogger(os.Stdout, c.Log.Format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(l)
+
+	if c.Tracing.OTLPEndpoint != "" {
+		shutdown, err := setupTracing(context.Background(), c.Tracing.OTLPEndpoint)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := shutdown(context.Background())
+			if err != nil {
+				slog.Error("Failed to flush traces", "err", err)
+			}
+		}()
+	}
 
 	cfg := s3Config{
-		endpoint:  endpoint,
-		bucket:    bucket,
-		accessKey: accessKey,
-		secretKey: secretKey,
+		endpoint:  c.Storage.Endpoint,
+		bucket:    c.Storage.Bucket,
+		accessKey: c.Storage.AccessKey,
+		secretKey: c.Storage.SecretKey,
+		proxy:     c.Storage.Proxy,
+		noProxy:   c.Storage.NoProxy,
+	}
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case "reindex":
+		return runReindex(cfg, flag.Args()[1:])
+	case "fsck":
+		return runFsck(cfg, flag.Args()[1:])
+	default:
+		flag.Usage()
+		return fmt.Errorf("Unknown command %q", cmd)
+	}
+
+	users, err := parseUsers(c.Auth.Users)
+	if err != nil {
+		return err
+	}
+	s, err := newServer(cfg, serverConfig{
+		adminToken:     c.Auth.AdminToken,
+		downloadMode:   c.Downloads.Mode,
+		maxUploadSize:  c.Limits.MaxUploadSize,
+		allowOverwrite: c.Uploads.AllowOverwrite,
+		readers:        c.Auth.Read,
+		uploaders:      c.Auth.Upload,
+		users:          users,
+		identified:     c.identifiesClients(),
+		themeDir:       c.UI.ThemeDir,
+	})
+	if err != nil {
+		return err
 	}
-	s, err := newServer(cfg)
+	err = verifyVendorAssets(s.ui)
 	if err != nil {
 		return err
 	}
-	console.Debugln(s.templates.DefinedTemplates())
-	console.Infof("Serving on port %s\n", port)
-	return http.ListenAndServe("0.0.0.0:"+port, s)
+	tlsConfig, err := newTLSConfig(c.TLS)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:              c.Listen,
+		Handler:           s,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: c.Timeouts.ReadHeader,
+		ReadTimeout:       c.Timeouts.Read,
+		WriteTimeout:      c.Timeouts.Write,
+		IdleTimeout:       c.Timeouts.Idle,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	s.runBackground(background, c.Index.RefreshInterval, c.Stats.Interval)
+	slog.Debug("Parsed templates", "templates", s.templates.DefinedTemplates())
+
+	errc := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			clientAuth := c.TLS.ClientAuth
+			if c.TLS.ClientCAFile == "" {
+				clientAuth = clientAuthNone
+			}
+			slog.Info("Serving over TLS", "address", c.Listen, "client_auth", clientAuth)
+			errc <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		slog.Info("Serving", "address", c.Listen)
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	// A second signal kills gopi straight away
+	stop()
+	return s.shutdown(srv, c.Timeouts.Drain, c.Timeouts.Shutdown, stopBackground)
+}
+
+// applyFlags overrides the config with the flags given on the command line
+func applyFlags(c *config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "endpoint":
+			c.Storage.Endpoint = endpoint
+		case "accessKey":
+			c.Storage.AccessKey = accessKey
+		case "secretKey":
+			c.Storage.SecretKey = secretKey
+		case "bucket":
+			c.Storage.Bucket = bucket
+		case "proxy":
+			c.Storage.Proxy = proxy
+		case "listen":
+			c.Listen = listen
+		case "port":
+			// Only replaces the port so it can be combined with a listen
+			// address from the config, flags are visited in lexical order
+			host, _, err := net.SplitHostPort(c.Listen)
+			if err != nil {
+				host = "0.0.0.0"
+			}
+			c.Listen = net.JoinHostPort(host, port)
+		case "tlsCertFile":
+			c.TLS.CertFile = tlsCertFile
+		case "tlsKeyFile":
+			c.TLS.KeyFile = tlsKeyFile
+		case "tlsClientCAFile":
+			c.TLS.ClientCAFile = tlsClientCAFile
+		case "tlsClientAuth":
+			c.TLS.ClientAuth = tlsClientAuth
+		case "logFormat":
+			c.Log.Format = logFormat
+		case "logLevel":
+			c.Log.Level = logLevel
+		case "otlpEndpoint":
+			c.Tracing.OTLPEndpoint = otlpEndpoint
+		case "adminToken":
+			c.Auth.AdminToken = adminToken
+		case "refreshInterval":
+			c.Index.RefreshInterval = refreshInterval
+		case "downloadMode":
+			c.Downloads.Mode = downloadMode
+		case "statsInterval":
+			c.Stats.Interval = statsInterval
+		case "drainDelay":
+			c.Timeouts.Drain = drainDelay
+		case "shutdownTimeout":
+			c.Timeouts.Shutdown = shutdownTimeout
+		case "maxUploadSize":
+			c.Limits.MaxUploadSize = maxUploadSize
+		case "allowOverwrite":
+			c.Uploads.AllowOverwrite = allowOverwrite
+		case "themeDir":
+			c.UI.ThemeDir = themeDir
+		}
+	})
+	if debug {
+		c.Log.Level = "debug"
+	}
 }
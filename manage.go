@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// managePage is the template data of the management page
+type managePage struct {
+	User     string
+	Flashes  []flash
+	Projects []string
+}
+
+// manageProjectPage is the template data of the management page of a project
+type manageProjectPage struct {
+	User     string
+	Flashes  []flash
+	Name     string
+	Releases []release
+	Access   projectAccess
+	// Role is the role of User on the project
+	Role string
+	// NewToken is only set on the response creating it, it can't be shown again
+	NewToken string
+}
+
+// ManageHandler shows the upload form and the projects to manage
+func (s *server) ManageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := managePage{
+			User:     requestIdentity(r.Context()).name,
+			Flashes:  takeFlashes(w, r),
+			Projects: s.index.projectList().sortedNames(),
+		}
+		err := s.templates.ExecuteTemplate(w, "manage.tpl.html", data)
+		if err != nil {
+			logger(r.Context()).Error("Failed to execute template", "err", err)
+		}
+	}
+}
+
+// ManageUploadHandler uploads the distribution files of the browser upload
+// form. The name and version are read from the files, browsers don't send
+// metadata like twine does.
+func (s *server) ManageUploadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowLongTransfer(w, r)
+		log := logger(r.Context())
+		if s.cfg.maxUploadSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, s.cfg.maxUploadSize)
+		}
+		err := r.ParseMultipartForm(32 << 20)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.metrics.uploadFailed(err)
+			setFlashes(w, flash{flashError, fmt.Sprintf("Upload is larger than the limit of %d bytes", tooLarge.Limit)})
+			http.Redirect(w, r, "/manage/", http.StatusSeeOther)
+			return
+		}
+		if err != nil || len(r.MultipartForm.File["content"]) == 0 {
+			setFlashes(w, flash{flashError, "Choose one or more distribution files to upload"})
+			http.Redirect(w, r, "/manage/", http.StatusSeeOther)
+			return
+		}
+		uploader := requestIdentity(r.Context())
+		var flashes []flash
+		for _, header := range r.MultipartForm.File["content"] {
+			p, err := s.uploadFormFile(r, header, uploader)
+			if err != nil {
+				s.metrics.uploadFailed(err)
+				_, msg := uploadError(err, header.Filename)
+				log.Warn("Failed to upload file", "file", header.Filename, "err", err)
+				flashes = append(flashes, flash{flashError, msg})
+				continue
+			}
+			flashes = append(flashes, flash{flashSuccess, fmt.Sprintf("Uploaded %s to %s %s", p.FileName, p.Name, p.Version)})
+		}
+		setFlashes(w, flashes...)
+		http.Redirect(w, r, "/manage/", http.StatusSeeOther)
+	}
+}
+
+// uploadFormFile reads the name, version and metadata of a file from the
+// browser upload form and stores it. The file is read from the temporary
+// file the form was parsed into rather than held in memory.
+func (s *server) uploadFormFile(r *http.Request, header *multipart.FileHeader, uploader identity) (pkg, error) {
+	f, err := header.Open()
+	if err != nil {
+		return pkg{}, err
+	}
+	defer f.Close()
+	p := parseFilename(header.Filename)
+	md, err := extractMetadata(header.Filename, f, header.Size)
+	if err == nil {
+		md.apply(&p)
+	} else {
+		logger(r.Context()).Debug("Failed to extract metadata", "file", header.Filename, "err", err)
+	}
+	p.FileName = header.Filename
+	p.URL = fmt.Sprintf("/%s%s%s", p.Name, pathSeparator, header.Filename)
+	p.Size = header.Size
+	p.MD5, p.SHA256, err = readerDigests(io.NewSectionReader(f, 0, header.Size))
+	if err != nil {
+		return pkg{}, err
+	}
+	return p, s.storeUpload(r.Context(), p, io.NewSectionReader(f, 0, header.Size), uploader)
+}
+
+// ManageProjectHandler shows the releases, owners and tokens of a project
+func (s *server) ManageProjectHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["package"]
+		if !s.index.exists(name) {
+			http.Error(w, "Package not found", http.StatusNotFound)
+			return
+		}
+		s.renderManageProject(w, r, name, takeFlashes(w, r), "")
+	}
+}
+
+func (s *server) renderManageProject(w http.ResponseWriter, r *http.Request, name string, flashes []flash, newToken string) {
+	pr, err := s.project(r.Context(), name)
+	if err != nil {
+		logger(r.Context()).Error("Failed to load package", "package", name, "err", err)
+		http.Error(w, "Failed to load package", http.StatusInternalServerError)
+		return
+	}
+	access, err := s.readAccess(r.Context(), name)
+	if err != nil {
+		logger(r.Context()).Error("Failed to read project access", "package", name, "err", err)
+		http.Error(w, "Failed to load package", http.StatusInternalServerError)
+		return
+	}
+	user := requestIdentity(r.Context()).name
+	if !access.claimed() {
+		http.Error(w, fmt.Sprintf("Forbidden, nobody owns %s yet, ask an admin to assign an owner", name), http.StatusForbidden)
+		return
+	}
+	if !access.allows(user, roleMaintainer) {
+		http.Error(w, fmt.Sprintf("Forbidden, only owners and maintainers may manage %s", name), http.StatusForbidden)
+		return
+	}
+	data := manageProjectPage{
+		User:     user,
+		Flashes:  flashes,
+		Name:     name,
+		Releases: pr.Releases,
+		Access:   access,
+		Role:     access.role(user),
+		NewToken: newToken,
+	}
+	err = s.templates.ExecuteTemplate(w, "managepackage.tpl.html", data)
+	if err != nil {
+		logger(r.Context()).Error("Failed to execute template", "err", err)
+	}
+}
+
+// manageActions maps the actions of the project management page to the role they need
+var manageActions = map[string]string{
+	"yank":         roleMaintainer,
+	"unyank":       roleMaintainer,
+	"delete":       roleMaintainer,
+	"create-token": roleMaintainer,
+	"revoke-token": roleMaintainer,
+	"add-role":     roleOwner,
+	"remove-role":  roleOwner,
+}
+
+// ManageActionHandler handles the forms of the project management page
+func (s *server) ManageActionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["package"]
+		if !s.index.exists(name) {
+			http.Error(w, "Package not found", http.StatusNotFound)
+			return
+		}
+		role, ok := manageActions[vars["action"]]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unsupported action %s", vars["action"]), http.StatusNotFound)
+			return
+		}
+		ctx := r.Context()
+		user := requestIdentity(ctx).name
+		version := r.PostFormValue("version")
+		access, err := s.readAccess(ctx, name)
+		if err == nil && !access.allows(user, role) {
+			err = NotAllowed
+		}
+		if err != nil {
+			logger(ctx).Warn("Failed to manage package", "package", name, "action", vars["action"], "identity", user, "err", err)
+			setFlashes(w, flash{flashError, manageError(err, vars["action"])})
+			http.Redirect(w, r, fmt.Sprintf("/manage/%s/", name), http.StatusSeeOther)
+			return
+		}
+		var done string
+		switch vars["action"] {
+		case "yank":
+			err = s.setYanked(ctx, name, version, true, strings.TrimSpace(r.PostFormValue("reason")))
+			done = fmt.Sprintf("Yanked %s %s", name, version)
+		case "unyank":
+			err = s.setYanked(ctx, name, version, false, "")
+			done = fmt.Sprintf("Unyanked %s %s", name, version)
+		case "delete":
+			err = s.deleteRelease(ctx, name, version)
+			done = fmt.Sprintf("Deleted %s %s", name, version)
+		case "add-role":
+			member := strings.TrimSpace(r.PostFormValue("user"))
+			memberRole := r.PostFormValue("role")
+			if member == "" || (memberRole != roleOwner && memberRole != roleMaintainer) {
+				err = InvalidFormat
+				break
+			}
+			err = s.addRole(ctx, name, member, memberRole)
+			done = fmt.Sprintf("Gave %s the %s role on %s", member, memberRole, name)
+		case "remove-role":
+			member := r.PostFormValue("user")
+			err = s.removeRole(ctx, name, member)
+			done = fmt.Sprintf("Removed %s from %s", member, name)
+		case "create-token":
+			tokenName := strings.TrimSpace(r.PostFormValue("name"))
+			if tokenName == "" {
+				err = InvalidFormat
+				break
+			}
+			var token string
+			token, err = s.createToken(ctx, name, tokenName, user)
+			if err == nil {
+				logger(ctx).Info("Created package token", "package", name, "token", tokenName, "identity", user)
+				// Render straight away rather than redirecting, the token mustn't end up in a cookie
+				s.renderManageProject(w, r, name, []flash{{flashSuccess, fmt.Sprintf("Created token %s, copy it now as it won't be shown again", tokenName)}}, token)
+				return
+			}
+		case "revoke-token":
+			err = s.revokeToken(ctx, name, r.PostFormValue("id"))
+			done = "Revoked token"
+		}
+		if err != nil {
+			logger(ctx).Warn("Failed to manage package", "package", name, "action", vars["action"], "version", version, "identity", user, "err", err)
+			setFlashes(w, flash{flashError, manageError(err, vars["action"])})
+		} else {
+			logger(ctx).Info("Managed package", "package", name, "action", vars["action"], "version", version, "identity", user)
+			setFlashes(w, flash{flashSuccess, done})
+		}
+		http.Redirect(w, r, fmt.Sprintf("/manage/%s/", name), http.StatusSeeOther)
+	}
+}
+
+// manageError tells the user why a management action failed
+func manageError(err error, action string) string {
+	switch {
+	case errors.Is(err, InvalidFormat):
+		return "Please fill in the form"
+	case errors.Is(err, NoSuchKey):
+		return "Version not found"
+	case errors.Is(err, NotAllowed):
+		return fmt.Sprintf("Not allowed to %s, ask an owner of the project", action)
+	case errors.Is(err, errLastOwner):
+		return "Add another owner first, a project needs at least one owner"
+	}
+	return fmt.Sprintf("Failed to %s", action)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// errNoMetadata is returned when a distribution doesn't contain a PKG-INFO or METADATA file
+var errNoMetadata = errors.New("no metadata file found in distribution")
+
+// coreMetadata holds the fields of a PKG-INFO/METADATA file, keyed by field
+// name. Fields such as Classifier can appear several times.
+type coreMetadata map[string][]string
+
+func (md coreMetadata) get(field string) string {
+	if v := md[field]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// apply copies the metadata onto p, leaving fields that aren't in the metadata untouched
+func (md coreMetadata) apply(p *pkg) {
+	if name := md.get("Name"); name != "" {
+		p.Name = normalisePackageName(name)
+	}
+	if version := md.get("Version"); version != "" {
+		p.Version = version
+	}
+	if summary := md.get("Summary"); summary != "" {
+		p.Summary = summary
+	}
+	if description := md.get("Description"); description != "" && description != "UNKNOWN" {
+		p.Description = description
+	}
+	if author := md.get("Author"); author != "" && author != "UNKNOWN" {
+		p.Author = author
+	} else if email := md.get("Author-email"); email != "" {
+		p.Author = email
+	}
+	if keywords := md.get("Keywords"); keywords != "" {
+		p.Keywords = keywords
+	}
+	if classifiers := md["Classifier"]; len(classifiers) > 0 {
+		p.Classifiers = classifiers
+	}
+	if contentType := md.get("Description-Content-Type"); contentType != "" {
+		p.DescriptionContentType = contentType
+	}
+	if license := md.get("License"); license != "" && license != "UNKNOWN" {
+		p.License = license
+	}
+	if homePage := md.get("Home-page"); homePage != "" && homePage != "UNKNOWN" {
+		p.HomePage = homePage
+	}
+	if urls := md["Project-URL"]; len(urls) > 0 {
+		p.ProjectURLs = urls
+	}
+	if requiresPython := md.get("Requires-Python"); requiresPython != "" {
+		p.RequiresPython = requiresPython
+	}
+	if requires := md["Requires-Dist"]; len(requires) > 0 {
+		p.RequiresDist = requires
+	}
+}
+
+// fileDigests returns the hex encoded MD5 and SHA256 digests of data
+func fileDigests(data []byte) (string, string) {
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	return hex.EncodeToString(md5Sum[:]), hex.EncodeToString(sha256Sum[:])
+}
+
+// readerDigests returns the hex encoded MD5 and SHA256 digests of what r reads
+func readerDigests(r io.Reader) (string, string, error) {
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	_, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), r)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(md5Hash.Sum(nil)), hex.EncodeToString(sha256Hash.Sum(nil)), nil
+}
+
+// extractMetadata finds and parses the core metadata of a distribution file
+// of size bytes, METADATA for wheels and PKG-INFO for source distributions
+// and eggs. Only the parts of the file needed are read.
+func extractMetadata(fileName string, file io.ReaderAt, size int64) (coreMetadata, error) {
+	r := io.NewSectionReader(file, 0, size)
+	switch {
+	case strings.HasSuffix(fileName, ".whl"), strings.HasSuffix(fileName, ".egg"), strings.HasSuffix(fileName, ".zip"):
+		return zipMetadata(file, size)
+	case strings.HasSuffix(fileName, ".tar.gz"), strings.HasSuffix(fileName, ".tgz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return tarMetadata(gz)
+	case strings.HasSuffix(fileName, ".tar.bz2"), strings.HasSuffix(fileName, ".tbz"):
+		return tarMetadata(bzip2.NewReader(r))
+	case strings.HasSuffix(fileName, ".tar"):
+		return tarMetadata(r)
+	}
+	return nil, errNoMetadata
+}
+
+// isMetadataFile reports whether name is a metadata file and how deep it is
+// in the archive, the shallowest one belongs to the distribution itself
+func isMetadataFile(name string) (bool, int) {
+	name = strings.TrimPrefix(name, "./")
+	base := path.Base(name)
+	dir := path.Dir(name)
+	depth := strings.Count(name, "/")
+	switch {
+	case base == "METADATA" && strings.HasSuffix(dir, ".dist-info"):
+		return true, depth
+	case base == "PKG-INFO" && (dir == "EGG-INFO" || depth <= 1):
+		return true, depth
+	}
+	return false, 0
+}
+
+func zipMetadata(file io.ReaderAt, size int64) (coreMetadata, error) {
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, err
+	}
+	var found *zip.File
+	foundDepth := 0
+	for _, f := range zr.File {
+		if ok, depth := isMetadataFile(f.Name); ok && (found == nil || depth < foundDepth) {
+			found, foundDepth = f, depth
+		}
+	}
+	if found == nil {
+		return nil, errNoMetadata
+	}
+	rc, err := found.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return parseMetadata(rc)
+}
+
+func tarMetadata(r io.Reader) (coreMetadata, error) {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, errNoMetadata
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ok, depth := isMetadataFile(h.Name); ok && depth <= 1 && h.Typeflag == tar.TypeReg {
+			return parseMetadata(tr)
+		}
+	}
+}
+
+// parseMetadata parses the RFC 822 style core metadata format. Continuation
+// lines are joined with newlines and a message body, used by metadata 2.1
+// and newer, is the description.
+func parseMetadata(r io.Reader) (coreMetadata, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	md := make(coreMetadata)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	var field string
+	var body []string
+	inBody := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case inBody:
+			body = append(body, line)
+		case line == "":
+			inBody = true
+		case (line[0] == ' ' || line[0] == '\t') && field != "":
+			// Continuation of the previous field, setuptools indents descriptions with 8 spaces or "       |"
+			line = strings.TrimPrefix(line, "        ")
+			line = strings.TrimPrefix(line, "       |")
+			values := md[field]
+			values[len(values)-1] += "\n" + line
+		default:
+			i := strings.Index(line, ":")
+			if i < 0 {
+				continue
+			}
+			field = strings.TrimSpace(line[:i])
+			md[field] = append(md[field], strings.TrimSpace(line[i+1:]))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if description := strings.TrimSpace(strings.Join(body, "\n")); description != "" {
+		md["Description"] = []string{description}
+	}
+	return md, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus metrics of a server
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	uploadSize      prometheus.Histogram
+	uploadFailures  *prometheus.CounterVec
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+	journalFailures prometheus.Counter
+	journalBacklog  prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopi_http_requests_total",
+			Help: "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gopi_http_request_duration_seconds",
+			Help:    "HTTP request latency by route and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		uploadSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gopi_upload_size_bytes",
+			Help:    "Size of uploaded distribution files.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		}),
+		uploadFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopi_upload_failures_total",
+			Help: "Failed uploads by kind of error.",
+		}, []string{"kind"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gopi_storage_operation_duration_seconds",
+			Help:    "Latency of storage backend calls by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopi_storage_errors_total",
+			Help: "Failed storage backend calls by operation and kind of error.",
+		}, []string{"operation", "kind"}),
+		journalFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gopi_journal_write_failures_total",
+			Help: "Failed attempts to write changes to the journal.",
+		}),
+		journalBacklog: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gopi_journal_unrecorded_changes",
+			Help: "Changes waiting to be written to the journal after failing.",
+		}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.uploadSize,
+		m.uploadFailures,
+		m.storageDuration,
+		m.storageErrors,
+		m.journalFailures,
+		m.journalBacklog,
+	)
+	return m
+}
+
+// registerIndexMetrics exposes the size of the index and when it was last reloaded
+func (m *metrics) registerIndexMetrics(s *server) {
+	count := func(f func(projectSummary) int) func() float64 {
+		return func() float64 {
+			n := 0
+			for _, p := range s.index.projectList() {
+				n += f(p)
+			}
+			return float64(n)
+		}
+	}
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gopi_index_projects",
+			Help: "Projects in the package index.",
+		}, count(func(projectSummary) int { return 1 })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gopi_index_releases",
+			Help: "Releases in the package index.",
+		}, count(func(p projectSummary) int { return p.Releases })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gopi_index_files",
+			Help: "Distribution files in the package index.",
+		}, count(func(p projectSummary) int { return p.Files })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gopi_index_last_serial",
+			Help: "Serial of the latest change in the journal.",
+		}, func() float64 { return float64(s.changelog.lastSerial()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gopi_index_last_reload_timestamp_seconds",
+			Help: "When the index was last loaded from the bucket.",
+		}, func() float64 {
+			s.refresh.mu.RLock()
+			defer s.refresh.mu.RUnlock()
+			if s.refresh.lastReload.IsZero() {
+				return 0
+			}
+			return float64(s.refresh.lastReload.Unix())
+		}),
+	)
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeStorage records the latency and outcome of a storage backend call that started at start
+func (m *metrics) observeStorage(operation string, start time.Time, err error) {
+	m.storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.storageErrors.WithLabelValues(operation, errorKind(err)).Inc()
+	}
+}
+
+// uploadFailed counts a failed upload by the kind of err
+func (m *metrics) uploadFailed(err error) {
+	m.uploadFailures.WithLabelValues(errorKind(err)).Inc()
+}
+
+// errorKind names the PkgError or S3Error in err, "TooLarge" for uploads over
+// the size limit or "Other" for any other error
+func errorKind(err error) string {
+	var pkgErr PkgError
+	if errors.As(err, &pkgErr) {
+		return pkgErr.Error()
+	}
+	var s3Err S3Error
+	if errors.As(err, &s3Err) {
+		return s3Err.Error()
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return "TooLarge"
+	}
+	return "Other"
+}
+
+// statusRecorder remembers the status code and body size written to a ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter to
+// flush or set deadlines
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// instrument counts requests to h and their latency under the given route name and traces them
+func (s *server) instrument(route string, h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r, span := traceRequest(r, route)
+		h.ServeHTTP(sr, r)
+		endRequestSpan(span, sr.status)
+		s.metrics.requests.WithLabelValues(route, r.Method, strconv.Itoa(sr.status)).Inc()
+		s.metrics.requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: AlreadyExists, want: "AlreadyExists"},
+		{err: fmt.Errorf("Failed to upload, %w", NotAllowed), want: "NotAllowed"},
+		{err: NoSuchKey, want: "NoSuchKey"},
+		{err: fmt.Errorf("Failed to read, %w", AccessDenied), want: "AccessDenied"},
+		{err: fmt.Errorf("Failed to read body, %w", &http.MaxBytesError{Limit: 10}), want: "TooLarge"},
+		{err: errors.New("connection reset"), want: "Other"},
+	}
+	for _, tt := range tests {
+		if got := errorKind(tt.err); got != tt.want {
+			t.Errorf("errorKind(%v) is %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		wantCode string
+	}{
+		{
+			name:     "status written by the handler",
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) },
+			wantCode: "201",
+		},
+		{
+			name:     "implicit 200",
+			handler:  func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") },
+			wantCode: "200",
+		},
+		{
+			name: "flushing through http.ResponseController",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if err := http.NewResponseController(w).Flush(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+			},
+			wantCode: "200",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := strings.ReplaceAll(tt.name, " ", "_")
+			w := httptest.NewRecorder()
+			s.instrument(route, tt.handler).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+			if got := testutil.ToFloat64(s.metrics.requests.WithLabelValues(route, http.MethodPost, tt.wantCode)); got != 1 {
+				t.Errorf("%s requests with code %s are %v, want 1, response %d %q", route, tt.wantCode, got, w.Code, w.Body.String())
+			}
+			if got := testutil.CollectAndCount(s.metrics.requestDuration, "gopi_http_request_duration_seconds"); got == 0 {
+				t.Error("no request latency was observed")
+			}
+		})
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{})
+	if err := s.addPackage(context.Background(), testPkg("demo-1.0.tar.gz", "1.0", "")); err != nil {
+		t.Fatalf("Failed to add package, %s", err)
+	}
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/simple/", nil))
+	f.denyGet = func(key string) bool { return key == projectIndexKey("demo") }
+	s.index.invalidate("demo")
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/simple/demo/", nil))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics returned %d", w.Code)
+	}
+	for _, want := range []string{
+		`gopi_http_requests_total{code="200",method="GET",route="simple"} 1`,
+		`gopi_http_requests_total{code="500",method="GET",route="simple"} 1`,
+		`gopi_storage_errors_total{kind="AccessDenied",operation="get"} 1`,
+		"gopi_index_projects 1",
+		"gopi_index_releases 1",
+		"gopi_index_files 1",
+		"go_goroutines",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("/metrics doesn't contain %q", want)
+		}
+	}
+}
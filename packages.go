@@ -1,16 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/url"
 	"regexp"
 	"sort"
 	"strings"
-
-	"github.com/Masterminds/semver"
-	"github.com/minio/minio-go"
-	"github.com/minio/minio/pkg/console"
+	"time"
 )
 
 var (
@@ -24,6 +24,13 @@ var (
 	excludedExtensions = ".pdf"
 )
 
+var (
+	// removedFilesPrefix holds the names of the deleted files of every project, one object per project
+	removedFilesPrefix = internalPrefix + "removed/"
+)
+
+// pkg is a distribution file with the metadata of its release, as uploaded
+// and as listed by the simple index
 type pkg struct {
 	Name     string `json:"name"`
 	FileName string `json:"filename"`
@@ -31,7 +38,31 @@ type pkg struct {
 	PyVer    string `json:"pyver"`
 	URL      string `json:"url"`
 	MD5      string `json:"md5_digest"`
-	Summary  string `json:"summary"`
+	SHA256   string `json:"sha256_digest,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	releaseMetadata
+	// UploadTime is when the file was uploaded, zero for files indexed
+	// before it was recorded
+	UploadTime time.Time `json:"upload_time"`
+	// Uploader is the identity that uploaded the file, if known
+	Uploader string `json:"uploader,omitempty"`
+	// Yanked versions are hidden from installers unless pinned, PEP 592
+	Yanked       bool   `json:"yanked,omitempty"`
+	YankedReason string `json:"yanked_reason,omitempty"`
+}
+
+// distFile returns the file without the metadata of its release
+func (p pkg) distFile() distFile {
+	return distFile{
+		FileName:   p.FileName,
+		PyVer:      p.PyVer,
+		URL:        p.URL,
+		MD5:        p.MD5,
+		SHA256:     p.SHA256,
+		Size:       p.Size,
+		UploadTime: p.UploadTime,
+		Uploader:   p.Uploader,
+	}
 }
 
 type pkgs []pkg
@@ -50,6 +81,12 @@ const (
 
 	// InvalidFormat means that the package the user is attempting to upload is incorrectly formatted
 	InvalidFormat
+
+	// NotAllowed means that the user may not change the package
+	NotAllowed
+
+	// FileNameReused means that a file of the same name was deleted, file names can't be reused
+	FileNameReused
 )
 
 func (e PkgError) Error() string {
@@ -58,67 +95,65 @@ func (e PkgError) Error() string {
 		return "AlreadyExists"
 	case 2:
 		return "InvalidFormat"
+	case 3:
+		return "NotAllowed"
+	case 4:
+		return "FileNameReused"
 	default:
 		return "UnknownError"
 	}
 }
 
-func (ps packageMap) GetLatestVersionString(pkgName string) string {
-	var rawVersions []string
-	for _, v := range ps[pkgName] {
-		rawVersions = append(rawVersions, v.Version)
-	}
-	if len(rawVersions) == 0 {
-		return ""
-	}
-	if len(rawVersions) == 1 {
-		return rawVersions[0]
+// sortedNames returns the names of all packages in alphabetical order
+func (ps packageMap) sortedNames() []string {
+	names := make([]string, 0, len(ps))
+	for name := range ps {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	vs := make([]*semver.Version, len(rawVersions))
-	for i, r := range rawVersions {
-		v, err := semver.NewVersion(r)
-		if err != nil {
-			console.Errorf("Error parsing version: %s", err)
+// GetLatestVersionPackage returns the file of the newest version in PEP 440
+// order. Yanked versions are only picked if every version has been yanked.
+func (ps pkgs) GetLatestVersionPackage() pkg {
+	var latest pkg
+	found := false
+	for _, p := range ps {
+		switch {
+		case !found:
+		case p.Yanked != latest.Yanked:
+			if p.Yanked {
+				continue
+			}
+		case compareVersions(p.Version, latest.Version) <= 0:
 			continue
 		}
-		vs[i] = v
-	}
-	sort.Sort(sort.Reverse(semver.Collection(vs)))
-	if vs[0] != nil {
-		return vs[0].Original()
+		latest, found = p, true
 	}
-	return ""
+	return latest
 }
 
-func (ps pkgs) GetLatestVersionPackage() pkg {
-	versionMap := make(map[string]pkg)
-	var rawVersions []string
-	for _, p := range ps {
-		versionMap[p.Version] = p
-		rawVersions = append(rawVersions, p.Version)
-	}
-	if len(rawVersions) == 0 {
-		return pkg{}
-	}
-	if len(rawVersions) == 1 {
-		return versionMap[rawVersions[0]]
-	}
+// sorted returns the files ordered by version, oldest first, and then by file name
+func (ps pkgs) sorted() pkgs {
+	sorted := append(pkgs(nil), ps...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if c := compareVersions(sorted[i].Version, sorted[j].Version); c != 0 {
+			return c < 0
+		}
+		return sorted[i].FileName < sorted[j].FileName
+	})
+	return sorted
+}
 
-	vs := make([]*semver.Version, len(rawVersions))
-	for i, r := range rawVersions {
-		v, err := semver.NewVersion(r)
-		if err != nil {
-			console.Errorf("Error parsing package version: %s", err)
-			continue
+// byFileName returns the file called fileName
+func (ps pkgs) byFileName(fileName string) (pkg, bool) {
+	for _, p := range ps {
+		if p.FileName == fileName {
+			return p, true
 		}
-		vs[i] = v
-	}
-	sort.Sort(sort.Reverse(semver.Collection(vs)))
-	if vs[0] != nil {
-		return versionMap[vs[0].Original()]
 	}
-	return pkg{}
+	return pkg{}, false
 }
 
 func (ps pkgs) GetPackageByVersion(version string) pkg {
@@ -130,94 +165,295 @@ func (ps pkgs) GetPackageByVersion(version string) pkg {
 	return pkg{}
 }
 
-func (s *server) removePackage(name, version string) error {
-	for i, pkg := range s.packages[name] {
-		if pkg.Name == name && pkg.Version == version {
-			s.packages[name] = append(s.packages[name][0:i], s.packages[name][i+1:]...)
+// deleteRelease removes a version from the index and deletes its files from
+// the bucket. Their names are recorded so they can't be uploaded again.
+func (s *server) deleteRelease(ctx context.Context, name, version string) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	// Read under the lock so files published to the release since are deleted too
+	current, err := s.readProject(ctx, name)
+	if err != nil {
+		return err
+	}
+	r := current.findRelease(version)
+	if r == nil {
+		return NoSuchKey
+	}
+	files := r.Files
+	var fileNames []string
+	for _, f := range files {
+		fileNames = append(fileNames, f.FileName)
+	}
+	// The names are recorded first so they can't be reused even if
+	// removing the release fails halfway
+	err = s.recordRemovedFiles(ctx, name, fileNames...)
+	if err != nil {
+		return fmt.Errorf("Failed to record deleted files, %s", err.Error())
+	}
+	remaining := []release{}
+	for _, r := range current.Releases {
+		if r.Version != version {
+			remaining = append(remaining, r)
+		}
+	}
+	current.Releases = remaining
+	err = s.writeProject(ctx, name, current)
+	if err != nil {
+		return err
+	}
+	s.search.remove(name, version)
+	s.logChange(ctx, name, version, actionRemoveRelease)
+	for _, f := range files {
+		err = s.removeObject(ctx, strings.TrimPrefix(f.URL, "/"))
+		if err != nil && !errors.Is(err, NoSuchKey) {
+			return fmt.Errorf("Failed to delete %s, %s", f.FileName, err.Error())
 		}
+		s.logChange(ctx, name, version, fmt.Sprintf(actionRemoveFile, f.FileName))
+	}
+	return nil
+}
+
+// setYanked yanks or unyanks a release, PEP 592
+func (s *server) setYanked(ctx context.Context, name, version string, yanked bool, reason string) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	current, err := s.readProject(ctx, name)
+	if err != nil {
+		return err
+	}
+	r := current.findRelease(version)
+	if r == nil {
+		return NoSuchKey
+	}
+	r.Yanked = yanked
+	r.YankedReason = ""
+	if yanked {
+		r.YankedReason = reason
+	}
+	err = s.writeProject(ctx, name, current)
+	if err != nil {
+		return err
 	}
-	return s.writePackagesJSON()
+	s.search.add(r.pkg(name))
+	action := actionYankRelease
+	if !yanked {
+		action = actionUnyankRelease
+	}
+	s.logChange(ctx, name, version, action)
+	return nil
 }
 
-func (s *server) addPackage(p pkg) error {
-	// Let's make sure we refresh our in-memory package list first
-	// so we don't upload a package twice in-case the package.json
-	// has been manually edited
+// reservePackage takes the name of an uploaded file before its object is
+// stored, so concurrent uploads of the same file name are rejected before
+// either of them writes the object. The file isn't published until
+// publishPackage. A release can have any number of files but file names
+// are unique, unless overwriting is allowed an existing or deleted file
+// can't be uploaded again.
+func (s *server) reservePackage(ctx context.Context, p pkg) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
 
-	err := s.readPackagesJSON()
+	// Let's make sure we read the latest version of the project from the
+	// bucket first so we don't upload a package twice in-case another
+	// gopi or someone editing the index has changed it
+	current, err := s.readProject(ctx, p.Name)
 	if err != nil {
 		return err
 	}
-	if _, exists := s.packages[p.Name]; !exists {
-		s.packages[p.Name] = []pkg{}
+	if pending, ok := current.findPending(p.FileName); ok && !pending.stale(time.Now()) {
+		return AlreadyExists
 	}
-	// Check if the version we're adding already exists
-	for _, pkg := range s.packages[p.Name] {
-		if pkg.Version == p.Version {
-			return AlreadyExists
+	_, exists := current.files().byFileName(p.FileName)
+	switch {
+	case exists && !s.cfg.allowOverwrite:
+		return AlreadyExists
+	case !exists && !s.cfg.allowOverwrite:
+		err = s.checkFileNameUnused(ctx, p)
+		if err != nil {
+			return err
 		}
 	}
-	s.packages[p.Name] = append(s.packages[p.Name], p)
-	// Todo(LeoS): Make sure we don't add the package if the writePackageJSON function doesn't succeed.
-	return s.writePackagesJSON()
+	current.removePending(p.FileName)
+	current.Pending = append(current.Pending, p)
+	return s.writeProject(ctx, p.Name, current)
 }
 
-func (s *server) writePackagesJSON() error {
-	packageMapJSON, err := json.Marshal(s.packages)
+// publishPackage adds a file reserved by reservePackage to its release once
+// its object has been stored. A release keeps the metadata of its first
+// upload, an overwritten file replaces it.
+func (s *server) publishPackage(ctx context.Context, p pkg) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	current, err := s.readProject(ctx, p.Name)
 	if err != nil {
 		return err
 	}
-	r := bytes.NewReader(packageMapJSON)
-	_, err = s.s3.PutObject(s.s3cfg.bucket, packageListFile, r, -1, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	current.removePending(p.FileName)
+	newRelease := current.findRelease(p.Version) == nil
+	_, replaced := current.remove(p.FileName)
+	if replaced && !p.releaseMetadata.empty() {
+		if r := current.findRelease(p.Version); r != nil {
+			r.releaseMetadata = p.releaseMetadata
+		}
+	}
+	current.add(p)
+	err = s.writeProject(ctx, p.Name, current)
 	if err != nil {
 		return err
 	}
+	s.search.add(current.findRelease(p.Version).pkg(p.Name))
+	if replaced {
+		s.logChange(ctx, p.Name, p.Version, fmt.Sprintf(actionReplaceFile, p.FileName))
+		return nil
+	}
+	action := actionAddFile
+	if newRelease {
+		action = actionNewReleaseFile
+	}
+	s.logChange(ctx, p.Name, p.Version, fmt.Sprintf(action, p.FileName))
 	return nil
 }
 
-func (s *server) readPackagesJSON() error {
-	_, err := s.s3.StatObject(s.s3cfg.bucket, packageListFile, minio.StatObjectOptions{})
+// cancelReservation frees the name of a file reserved by reservePackage
+// whose object couldn't be stored, so uploading it again isn't rejected
+func (s *server) cancelReservation(ctx context.Context, p pkg) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	current, err := s.readProject(ctx, p.Name)
+	if err != nil {
+		return err
+	}
+	if _, ok := current.findPending(p.FileName); !ok {
+		return nil
+	}
+	current.removePending(p.FileName)
+	return s.writeProject(ctx, p.Name, current)
+}
+
+// withdrawPackage takes a published file out of the index again and deletes
+// its object, for an upload that turned out not to be allowed. Unlike
+// deleteRelease the file name isn't recorded as removed, it can be uploaded
+// by someone who may.
+func (s *server) withdrawPackage(ctx context.Context, p pkg) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	current, err := s.readProject(ctx, p.Name)
+	if err != nil {
+		return err
+	}
+	if _, ok := current.remove(p.FileName); !ok {
+		return nil
+	}
+	err = s.writeProject(ctx, p.Name, current)
 	if err != nil {
-		errResponse := minio.ToErrorResponse(err)
-		if errResponse.Code == "AccessDenied" {
-			return AccessDenied
-		}
-		if errResponse.Code == "NoSuchBucket" {
-			return NoSuchBucket
-		}
-		if errResponse.Code == "InvalidBucketName" {
-			return InvalidBucketName
-		}
-		if errResponse.Code == "NoSuchKey" {
-			return NoSuchKey
-		}
 		return err
 	}
-	o, err := s.s3.GetObject(s.s3cfg.bucket, packageListFile, minio.GetObjectOptions{})
+	s.search.resetProject(p.Name, current)
+	s.logChange(ctx, p.Name, p.Version, fmt.Sprintf(actionRemoveFile, p.FileName))
+	err = s.removeObject(ctx, strings.TrimPrefix(p.URL, "/"))
+	if err != nil && !errors.Is(err, NoSuchKey) {
+		return fmt.Errorf("Failed to delete %s, %s", p.FileName, err.Error())
+	}
+	return nil
+}
+
+// addPackage indexes a file whose object is already in the bucket, see
+// reservePackage for when it's rejected
+func (s *server) addPackage(ctx context.Context, p pkg) error {
+	err := s.reservePackage(ctx, p)
 	if err != nil {
 		return err
 	}
-	packageMap := &packageMap{}
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(o)
-	err = json.Unmarshal(buf.Bytes(), packageMap)
+	return s.publishPackage(ctx, p)
+}
+
+// checkFileNameUnused returns FileNameReused if a file called p.FileName was
+// deleted and AlreadyExists if its object is in the bucket without being in
+// the index
+func (s *server) checkFileNameUnused(ctx context.Context, p pkg) error {
+	removed, err := s.readRemovedFiles(ctx, p.Name)
 	if err != nil {
 		return err
 	}
-	s.packages = *packageMap
+	for _, fileName := range removed {
+		if fileName == p.FileName {
+			return FileNameReused
+		}
+	}
+	exists, err := s.objectExists(ctx, strings.TrimPrefix(p.URL, "/"))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return AlreadyExists
+	}
 	return nil
 }
 
-// newPkg takes Filename, version from POST form and S3 location and returns a "pkg" struct
-func newPkg(fileName, version, summary, md5, location string) pkg {
+func removedFilesKey(name string) string {
+	return removedFilesPrefix + name + ".json"
+}
+
+// readRemovedFiles returns the names of the deleted files of a project
+func (s *server) readRemovedFiles(ctx context.Context, name string) ([]string, error) {
+	var removed []string
+	data, err := s.getObject(ctx, removedFilesKey(name))
+	if errors.Is(err, NoSuchKey) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &removed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, %s", removedFilesKey(name), err.Error())
+	}
+	return removed, nil
+}
+
+// recordRemovedFiles remembers the names of deleted files so they can't be
+// uploaded again. Names recorded by other replicas meanwhile are kept.
+func (s *server) recordRemovedFiles(ctx context.Context, name string, fileNames ...string) error {
+	return s.updateObject(ctx, removedFilesKey(name), "application/json", func(data []byte) ([]byte, error) {
+		var removed []string
+		if data != nil {
+			err := json.Unmarshal(data, &removed)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse %s, %s", removedFilesKey(name), err.Error())
+			}
+		}
+		removed = append(removed, fileNames...)
+		sort.Strings(removed)
+		return json.Marshal(removed)
+	})
+}
+
+// newPkg takes Filename, the metadata from the POST form and S3 location and returns a "pkg" struct
+func newPkg(fileName, location string, form url.Values) pkg {
 	pkg := parseFilename(fileName)
 	pkg.FileName = fileName
 	pkg.URL = fmt.Sprintf("/%s", location)
-	pkg.Summary = summary
-	pkg.MD5 = md5
+	pkg.Summary = form.Get("summary")
+	pkg.Description = form.Get("description")
+	pkg.Author = form.Get("author")
+	pkg.Keywords = form.Get("keywords")
+	pkg.Classifiers = form["classifiers"]
+	pkg.DescriptionContentType = form.Get("description_content_type")
+	pkg.License = form.Get("license")
+	pkg.HomePage = form.Get("home_page")
+	pkg.ProjectURLs = form["project_urls"]
+	pkg.RequiresPython = form.Get("requires_python")
+	pkg.RequiresDist = form["requires_dist"]
+	pkg.MD5 = form.Get("md5_digest")
+	pkg.SHA256 = form.Get("sha256_digest")
+	version := form.Get("version")
 	if pkg.Version != version {
-		console.Infoln("Uploaded package filename and POST form have different versions. Using form value")
-		console.Debugf("Form Version: %s\tFile Version: %s\n", version, pkg.Version)
+		slog.Info("Uploaded package filename and POST form have different versions, using form value", "form_version", version, "file_version", pkg.Version)
 		pkg.Version = version
 	}
 	return pkg
@@ -245,7 +481,10 @@ func parseFilename(fileName string) pkg {
 				trimmed = trimmed[:pyVerStart]
 			}
 			// Grab the rest of the info by looking for the package version and assuming the rest is the name
-			pkgVer := pkgNameVersion.FindStringSubmatch(trimmed)
+			pkgVer := pkgNameVersion.FindStringSubmatch(strings.ToLower(trimmed))
+			if pkgVer == nil {
+				continue
+			}
 
 			p.Name = normalisePackageName(pkgVer[1])
 			p.Version = pkgVer[3]
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddPackage(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowOverwrite bool
+		existing       []pkg
+		// removed files were deleted, stray files are in the bucket without being indexed
+		removed []string
+		stray   []string
+		upload  pkg
+		wantErr error
+		// wantFiles are the file names of the release of upload afterwards
+		wantFiles   []string
+		wantSummary string
+	}{
+		{
+			name:        "new release",
+			upload:      testPkg("demo-1.0.tar.gz", "1.0", "first"),
+			wantFiles:   []string{"demo-1.0.tar.gz"},
+			wantSummary: "first",
+		},
+		{
+			name:        "another file of a release keeps its metadata",
+			existing:    []pkg{testPkg("demo-1.0.tar.gz", "1.0", "first")},
+			upload:      testPkg("demo-1.0-py3-none-any.whl", "1.0", "second"),
+			wantFiles:   []string{"demo-1.0-py3-none-any.whl", "demo-1.0.tar.gz"},
+			wantSummary: "first",
+		},
+		{
+			name:        "a file fills in a release without metadata",
+			existing:    []pkg{testPkg("demo-1.0.tar.gz", "1.0", "")},
+			upload:      testPkg("demo-1.0-py3-none-any.whl", "1.0", "second"),
+			wantFiles:   []string{"demo-1.0-py3-none-any.whl", "demo-1.0.tar.gz"},
+			wantSummary: "second",
+		},
+		{
+			name:        "existing file name",
+			existing:    []pkg{testPkg("demo-1.0.tar.gz", "1.0", "first")},
+			upload:      testPkg("demo-1.0.tar.gz", "1.0", "again"),
+			wantErr:     AlreadyExists,
+			wantFiles:   []string{"demo-1.0.tar.gz"},
+			wantSummary: "first",
+		},
+		{
+			name:           "existing file name with overwrite",
+			allowOverwrite: true,
+			existing:       []pkg{testPkg("demo-1.0.tar.gz", "1.0", "first")},
+			upload:         testPkg("demo-1.0.tar.gz", "1.0", "again"),
+			wantFiles:      []string{"demo-1.0.tar.gz"},
+			wantSummary:    "again",
+		},
+		{
+			name:    "deleted file name",
+			removed: []string{"demo-1.0.tar.gz"},
+			upload:  testPkg("demo-1.0.tar.gz", "1.0", "first"),
+			wantErr: FileNameReused,
+		},
+		{
+			name:           "deleted file name with overwrite",
+			allowOverwrite: true,
+			removed:        []string{"demo-1.0.tar.gz"},
+			upload:         testPkg("demo-1.0.tar.gz", "1.0", "first"),
+			wantFiles:      []string{"demo-1.0.tar.gz"},
+			wantSummary:    "first",
+		},
+		{
+			name:    "file in the bucket but not in the index",
+			stray:   []string{"demo/demo-1.0.tar.gz"},
+			upload:  testPkg("demo-1.0.tar.gz", "1.0", "first"),
+			wantErr: AlreadyExists,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, f := newTestServer(t, serverConfig{allowOverwrite: tt.allowOverwrite})
+			ctx := context.Background()
+			for _, p := range tt.existing {
+				if err := s.addPackage(ctx, p); err != nil {
+					t.Fatalf("Failed to add %s, %s", p.FileName, err)
+				}
+			}
+			if len(tt.removed) > 0 {
+				if err := s.recordRemovedFiles(ctx, "demo", tt.removed...); err != nil {
+					t.Fatalf("Failed to record removed files, %s", err)
+				}
+			}
+			for _, key := range tt.stray {
+				f.put(key, []byte("stray"))
+			}
+
+			err := s.addPackage(ctx, tt.upload)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("addPackage() error = %v, want %v", err, tt.wantErr)
+			}
+			pr, err := s.readProject(ctx, "demo")
+			if err != nil {
+				t.Fatalf("Failed to read project, %s", err)
+			}
+			r := pr.findRelease(tt.upload.Version)
+			if r == nil {
+				if len(tt.wantFiles) > 0 {
+					t.Fatalf("Release %s is missing", tt.upload.Version)
+				}
+				return
+			}
+			var files []string
+			for _, f := range r.Files {
+				files = append(files, f.FileName)
+			}
+			if len(files) != len(tt.wantFiles) {
+				t.Fatalf("Release has files %v, want %v", files, tt.wantFiles)
+			}
+			for i := range files {
+				if files[i] != tt.wantFiles[i] {
+					t.Fatalf("Release has files %v, want %v", files, tt.wantFiles)
+				}
+			}
+			if r.Summary != tt.wantSummary {
+				t.Errorf("Release summary is %q, want %q", r.Summary, tt.wantSummary)
+			}
+		})
+	}
+}
+
+func TestStoreUploadPublishesAfterPut(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	p := testPkg("demo-1.0.tar.gz", "1.0", "first")
+
+	f.beforePut = func(key string) {
+		if key != "demo/demo-1.0.tar.gz" {
+			return
+		}
+		// While the object is being stored the file isn't published but its name is taken
+		if file, err := s.findFile(ctx, "demo", p.FileName); err != nil || file.FileName != "" {
+			t.Errorf("File %q is published before its object is stored, err %v", file.FileName, err)
+		}
+		if s.index.exists("demo") {
+			t.Errorf("Project is listed before its first file is stored")
+		}
+		if err := s.reservePackage(ctx, p); !errors.Is(err, AlreadyExists) {
+			t.Errorf("Concurrent upload of the same file returned %v, want %v", err, AlreadyExists)
+		}
+	}
+	err := s.storeUpload(ctx, p, strings.NewReader("data"), identity{})
+	if err != nil {
+		t.Fatalf("storeUpload() error = %s", err)
+	}
+	f.beforePut = nil
+	file, err := s.findFile(ctx, "demo", p.FileName)
+	if err != nil || file.FileName != p.FileName {
+		t.Fatalf("File isn't published after the upload, err %v", err)
+	}
+	pr, err := s.readProject(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read project, %s", err)
+	}
+	if len(pr.Pending) != 0 {
+		t.Errorf("Pending uploads are %+v after the upload, want none", pr.Pending)
+	}
+}
+
+func TestStoreUploadOverwriteKeepsOldFileUntilPut(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{allowOverwrite: true})
+	ctx := context.Background()
+	old := testPkg("demo-1.0.tar.gz", "1.0", "first")
+	old.MD5 = "old"
+	if err := s.storeUpload(ctx, old, strings.NewReader("old"), identity{}); err != nil {
+		t.Fatalf("storeUpload() error = %s", err)
+	}
+	replacement := testPkg("demo-1.0.tar.gz", "1.0", "second")
+	replacement.MD5 = "new"
+	f.beforePut = func(key string) {
+		if key != "demo/demo-1.0.tar.gz" {
+			return
+		}
+		if file, _ := s.findFile(ctx, "demo", old.FileName); file.MD5 != "old" {
+			t.Errorf("Index has MD5 %q while the new object is stored, want the old one", file.MD5)
+		}
+	}
+	if err := s.storeUpload(ctx, replacement, strings.NewReader("new"), identity{}); err != nil {
+		t.Fatalf("storeUpload() error = %s", err)
+	}
+	if file, _ := s.findFile(ctx, "demo", old.FileName); file.MD5 != "new" {
+		t.Errorf("Index has MD5 %q after the overwrite, want the new one", file.MD5)
+	}
+}
+
+func TestStoreUploadFreesNameWhenPutFails(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{})
+	f.denyPut = func(key string) bool { return key == "demo/demo-1.0.tar.gz" }
+	ctx := context.Background()
+	p := testPkg("demo-1.0.tar.gz", "1.0", "first")
+
+	err := s.storeUpload(ctx, p, strings.NewReader("data"), identity{})
+	if !errors.Is(err, AccessDenied) {
+		t.Fatalf("storeUpload() error = %v, want %v", err, AccessDenied)
+	}
+	pr, err := s.readProject(ctx, "demo")
+	if err != nil || len(pr.Pending) != 0 || len(pr.Releases) != 0 {
+		t.Fatalf("Project is %+v after the put failed, err %v, want it empty", pr, err)
+	}
+	f.denyPut = nil
+	err = s.storeUpload(ctx, p, strings.NewReader("data"), identity{})
+	if err != nil {
+		t.Fatalf("Uploading again after a failed put, %s", err)
+	}
+	if o, ok := f.get("demo/demo-1.0.tar.gz"); !ok || string(o.data) != "data" {
+		t.Fatalf("Object wasn't stored")
+	}
+}
+
+func TestReservePackageTakesOverStaleUpload(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	p := testPkg("demo-1.0.tar.gz", "1.0", "first")
+	p.UploadTime = time.Now().Add(-pendingUploadTimeout - time.Minute)
+	if err := s.reservePackage(ctx, p); err != nil {
+		t.Fatalf("reservePackage() error = %s", err)
+	}
+	p.UploadTime = time.Now()
+	if err := s.reservePackage(ctx, p); err != nil {
+		t.Fatalf("Reserving the name of an upload that never finished, %s", err)
+	}
+	pr, _ := s.readProject(ctx, "demo")
+	if len(pr.Pending) != 1 || !pr.Pending[0].UploadTime.Equal(p.UploadTime) {
+		t.Errorf("Pending uploads are %+v, want only the new one", pr.Pending)
+	}
+}
+
+func TestDeleteReleaseKeepsIndexWhenRecordingNamesFails(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	p := testPkg("demo-1.0.tar.gz", "1.0", "first")
+	if err := s.storeUpload(ctx, p, strings.NewReader("data"), identity{}); err != nil {
+		t.Fatalf("storeUpload() error = %s", err)
+	}
+	f.denyPut = func(key string) bool { return key == removedFilesKey("demo") }
+	if err := s.deleteRelease(ctx, "demo", "1.0"); err == nil {
+		t.Fatalf("deleteRelease() succeeded without recording the deleted names")
+	}
+	if file, _ := s.findFile(ctx, "demo", p.FileName); file.FileName == "" {
+		t.Errorf("Release was removed although its file names weren't recorded")
+	}
+	if _, ok := f.get("demo/demo-1.0.tar.gz"); !ok {
+		t.Errorf("Object was deleted although its name wasn't recorded")
+	}
+}
+
+func TestDeleteReleaseDeletesFilesPublishedByReplicas(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	replica := newReplica(t, f, serverConfig{})
+	storeTestPkg(t, s, testPkg("demo-1.0.tar.gz", "1.0", ""))
+	if _, err := s.project(ctx, "demo"); err != nil {
+		t.Fatalf("Failed to read project, %s", err)
+	}
+	// The replica adds a file to the release after the project was cached
+	storeTestPkg(t, replica, testPkg("demo-1.0-py3-none-any.whl", "1.0", ""))
+
+	if err := s.deleteRelease(ctx, "demo", "1.0"); err != nil {
+		t.Fatalf("Failed to delete release, %s", err)
+	}
+	for _, key := range []string{"demo/demo-1.0.tar.gz", "demo/demo-1.0-py3-none-any.whl"} {
+		if _, ok := f.get(key); ok {
+			t.Errorf("object %s of the deleted release is still in the bucket", key)
+		}
+	}
+	removed, err := s.readRemovedFiles(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read removed files, %s", err)
+	}
+	if want := []string{"demo-1.0-py3-none-any.whl", "demo-1.0.tar.gz"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed files are %v, want %v", removed, want)
+	}
+}
+
+func TestRecordRemovedFilesKeepsConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	replica := newReplica(t, f, serverConfig{})
+
+	// The replica records a name between the read and the write of the first server
+	f.beforePut = func(key string) {
+		if key != removedFilesKey("demo") {
+			return
+		}
+		f.beforePut = nil
+		if err := replica.recordRemovedFiles(ctx, "demo", "demo-0.9.tar.gz"); err != nil {
+			t.Errorf("Failed to record a removed file on the replica, %s", err)
+		}
+	}
+	if err := s.recordRemovedFiles(ctx, "demo", "demo-1.0.tar.gz"); err != nil {
+		t.Fatalf("Failed to record a removed file, %s", err)
+	}
+	removed, err := s.readRemovedFiles(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read removed files, %s", err)
+	}
+	if want := []string{"demo-0.9.tar.gz", "demo-1.0.tar.gz"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed files are %v, want %v", removed, want)
+	}
+}
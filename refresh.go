@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// refreshState tracks how up to date the in-memory index is compared to the bucket
+type refreshState struct {
+	mu sync.RWMutex
+	// etag and lastModified are those of the project list when it was last loaded
+	etag         string
+	lastModified time.Time
+	// lastCheck is when the bucket was last checked for changes successfully
+	lastCheck time.Time
+	// lastReload is when changes were last loaded from the bucket
+	lastReload time.Time
+	errors     int
+	// interval is how often the bucket is checked for changes, 0 if it isn't
+	interval time.Duration
+}
+
+// indexStatus describes the state of the in-memory index
+type indexStatus struct {
+	Projects         int       `json:"projects"`
+	LastSerial       int       `json:"last_serial"`
+	ETag             string    `json:"etag"`
+	LastModified     time.Time `json:"last_modified"`
+	LastCheck        time.Time `json:"last_check"`
+	LastReload       time.Time `json:"last_reload"`
+	StalenessSeconds float64   `json:"staleness_seconds"`
+	RefreshErrors    int       `json:"refresh_errors"`
+}
+
+func (s *server) indexStatus() indexStatus {
+	s.refresh.mu.RLock()
+	defer s.refresh.mu.RUnlock()
+	status := indexStatus{
+		Projects:      len(s.index.projectList()),
+		LastSerial:    s.changelog.lastSerial(),
+		ETag:          s.refresh.etag,
+		LastModified:  s.refresh.lastModified,
+		LastCheck:     s.refresh.lastCheck,
+		LastReload:    s.refresh.lastReload,
+		RefreshErrors: s.refresh.errors,
+	}
+	// Anything changed in the bucket since the last check could be missing
+	if !s.refresh.lastCheck.IsZero() {
+		status.StalenessSeconds = time.Since(s.refresh.lastCheck).Seconds()
+	}
+	return status
+}
+
+// watchIndex checks the bucket for index changes made by other gopi servers
+// every interval until ctx is done
+func (s *server) watchIndex(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.refreshIndex(ctx)
+			if err != nil {
+				logger(ctx).Error("Failed to refresh index", "err", err)
+			}
+		}
+	}
+}
+
+// refreshIndex reloads the project list if its ETag has changed, dropping
+// the cached copies of projects that have been updated since they were
+// loaded and reindexing them for search. New journal entries are loaded too.
+func (s *server) refreshIndex(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "index.refresh")
+	err := s.reloadChangedProjects(ctx)
+	endSpan(span, err)
+	s.refresh.mu.Lock()
+	defer s.refresh.mu.Unlock()
+	if err != nil {
+		s.refresh.errors++
+		return err
+	}
+	s.refresh.lastCheck = time.Now()
+	return nil
+}
+
+func (s *server) reloadChangedProjects(ctx context.Context) error {
+	// Hold the index lock so local uploads don't interleave with the reload
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	err := s.refreshJournal(ctx)
+	if err != nil {
+		return err
+	}
+
+	info, err := s.statObject(ctx, projectListFile)
+	if errors.Is(err, NoSuchKey) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.refresh.mu.RLock()
+	unchanged := info.ETag == s.refresh.etag
+	s.refresh.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	list, err := s.readProjectList(ctx)
+	if err != nil {
+		return err
+	}
+	old := s.index.projectList()
+	var changed []string
+	for name, p := range list {
+		if o, ok := old[name]; !ok || !o.Updated.Equal(p.Updated) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := list[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	s.index.setList(list)
+	for _, name := range changed {
+		s.index.invalidate(name)
+		ps, err := s.project(ctx, name)
+		if err != nil {
+			return err
+		}
+		s.search.resetProject(name, ps)
+	}
+	if len(changed) > 0 {
+		logger(ctx).Info("Reloaded changed projects from the bucket", "projects", len(changed))
+	}
+
+	s.refresh.mu.Lock()
+	s.refresh.etag = info.ETag
+	s.refresh.lastModified = info.LastModified
+	s.refresh.lastReload = time.Now()
+	s.refresh.mu.Unlock()
+	return nil
+}
+
+// refreshJournal loads the journal entries written by other gopi servers since the last known serial
+func (s *server) refreshJournal(ctx context.Context) error {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	return s.loadNewJournalEntries(ctx, s.changelog)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go"
+)
+
+// reindexOptions controls how the index is rebuilt
+type reindexOptions struct {
+	// extract downloads every distribution to re-read its metadata and hashes
+	extract bool
+	// dryRun reports what the new index would look like without writing it
+	dryRun bool
+}
+
+// reindexReport describes the index rebuilt from the objects in the bucket
+type reindexReport struct {
+	Projects int `json:"projects"`
+	Files    int `json:"files"`
+	// OrphanedObjects are objects in the bucket that aren't distribution files
+	OrphanedObjects []string `json:"orphaned_objects"`
+	// MissingFiles are entries of the old index without an object in the bucket
+	MissingFiles []string `json:"missing_files"`
+	// Errors are problems reading the old index or extracting metadata,
+	// none of them stop the reindex
+	Errors []string `json:"errors"`
+	DryRun bool     `json:"dry_run"`
+}
+
+func (r *reindexReport) errorf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	slog.Error(msg)
+	r.Errors = append(r.Errors, msg)
+}
+
+// reindex rebuilds the package index from the distribution files in the
+// bucket. Metadata of files that are already in the index is kept, new
+// files only get what can be parsed from their filename unless extract is set.
+// The bucket is scanned without holding the index lock so uploads carry on
+// meanwhile, the projects that changed during the scan are scanned again
+// under the lock before the new index replaces the old one.
+func (s *server) reindex(ctx context.Context, opts reindexOptions) (reindexReport, error) {
+	report := reindexReport{
+		OrphanedObjects: []string{},
+		MissingFiles:    []string{},
+		Errors:          []string{},
+		DryRun:          opts.dryRun,
+	}
+	// Read before listing the objects, so any change made after the objects
+	// were listed shows up as a changed project
+	oldList, err := s.readProjectList(ctx)
+	if err != nil && !errors.Is(err, NoSuchKey) {
+		report.errorf("Failed to read project list, %s", err.Error())
+	}
+	objects, err := s.listObjects(ctx, "")
+	if err != nil {
+		return report, err
+	}
+
+	// Read whatever is left of the old index, both from the project list and
+	// any project index documents that aren't in the list anymore
+	oldNames := make(map[string]struct{})
+	for name := range oldList {
+		oldNames[name] = struct{}{}
+	}
+	for _, name := range indexDocNames(objects) {
+		oldNames[name] = struct{}{}
+	}
+	old := make(projectMap)
+	oldFiles := make(map[string]pkg)
+	for name := range oldNames {
+		pr, err := s.readProject(ctx, name)
+		if err != nil {
+			report.errorf("Failed to read index of project %s, %s", name, err.Error())
+			continue
+		}
+		old[name] = pr
+		for _, p := range pr.files() {
+			oldFiles[p.URL] = p
+		}
+	}
+	fresh := s.indexObjects(ctx, objects, oldFiles, opts, &report)
+
+	if opts.dryRun {
+		report.finish(oldFiles, fresh)
+		return report, nil
+	}
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	err = s.rescanChanged(ctx, oldList, oldNames, old, oldFiles, fresh, opts, &report)
+	if err != nil {
+		return report, err
+	}
+	// Files being uploaded are published by their upload
+	for name, pr := range old {
+		if len(pr.Pending) > 0 && len(fresh[name]) > 0 {
+			files := pkgs{}
+			for _, p := range fresh[name] {
+				if _, ok := pr.findPending(p.FileName); !ok {
+					files = append(files, p)
+				}
+			}
+			fresh[name] = files
+		}
+	}
+	report.finish(oldFiles, fresh)
+
+	// Other gopi servers keep uploading, the documents and the project list
+	// are only written if they haven't changed since they were read. Files
+	// published since the reindex read a project are kept.
+	projects := make(projectMap)
+	now := time.Now().UTC()
+	for name := range old {
+		if _, ok := fresh[name]; !ok {
+			fresh[name] = pkgs{}
+		}
+	}
+	for _, name := range fresh.sortedNames() {
+		read := old[name].files()
+		pr, err := s.updateProject(ctx, name, func(current project) project {
+			// Projects that lost all their files keep an empty index document
+			pr := newProject(name, fresh[name])
+			pr.Pending = current.Pending
+			for _, p := range current.files() {
+				_, known := read.byFileName(p.FileName)
+				_, found := pr.files().byFileName(p.FileName)
+				if !known && !found {
+					pr.add(p)
+				}
+			}
+			return pr
+		})
+		if err != nil {
+			return report, fmt.Errorf("Failed to write index for project %s, %s", name, err.Error())
+		}
+		projects[name] = pr
+	}
+	list, err := s.updateProjectList(ctx, func(list projectList) {
+		for name, pr := range projects {
+			if len(pr.Releases) == 0 {
+				delete(list, name)
+				continue
+			}
+			list[name] = newProjectSummary(pr, now)
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+	for name, pr := range projects {
+		if len(pr.Releases) == 0 {
+			delete(projects, name)
+		}
+	}
+	s.index.reset(list, projects)
+	s.search.reset(projects)
+
+	// Let mirrors know which projects to sync again
+	for name := range oldNames {
+		if !sameFiles(old[name].files(), fresh[name]) {
+			s.logChange(ctx, name, "", actionReindex)
+		}
+	}
+	for name := range fresh {
+		if _, ok := oldNames[name]; !ok {
+			s.logChange(ctx, name, "", actionReindex)
+		}
+	}
+	return report, nil
+}
+
+// indexObjects returns the distribution files among objects by project.
+// Files in known keep their metadata, others get what can be parsed from
+// their filename or extracted from them if opts.extract is set.
+func (s *server) indexObjects(ctx context.Context, objects []minio.ObjectInfo, known map[string]pkg, opts reindexOptions, report *reindexReport) packageMap {
+	fresh := make(packageMap)
+	for _, o := range objects {
+		if isIndexObject(o.Key) {
+			continue
+		}
+		dir, fileName := path.Split(o.Key)
+		dir = strings.TrimSuffix(dir, pathSeparator)
+		p := parseFilename(fileName)
+		if dir == "" || strings.Contains(dir, pathSeparator) || p.Name == "" {
+			report.OrphanedObjects = append(report.OrphanedObjects, o.Key)
+			continue
+		}
+		url := "/" + o.Key
+		if existing, ok := known[url]; ok {
+			p = existing
+		} else {
+			p.FileName = fileName
+			p.URL = url
+		}
+		if p.UploadTime.IsZero() {
+			// Best guess for files indexed before upload times were recorded
+			p.UploadTime = o.LastModified.UTC()
+		}
+		// Files are stored under their normalised project name
+		name := normalisePackageName(dir)
+		p.Size = o.Size
+
+		if opts.extract {
+			s.extractFile(ctx, o, &p, report)
+		}
+		p.Name = name
+		fresh[name] = append(fresh[name], p)
+	}
+	return fresh
+}
+
+// extractFile sets the digests and metadata of p from its object o. The
+// object is streamed rather than held in memory and opened again to read the
+// metadata from the parts of the file holding it, a minio object that has
+// been read to the end can't be read at an offset.
+func (s *server) extractFile(ctx context.Context, o minio.ObjectInfo, p *pkg, report *reindexReport) {
+	md5Sum, sha256Sum, err := s.objectDigests(ctx, o.Key)
+	if err != nil {
+		report.errorf("Failed to download %s, %s", o.Key, err.Error())
+		return
+	}
+	p.MD5, p.SHA256 = md5Sum, sha256Sum
+	obj, err := s.openObject(ctx, o.Key)
+	if err != nil {
+		report.errorf("Failed to download %s, %s", o.Key, err.Error())
+		return
+	}
+	defer obj.Close()
+	md, err := extractMetadata(p.FileName, obj, o.Size)
+	if err != nil {
+		report.errorf("Failed to extract metadata from %s, %s", o.Key, err.Error())
+		return
+	}
+	md.apply(p)
+}
+
+// rescanChanged scans the projects that changed since scanned was read from
+// the bucket again, replacing their files in fresh and their old index in
+// old. Callers must hold s.indexMu so they can't change anymore.
+func (s *server) rescanChanged(ctx context.Context, scanned projectList, oldNames map[string]struct{}, old projectMap, oldFiles map[string]pkg, fresh packageMap, opts reindexOptions, report *reindexReport) error {
+	list, err := s.readProjectList(ctx)
+	if errors.Is(err, NoSuchKey) {
+		list, err = make(projectList), nil
+	}
+	if err != nil {
+		return err
+	}
+	var changed []string
+	for name, ps := range list {
+		if o, ok := scanned[name]; !ok || !o.Updated.Equal(ps.Updated) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range scanned {
+		if _, ok := list[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	for _, name := range changed {
+		pr, err := s.readProject(ctx, name)
+		if err != nil {
+			return fmt.Errorf("Failed to read index of project %s, %s", name, err.Error())
+		}
+		for _, p := range old[name].files() {
+			delete(oldFiles, p.URL)
+		}
+		known := make(map[string]pkg)
+		for _, p := range pr.files() {
+			known[p.URL] = p
+			oldFiles[p.URL] = p
+		}
+		objects, err := s.listObjects(ctx, name+pathSeparator)
+		if err != nil {
+			return err
+		}
+		oldNames[name] = struct{}{}
+		old[name] = pr
+		delete(fresh, name)
+		if files := s.indexObjects(ctx, objects, known, opts, report)[name]; len(files) > 0 {
+			fresh[name] = files
+		}
+	}
+	if len(changed) > 0 {
+		logger(ctx).Info("Scanned projects changed during the reindex again", "projects", len(changed))
+	}
+	return nil
+}
+
+// finish counts the files of the new index and lists the files of the old one that are missing from it
+func (r *reindexReport) finish(oldFiles map[string]pkg, fresh packageMap) {
+	found := make(map[string]struct{})
+	for _, files := range fresh {
+		for _, p := range files {
+			found[p.URL] = struct{}{}
+		}
+		r.Files += len(files)
+	}
+	r.Projects = len(fresh)
+	for url, p := range oldFiles {
+		if _, ok := found[url]; !ok {
+			r.MissingFiles = append(r.MissingFiles, fmt.Sprintf("%s %s %s", p.Name, p.Version, url))
+		}
+	}
+	sort.Strings(r.MissingFiles)
+	// Objects of rescanned projects are seen twice
+	sort.Strings(r.OrphanedObjects)
+	r.OrphanedObjects = slices.Compact(r.OrphanedObjects)
+}
+
+// reindexJob is the reindex started by POST /admin/reindex. It runs in the
+// background as it can take longer than the request timeouts.
+type reindexJob struct {
+	mu     sync.Mutex
+	status reindexStatus
+}
+
+// reindexStatus is the state of the last reindex started by POST /admin/reindex
+type reindexStatus struct {
+	Running  bool      `json:"running"`
+	Extract  bool      `json:"extract"`
+	DryRun   bool      `json:"dry_run"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Report is set once the reindex is done
+	Report *reindexReport `json:"report,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// startReindex starts a reindex in the background and returns its status,
+// or the status of the reindex that's already running and false
+func (s *server) startReindex(ctx context.Context, opts reindexOptions) (reindexStatus, bool) {
+	s.reindexJob.mu.Lock()
+	defer s.reindexJob.mu.Unlock()
+	if s.reindexJob.status.Running {
+		return s.reindexJob.status, false
+	}
+	s.reindexJob.status = reindexStatus{Running: true, Extract: opts.extract, DryRun: opts.dryRun, Started: time.Now().UTC()}
+	// Tracked like the background loops so shutdown waits for the index to be written
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		report, err := s.reindex(ctx, opts)
+		if err != nil {
+			logger(ctx).Error("Failed to reindex", "err", err)
+		} else {
+			report.print()
+		}
+		s.reindexJob.mu.Lock()
+		defer s.reindexJob.mu.Unlock()
+		s.reindexJob.status.Running = false
+		s.reindexJob.status.Finished = time.Now().UTC()
+		s.reindexJob.status.Report = &report
+		if err != nil {
+			s.reindexJob.status.Error = err.Error()
+		}
+	}()
+	return s.reindexJob.status, true
+}
+
+// reindexStatus returns the state of the last reindex started by POST /admin/reindex
+func (s *server) reindexStatus() reindexStatus {
+	s.reindexJob.mu.Lock()
+	defer s.reindexJob.mu.Unlock()
+	return s.reindexJob.status
+}
+
+// sameFiles reports whether both lists contain the same files
+func sameFiles(a, b pkgs) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	urls := make(map[string]struct{}, len(a))
+	for _, p := range a {
+		urls[p.URL] = struct{}{}
+	}
+	for _, p := range b {
+		if _, ok := urls[p.URL]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r reindexReport) print() {
+	for _, key := range r.OrphanedObjects {
+		slog.Info("Orphaned object", "key", key)
+	}
+	for _, f := range r.MissingFiles {
+		slog.Info("Index entry without file", "entry", f)
+	}
+	msg := "Reindexed"
+	if r.DryRun {
+		msg = "Reindex dry run"
+	}
+	slog.Info(msg, "files", r.Files, "projects", r.Projects, "orphaned_objects", len(r.OrphanedObjects),
+		"missing_files", len(r.MissingFiles), "errors", len(r.Errors))
+}
+
+// runReindex implements the "gopi reindex" command
+func runReindex(s3cfg s3Config, args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	extract := fs.Bool("extract", false, "Download every distribution to re-read its metadata and hashes")
+	dryRun := fs.Bool("dryRun", false, "Report what the new index would look like without writing it")
+	fs.Parse(args)
+
+	s, err := newStorageServer(s3cfg)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	err = s.loadJournal(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to load journal, %s", err.Error())
+	}
+	report, err := s.reindex(ctx, reindexOptions{extract: *extract, dryRun: *dryRun})
+	if err != nil {
+		return err
+	}
+	report.print()
+	return nil
+}
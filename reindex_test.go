@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// storeTestPkg uploads p with its file content
+func storeTestPkg(t *testing.T, s *server, p pkg) {
+	t.Helper()
+	if err := s.storeUpload(context.Background(), p, bytes.NewReader([]byte(p.FileName)), identity{}); err != nil {
+		t.Fatalf("Failed to upload %s, %s", p.FileName, err)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		ctx := context.Background()
+		s, f := newTestServer(t, serverConfig{})
+		storeTestPkg(t, s, testPkg("demo-1.0.tar.gz", "1.0", "indexed"))
+		// An index entry without its file, a file without its index entry and an object that isn't a distribution
+		if err := s.addPackage(ctx, testPkg("demo-0.9.tar.gz", "0.9", "")); err != nil {
+			t.Fatalf("Failed to add package, %s", err)
+		}
+		f.put("demo/demo-2.0.tar.gz", []byte("demo"))
+		f.put("notes.txt", []byte("notes"))
+
+		report, err := s.reindex(ctx, reindexOptions{dryRun: dryRun})
+		if err != nil {
+			t.Fatalf("Failed to reindex, %s", err)
+		}
+		want := reindexReport{
+			Projects:        1,
+			Files:           2,
+			OrphanedObjects: []string{"notes.txt"},
+			MissingFiles:    []string{"demo 0.9 /demo/demo-0.9.tar.gz"},
+			Errors:          []string{},
+			DryRun:          dryRun,
+		}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("report with dryRun %v is %+v, want %+v", dryRun, report, want)
+		}
+
+		pr, err := s.readProject(ctx, "demo")
+		if err != nil {
+			t.Fatalf("Failed to read project, %s", err)
+		}
+		var versions []string
+		for _, r := range pr.Releases {
+			versions = append(versions, r.Version)
+		}
+		wantVersions := []string{"2.0", "1.0"}
+		if dryRun {
+			wantVersions = []string{"1.0", "0.9"}
+		}
+		if !reflect.DeepEqual(versions, wantVersions) {
+			t.Errorf("versions after reindex with dryRun %v are %v, want %v", dryRun, versions, wantVersions)
+		}
+		if r := pr.findRelease("1.0"); r == nil || r.Summary != "indexed" {
+			t.Errorf("release 1.0 is %+v, want it to keep its metadata", r)
+		}
+	}
+}
+
+func TestReindexKeepsUploadsDuringScan(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	replica := newReplica(t, f, serverConfig{})
+	storeTestPkg(t, s, testPkg("demo-1.0.tar.gz", "1.0", "first"))
+
+	// The replica uploads once the reindex has listed the bucket
+	f.beforeList = func(prefix string) {
+		if prefix != "" {
+			return
+		}
+		f.beforeList = nil
+		storeTestPkg(t, replica, testPkg("demo-1.1.tar.gz", "1.1", "during"))
+	}
+	if _, err := s.reindex(ctx, reindexOptions{}); err != nil {
+		t.Fatalf("Failed to reindex, %s", err)
+	}
+
+	pr, err := s.readProject(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read project, %s", err)
+	}
+	if r := pr.findRelease("1.1"); r == nil || r.Summary != "during" {
+		t.Errorf("release uploaded during the reindex is %+v, want it kept with its metadata", r)
+	}
+}
+
+func TestReindexKeepsUploadsDuringWrite(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	replica := newReplica(t, f, serverConfig{})
+	storeTestPkg(t, s, testPkg("demo-1.0.tar.gz", "1.0", "first"))
+
+	// The replica uploads just before the reindex writes the project
+	f.beforePut = func(key string) {
+		if key != projectIndexKey("demo") {
+			return
+		}
+		f.beforePut = nil
+		storeTestPkg(t, replica, testPkg("demo-1.1.tar.gz", "1.1", "during"))
+	}
+	if _, err := s.reindex(ctx, reindexOptions{}); err != nil {
+		t.Fatalf("Failed to reindex, %s", err)
+	}
+
+	pr, err := s.readProject(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read project, %s", err)
+	}
+	if r := pr.findRelease("1.1"); r == nil || r.Summary != "during" {
+		t.Errorf("release uploaded while the reindex wrote the index is %+v, want it kept", r)
+	}
+	list, err := s.readProjectList(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read project list, %s", err)
+	}
+	if ps := list["demo"]; ps.Version != "1.1" || ps.Releases != 2 {
+		t.Errorf("demo in the project list is %+v, want 2 releases up to 1.1", ps)
+	}
+}
+
+func TestReindexExtract(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	wheel := testWheel(t, "demo", "2.0")
+	f.put("demo/demo-2.0-py3-none-any.whl", wheel)
+
+	report, err := s.reindex(ctx, reindexOptions{extract: true})
+	if err != nil {
+		t.Fatalf("Failed to reindex, %s", err)
+	}
+	if len(report.Errors) > 0 {
+		t.Errorf("reindex errors are %v, want none", report.Errors)
+	}
+	pr, err := s.readProject(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read project, %s", err)
+	}
+	files := pr.files()
+	md5Sum, sha256Sum := fileDigests(wheel)
+	if len(files) != 1 || files[0].MD5 != md5Sum || files[0].SHA256 != sha256Sum {
+		t.Errorf("files are %+v, want the wheel with MD5 %s and SHA256 %s", files, md5Sum, sha256Sum)
+	}
+	if r := pr.findRelease("2.0"); r == nil || r.Summary != "a wheel" {
+		t.Errorf("release 2.0 is %+v, want the metadata of the wheel", r)
+	}
+}
+
+func TestReindexHandler(t *testing.T) {
+	s, f := newTestServer(t, serverConfig{adminToken: "admin"})
+	storeTestPkg(t, s, testPkg("demo-1.0.tar.gz", "1.0", ""))
+
+	request := func(method string) (int, reindexStatus) {
+		t.Helper()
+		req := httptest.NewRequest(method, "/admin/reindex", nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		var status reindexStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("Failed to parse response %q, %s", w.Body.String(), err)
+		}
+		return w.Code, status
+	}
+
+	// Hold the reindex up while it lists the bucket
+	listing := make(chan struct{})
+	release := make(chan struct{})
+	f.beforeList = func(prefix string) {
+		f.beforeList = nil
+		close(listing)
+		<-release
+	}
+	if code, status := request(http.MethodPost); code != http.StatusAccepted || !status.Running {
+		t.Fatalf("starting a reindex returned %d %+v, want %d and running", code, status, http.StatusAccepted)
+	}
+	<-listing
+	if code, _ := request(http.MethodPost); code != http.StatusConflict {
+		t.Errorf("starting a reindex while one runs returned %d, want %d", code, http.StatusConflict)
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, status := request(http.MethodGet)
+		if code != http.StatusOK {
+			t.Fatalf("reindex status returned %d, want %d", code, http.StatusOK)
+		}
+		if !status.Running {
+			if status.Report == nil || status.Report.Files != 1 || status.Error != "" {
+				t.Errorf("finished reindex is %+v, want a report of 1 file", status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("reindex didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"time"
+)
+
+// releaseMetadata is the core metadata of a release, shared by all its files
+type releaseMetadata struct {
+	Summary     string   `json:"summary"`
+	Description string   `json:"description,omitempty"`
+	Author      string   `json:"author,omitempty"`
+	Keywords    string   `json:"keywords,omitempty"`
+	Classifiers []string `json:"classifiers,omitempty"`
+	// DescriptionContentType is the format of Description, reStructuredText if empty
+	DescriptionContentType string `json:"description_content_type,omitempty"`
+	License                string `json:"license,omitempty"`
+	HomePage               string `json:"home_page,omitempty"`
+	// ProjectURLs are "label, url" pairs as in the core metadata
+	ProjectURLs    []string `json:"project_urls,omitempty"`
+	RequiresPython string   `json:"requires_python,omitempty"`
+	RequiresDist   []string `json:"requires_dist,omitempty"`
+}
+
+// empty reports whether no metadata was uploaded, as with files uploaded
+// from the browser that metadata couldn't be extracted from
+func (md releaseMetadata) empty() bool {
+	return reflect.ValueOf(md).IsZero()
+}
+
+// distFile is a distribution file of a release
+type distFile struct {
+	FileName string `json:"filename"`
+	PyVer    string `json:"pyver"`
+	URL      string `json:"url"`
+	MD5      string `json:"md5_digest"`
+	SHA256   string `json:"sha256_digest,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	// UploadTime is when the file was uploaded, zero for files indexed
+	// before it was recorded
+	UploadTime time.Time `json:"upload_time"`
+	// Uploader is the identity that uploaded the file, if known
+	Uploader string `json:"uploader,omitempty"`
+}
+
+// release is a version of a project with its metadata and distribution
+// files. The metadata is set by the first upload of the release, later
+// files only fill it in while it's empty.
+type release struct {
+	Version string `json:"version"`
+	releaseMetadata
+	// Yanked releases are hidden from installers unless pinned, PEP 592
+	Yanked       bool       `json:"yanked,omitempty"`
+	YankedReason string     `json:"yanked_reason,omitempty"`
+	Files        []distFile `json:"files"`
+}
+
+// project is the index document of a project, stored in <project>/index.json
+type project struct {
+	Name string `json:"name"`
+	// Releases are ordered newest first in PEP 440 order
+	Releases []release `json:"releases"`
+	// Pending are the files being uploaded. Their names are taken but
+	// they're only added to their release once their object is stored.
+	Pending []pkg `json:"pending,omitempty"`
+}
+
+// pendingUploadTimeout is how long the name of a file being uploaded stays
+// reserved, after that the upload is assumed to have died with its server
+const pendingUploadTimeout = time.Hour
+
+// stale reports whether the upload of a pending file has been given up on
+func (p pkg) stale(now time.Time) bool {
+	return now.Sub(p.UploadTime) > pendingUploadTimeout
+}
+
+// findPending returns the upload in progress of the file called fileName
+func (pr project) findPending(fileName string) (pkg, bool) {
+	for _, p := range pr.Pending {
+		if p.FileName == fileName {
+			return p, true
+		}
+	}
+	return pkg{}, false
+}
+
+// removePending drops the upload in progress of the file called fileName
+func (pr *project) removePending(fileName string) {
+	pending := []pkg{}
+	for _, p := range pr.Pending {
+		if p.FileName != fileName {
+			pending = append(pending, p)
+		}
+	}
+	pr.Pending = pending
+	if len(pr.Pending) == 0 {
+		pr.Pending = nil
+	}
+}
+
+// newProject groups files into releases. It's used for files that don't
+// come from a project document, such as the index documents of older
+// versions of gopi which stored every file with a copy of its metadata.
+// Each release takes the metadata of its earliest uploaded file that has any.
+func newProject(name string, ps pkgs) project {
+	pr := project{Name: name, Releases: []release{}}
+	byUpload := append(pkgs(nil), ps...)
+	sort.SliceStable(byUpload, func(i, j int) bool {
+		return byUpload[i].UploadTime.Before(byUpload[j].UploadTime)
+	})
+	for _, p := range byUpload {
+		pr.add(p)
+	}
+	return pr
+}
+
+// add adds the file p to its release, creating the release if needed
+func (pr *project) add(p pkg) {
+	r := pr.findRelease(p.Version)
+	if r == nil {
+		pr.Releases = append(pr.Releases, release{Version: p.Version})
+		r = &pr.Releases[len(pr.Releases)-1]
+	}
+	if r.releaseMetadata.empty() {
+		r.releaseMetadata = p.releaseMetadata
+	}
+	if p.Yanked {
+		r.Yanked, r.YankedReason = true, p.YankedReason
+	}
+	r.Files = append(r.Files, p.distFile())
+	pr.sort()
+}
+
+// remove drops the file called fileName and its release if it was the last
+// file of the release. It returns the file and whether it was found.
+func (pr *project) remove(fileName string) (pkg, bool) {
+	for i, r := range pr.Releases {
+		for j, f := range r.Files {
+			if f.FileName != fileName {
+				continue
+			}
+			removed := r.file(pr.Name, f)
+			r.Files = append(r.Files[:j:j], r.Files[j+1:]...)
+			pr.Releases[i] = r
+			if len(r.Files) == 0 {
+				pr.Releases = append(pr.Releases[:i:i], pr.Releases[i+1:]...)
+			}
+			return removed, true
+		}
+	}
+	return pkg{}, false
+}
+
+// sort orders the releases newest first and the files of each release by name
+func (pr *project) sort() {
+	sort.SliceStable(pr.Releases, func(i, j int) bool {
+		return compareVersions(pr.Releases[i].Version, pr.Releases[j].Version) > 0
+	})
+	for _, r := range pr.Releases {
+		sort.SliceStable(r.Files, func(i, j int) bool {
+			return r.Files[i].FileName < r.Files[j].FileName
+		})
+	}
+}
+
+// findRelease returns the release of a version, nil if there's no such release
+func (pr *project) findRelease(version string) *release {
+	for i := range pr.Releases {
+		if pr.Releases[i].Version == version {
+			return &pr.Releases[i]
+		}
+	}
+	return nil
+}
+
+// latest returns the newest release. Yanked releases are only picked if
+// every release has been yanked.
+func (pr project) latest() release {
+	for _, r := range pr.Releases {
+		if !r.Yanked {
+			return r
+		}
+	}
+	if len(pr.Releases) > 0 {
+		return pr.Releases[0]
+	}
+	return release{}
+}
+
+// files returns every file of the project with the metadata of its release
+func (pr project) files() pkgs {
+	ps := pkgs{}
+	for _, r := range pr.Releases {
+		for _, f := range r.Files {
+			ps = append(ps, r.file(pr.Name, f))
+		}
+	}
+	return ps
+}
+
+// fileCount returns the number of files of every release
+func (pr project) fileCount() int {
+	n := 0
+	for _, r := range pr.Releases {
+		n += len(r.Files)
+	}
+	return n
+}
+
+// file returns f with the metadata of the release
+func (r release) file(name string, f distFile) pkg {
+	p := r.pkg(name)
+	p.FileName = f.FileName
+	p.PyVer = f.PyVer
+	p.URL = f.URL
+	p.MD5 = f.MD5
+	p.SHA256 = f.SHA256
+	p.Size = f.Size
+	p.UploadTime = f.UploadTime
+	p.Uploader = f.Uploader
+	return p
+}
+
+// pkg returns the release without any file, as indexed for search
+func (r release) pkg(name string) pkg {
+	return pkg{
+		Name:            name,
+		Version:         r.Version,
+		releaseMetadata: r.releaseMetadata,
+		Yanked:          r.Yanked,
+		YankedReason:    r.YankedReason,
+	}
+}
+
+// UploadTime returns when the first file of the release was uploaded, zero if unknown
+func (r release) UploadTime() time.Time {
+	var first time.Time
+	for _, f := range r.Files {
+		if first.IsZero() || (!f.UploadTime.IsZero() && f.UploadTime.Before(first)) {
+			first = f.UploadTime
+		}
+	}
+	return first
+}
+
+// Uploader returns who uploaded the first file of the release
+func (r release) Uploader() string {
+	first := r.UploadTime()
+	for _, f := range r.Files {
+		if f.UploadTime.Equal(first) {
+			return f.Uploader
+		}
+	}
+	return ""
+}
+
+// Size returns the total size of the files of the release
+func (r release) Size() int64 {
+	var size int64
+	for _, f := range r.Files {
+		size += f.Size
+	}
+	return size
+}
@@ -6,23 +6,45 @@ import (
 
 func (s *server) routes() {
 
-	s.router.NotFoundHandler = s.NotFoundHandler()
+	s.router.NotFoundHandler = s.instrument("not_found", s.NotFoundHandler())
 	s.rpc.RegisterBeforeFunc(s.RPCRequestInfo)
 
-	s.router.PathPrefix("/assets").Handler(http.FileServer(http.Dir("./assets/")))
+	s.router.PathPrefix("/assets").Handler(s.instrument("assets", http.FileServer(http.FS(s.ui))))
 
-	s.router.Handle("/RPC2", s.rpc)
+	s.router.Handle("/RPC2", s.instrument("rpc2", s.requireRead(s.rpc.ServeHTTP)))
+	s.router.Handle("/metrics", s.metrics.handler()).Methods("GET")
+	s.router.HandleFunc("/healthz", s.HealthzHandler()).Methods("GET")
+	s.router.HandleFunc("/readyz", s.ReadyzHandler()).Methods("GET")
 
-	s.router.HandleFunc("/", s.HomeHandler())
-	s.router.HandleFunc("/package/{package}/", s.DetailsHandler())
+	s.router.HandleFunc("/", s.instrument("home", s.requireRead(s.HomeHandler())))
+	s.router.HandleFunc("/package/{package}/", s.instrument("details", s.requireRead(s.DetailsHandler())))
+	s.router.HandleFunc("/package/{package}/{version}/", s.instrument("details", s.requireRead(s.DetailsHandler())))
+	s.router.HandleFunc("/search", s.instrument("search", s.requireRead(s.SearchHandler()))).Methods("GET")
+	s.router.HandleFunc("/changelog", s.instrument("changelog", s.requireRead(s.ChangelogHandler()))).Methods("GET")
+	s.router.HandleFunc("/stats", s.instrument("stats", s.requireRead(s.StatsOverviewHandler()))).Methods("GET")
+	s.router.HandleFunc("/stats/{package}", s.instrument("stats", s.requireRead(s.StatsHandler()))).Methods("GET")
 
-	s.router.HandleFunc("/simple/", s.SimpleHandler()).Methods("GET")
-	s.router.HandleFunc("/simple/{package}/", s.SimpleHandler()).Methods("GET")
+	s.router.HandleFunc("/simple/", s.instrument("simple", s.requireRead(s.SimpleHandler()))).Methods("GET")
+	s.router.HandleFunc("/simple/{package}/", s.instrument("simple", s.requireRead(s.SimpleHandler()))).Methods("GET")
 
 	// There's probably a nicer way of handling both of these endpoints without redirecting
-	s.router.HandleFunc("/simple", s.UploadHandler()).Methods("POST")
-	s.router.HandleFunc("/simple/", s.UploadHandler()).Methods("POST")
-
-	s.router.HandleFunc("/api/{package}/{file}", s.DownloadHander())
+	s.router.HandleFunc("/simple", s.instrument("upload", s.requireUpload(s.UploadHandler()))).Methods("POST")
+	s.router.HandleFunc("/simple/", s.instrument("upload", s.requireUpload(s.UploadHandler()))).Methods("POST")
+
+	s.router.HandleFunc("/manage/", s.instrument("manage", s.requireManager(s.ManageHandler()))).Methods("GET")
+	s.router.HandleFunc("/manage/upload", s.instrument("manage", s.requireManager(s.ManageUploadHandler()))).Methods("POST")
+	s.router.HandleFunc("/manage/{package}/", s.instrument("manage", s.requireManager(s.ManageProjectHandler()))).Methods("GET")
+	s.router.HandleFunc("/manage/{package}/{action}", s.instrument("manage", s.requireManager(s.ManageActionHandler()))).Methods("POST")
+
+	s.router.HandleFunc("/admin/reindex", s.instrument("admin", s.ReindexHandler())).Methods("POST")
+	s.router.HandleFunc("/admin/reindex", s.instrument("admin", s.ReindexStatusHandler())).Methods("GET")
+	s.router.HandleFunc("/admin/refresh", s.instrument("admin", s.RefreshHandler())).Methods("POST")
+	s.router.HandleFunc("/admin/owners", s.instrument("admin", s.OwnersHandler())).Methods("POST")
+
+	s.router.HandleFunc("/pypi/{package}/json", s.instrument("api", s.requireRead(s.JSONHandler()))).Methods("GET")
+	s.router.HandleFunc("/pypi/{package}/{version}/json", s.instrument("api", s.requireRead(s.JSONHandler()))).Methods("GET")
+	s.router.HandleFunc("/api/search", s.instrument("api", s.requireRead(s.SearchAPIHandler()))).Methods("GET")
+	s.router.HandleFunc("/api/index", s.instrument("api", s.requireRead(s.IndexStatusHandler()))).Methods("GET")
+	s.router.HandleFunc("/api/{package}/{file}", s.instrument("download", s.requireRead(s.DownloadHander())))
 	return
 }
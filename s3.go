@@ -1,10 +1,51 @@
 package main
 
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
 type s3Config struct {
 	endpoint  string
 	bucket    string
 	accessKey string
 	secretKey string
+	// proxy and noProxy are storage.proxy and storage.noProxy
+	proxy   string
+	noProxy []string
+}
+
+// proxyFunc returns the proxy of the connections to the storage backend, the
+// proxy of the config unless the host is in noProxy, or the one of the
+// environment when the config has none
+func (c s3Config) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if c.proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxy, err := url.Parse(c.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid storage proxy %q, %s", c.proxy, err.Error())
+	}
+	return func(r *http.Request) (*url.URL, error) {
+		host := r.URL.Hostname()
+		for _, h := range c.noProxy {
+			h = strings.TrimPrefix(h, ".")
+			if host == h || strings.HasSuffix(host, "."+h) {
+				return nil, nil
+			}
+		}
+		return proxy, nil
+	}, nil
 }
 
 // S3Error describes a bucket, object or network error when connecting to S3
@@ -25,8 +66,16 @@ const (
 
 	// NoSuchKey means the object does not exist in the bucket, essentially "file not found"
 	NoSuchKey
+
+	// PreconditionFailed means a conditional write lost to another writer,
+	// the object was created or changed since it was read
+	PreconditionFailed
 )
 
+// maxUpdateAttempts is how many times updateObject retries a write that
+// lost to another writer before giving up
+const maxUpdateAttempts = 10
+
 // Error returns the mssage of a customError
 func (e S3Error) Error() string {
 	switch e {
@@ -38,7 +87,280 @@ func (e S3Error) Error() string {
 		return "InvalidBucketName"
 	case 4:
 		return "NoSuchKey"
+	case 5:
+		return "PreconditionFailed"
 	default:
 		return "UnknownError"
 	}
 }
+
+// toS3Error translates a minio error response into an S3Error where possible
+func toS3Error(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "AccessDenied":
+		return AccessDenied
+	case "NoSuchBucket":
+		return NoSuchBucket
+	case "InvalidBucketName":
+		return InvalidBucketName
+	case "NoSuchKey":
+		return NoSuchKey
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return PreconditionFailed
+	}
+	return err
+}
+
+// getObject reads the whole object at key from the bucket
+func (s *server) getObject(ctx context.Context, key string) (data []byte, err error) {
+	ctx, done := s.storageCall(ctx, "get", key)
+	defer func() { done(err) }()
+	o, err := s.s3.GetObjectWithContext(ctx, s.s3cfg.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, toS3Error(err)
+	}
+	defer o.Close()
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(o)
+	if err != nil {
+		return nil, toS3Error(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// openObject opens the object at key for reading without downloading it,
+// reads and seeks fetch what they need from the bucket. Callers must close it.
+func (s *server) openObject(ctx context.Context, key string) (o *minio.Object, err error) {
+	ctx, done := s.storageCall(ctx, "get", key)
+	defer func() { done(err) }()
+	o, err = s.s3.GetObjectWithContext(ctx, s.s3cfg.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, toS3Error(err)
+	}
+	return o, nil
+}
+
+// objectDigests streams the object at key and returns its hex encoded MD5
+// and SHA256 digests
+func (s *server) objectDigests(ctx context.Context, key string) (string, string, error) {
+	o, err := s.openObject(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+	defer o.Close()
+	md5Sum, sha256Sum, err := readerDigests(o)
+	if err != nil {
+		return "", "", toS3Error(err)
+	}
+	return md5Sum, sha256Sum, nil
+}
+
+// getObjectETag is getObject, also returning the ETag of the object read
+func (s *server) getObjectETag(ctx context.Context, key string) (data []byte, etag string, err error) {
+	ctx, done := s.storageCall(ctx, "get", key)
+	defer func() { done(err) }()
+	o, err := s.s3.GetObjectWithContext(ctx, s.s3cfg.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", toS3Error(err)
+	}
+	defer o.Close()
+	info, err := o.Stat()
+	if err != nil {
+		return nil, "", toS3Error(err)
+	}
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(o)
+	if err != nil {
+		return nil, "", toS3Error(err)
+	}
+	return buf.Bytes(), info.ETag, nil
+}
+
+// putObject writes data to key in the bucket
+func (s *server) putObject(ctx context.Context, key string, data []byte, contentType string) error {
+	ctx, done := s.storageCall(ctx, "put", key)
+	_, err := s.s3.PutObjectWithContext(ctx, s.s3cfg.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		err = toS3Error(err)
+	}
+	done(err)
+	return err
+}
+
+// putObjectIf writes data to key only if the object still has the given
+// ETag, or only if it doesn't exist yet when etag is empty. PreconditionFailed
+// is returned if another writer got there first.
+func (s *server) putObjectIf(ctx context.Context, key string, data []byte, contentType, etag string) error {
+	return s.putObject(withWriteCondition(ctx, etag), key, data, contentType)
+}
+
+// updateObject reads the object at key, passes its content to update, nil if
+// it doesn't exist, and writes back what update returns. If another writer
+// changed the object in the meantime it's read again and update retried, so
+// update must not have side effects beyond the returned content.
+func (s *server) updateObject(ctx context.Context, key, contentType string, update func(data []byte) ([]byte, error)) error {
+	for attempt := 1; ; attempt++ {
+		data, etag, err := s.getObjectETag(ctx, key)
+		if errors.Is(err, NoSuchKey) {
+			data, etag, err = nil, "", nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err = update(data)
+		if err != nil {
+			return err
+		}
+		err = s.putObjectIf(ctx, key, data, contentType, etag)
+		if !errors.Is(err, PreconditionFailed) || attempt == maxUpdateAttempts {
+			return err
+		}
+		logger(ctx).Debug("Object changed while it was updated, trying again", "key", key, "attempt", attempt)
+	}
+}
+
+// writeCondition is the precondition of a put, see withWriteCondition
+type writeCondition struct {
+	header string
+	value  string
+}
+
+type writeConditionKey struct{}
+
+// withWriteCondition returns a context making puts conditional on the object
+// having the ETag etag, or on it not existing when etag is empty
+func withWriteCondition(ctx context.Context, etag string) context.Context {
+	c := writeCondition{header: "If-None-Match", value: "*"}
+	if etag != "" {
+		c = writeCondition{header: "If-Match", value: `"` + strings.Trim(etag, `"`) + `"`}
+	}
+	return context.WithValue(ctx, writeConditionKey{}, c)
+}
+
+// conditionalTransport adds the write condition of a put's context to its
+// headers, minio-go has no option for conditional writes
+type conditionalTransport struct {
+	http.RoundTripper
+}
+
+func (t conditionalTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c, ok := r.Context().Value(writeConditionKey{}).(writeCondition)
+	// Parts of multipart uploads are puts too, only whole objects are conditional
+	if ok && r.Method == http.MethodPut && !r.URL.Query().Has("partNumber") {
+		r = r.Clone(r.Context())
+		r.Header.Set(c.header, c.value)
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+// removeObject deletes key from the bucket
+func (s *server) removeObject(ctx context.Context, key string) error {
+	_, done := s.storageCall(ctx, "remove", key)
+	err := s.s3.RemoveObject(s.s3cfg.bucket, key)
+	if err != nil {
+		err = toS3Error(err)
+	}
+	done(err)
+	return err
+}
+
+// statObject returns the size, ETag and modification time of key
+func (s *server) statObject(ctx context.Context, key string) (minio.ObjectInfo, error) {
+	_, done := s.storageCall(ctx, "stat", key)
+	info, err := s.s3.StatObject(s.s3cfg.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		err = toS3Error(err)
+	}
+	done(err)
+	return info, err
+}
+
+// objectExists reports whether key exists in the bucket
+func (s *server) objectExists(ctx context.Context, key string) (bool, error) {
+	_, err := s.statObject(ctx, key)
+	if err != nil {
+		if err == NoSuchKey {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// listObjects returns every object under prefix, recursively
+func (s *server) listObjects(ctx context.Context, prefix string) (objects []minio.ObjectInfo, err error) {
+	ctx, done := s.storageCall(ctx, "list", prefix)
+	defer func() { done(err) }()
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for o := range s.s3.ListObjectsV2(s.s3cfg.bucket, prefix, true, doneCh) {
+		if o.Err != nil {
+			return nil, toS3Error(o.Err)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		objects = append(objects, o)
+	}
+	return objects, nil
+}
+
+// listObjectsAfter returns the objects under prefix whose keys sort after
+// startAfter, so only the objects added since the last listing are read
+func (s *server) listObjectsAfter(ctx context.Context, prefix, startAfter string) (objects []minio.ObjectInfo, err error) {
+	ctx, done := s.storageCall(ctx, "list", prefix)
+	defer func() { done(err) }()
+	core := minio.Core{Client: s.s3}
+	token := ""
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		result, err := core.ListObjectsV2(s.s3cfg.bucket, prefix, token, false, "", 1000, startAfter)
+		if err != nil {
+			return nil, toS3Error(err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// bucketExists checks that the bucket exists and can be accessed
+func (s *server) bucketExists(ctx context.Context) error {
+	_, done := s.storageCall(ctx, "bucket_exists", "")
+	exists, err := s.s3.BucketExists(s.s3cfg.bucket)
+	if err != nil {
+		err = toS3Error(err)
+	} else if !exists {
+		err = NoSuchBucket
+	}
+	done(err)
+	return err
+}
+
+// storageCall traces a storage call on key, the returned function records
+// its outcome in the trace, the metrics and the debug log
+func (s *server) storageCall(ctx context.Context, operation, key string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "storage."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("gopi.storage.operation", operation),
+			attribute.String("gopi.storage.bucket", s.s3cfg.bucket),
+			attribute.String("gopi.storage.key", key),
+		),
+	)
+	return ctx, func(err error) {
+		s.metrics.observeStorage(operation, start, err)
+		endSpan(span, err)
+		log := logger(ctx).With("operation", operation, "key", key, "duration", time.Since(start))
+		if err != nil {
+			log.Debug("Storage call failed", "err", err)
+			return
+		}
+		log.Debug("Storage call")
+	}
+}
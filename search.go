@@ -0,0 +1,517 @@
+package main
+
+import (
+	"html/template"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	wordRe = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+	// snippetLength is the approximate length of the description excerpt returned with a search result
+	snippetLength = 200
+)
+
+// searchFieldID identifies a package metadata field in the search index
+type searchFieldID int
+
+const (
+	fieldName = searchFieldID(iota)
+	fieldVersion
+	fieldAuthor
+	fieldKeywords
+	fieldSummary
+	fieldDescription
+	fieldClassifiers
+	numSearchFields
+)
+
+// fieldWeights is how much a match in each field counts towards the ranking of
+// a free text search. Fields with a weight of zero don't count, they're only
+// searched by field specific searches such as the XML-RPC search method.
+var fieldWeights = [numSearchFields]float64{
+	fieldName:        10,
+	fieldVersion:     0,
+	fieldAuthor:      0,
+	fieldKeywords:    5,
+	fieldSummary:     3,
+	fieldDescription: 1,
+	fieldClassifiers: 2,
+}
+
+// termFreqs counts the occurrences of a term in each field of a document
+type termFreqs [numSearchFields]int
+
+// fieldTerm is a single field specific search term
+type fieldTerm struct {
+	field searchFieldID
+	term  string
+}
+
+// searchResult is a ranked package returned by a free text search
+type searchResult struct {
+	Name       string        `json:"name"`
+	Version    string        `json:"version"`
+	Summary    string        `json:"summary"`
+	Score      float64       `json:"score"`
+	Highlights searchExcerpt `json:"highlights"`
+}
+
+// searchExcerpt holds HTML escaped package fields with the matched terms wrapped in <mark>
+type searchExcerpt struct {
+	Name        template.HTML `json:"name"`
+	Summary     template.HTML `json:"summary"`
+	Description template.HTML `json:"description,omitempty"`
+}
+
+// searchIndex is an in-memory inverted index over the metadata of every
+// release. Documents are keyed by "name==version".
+type searchIndex struct {
+	mu       sync.RWMutex
+	docs     map[string]pkg
+	docTerms map[string][]string
+	projects map[string]map[string]struct{}
+	postings map[string]map[string]*termFreqs
+	// vocab is every indexed term in sorted order, used for prefix matching
+	vocab []string
+	// built is set once every project has been indexed
+	built bool
+}
+
+func newSearchIndex() *searchIndex {
+	idx := &searchIndex{}
+	idx.clear()
+	return idx
+}
+
+func (idx *searchIndex) clear() {
+	idx.docs = make(map[string]pkg)
+	idx.docTerms = make(map[string][]string)
+	idx.projects = make(map[string]map[string]struct{})
+	idx.postings = make(map[string]map[string]*termFreqs)
+	idx.vocab = nil
+}
+
+func searchDocKey(name, version string) string {
+	return name + "==" + version
+}
+
+// reset replaces the content of the index with the releases of every project
+func (idx *searchIndex) reset(projects projectMap) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.replaceLocked(projects)
+	idx.built = true
+}
+
+// seed replaces the content of the index with the releases of every project
+// without marking it built, some projects are only indexed by their summary
+// until markBuilt is called
+func (idx *searchIndex) seed(projects projectMap) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.replaceLocked(projects)
+	idx.built = false
+}
+
+func (idx *searchIndex) replaceLocked(projects projectMap) {
+	idx.clear()
+	for name, pr := range projects {
+		for _, r := range pr.Releases {
+			idx.addLocked(r.pkg(name))
+		}
+	}
+}
+
+// markBuilt records that every project has been indexed in full
+func (idx *searchIndex) markBuilt() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.built = true
+}
+
+// isBuilt reports whether every project has been indexed since gopi started
+func (idx *searchIndex) isBuilt() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.built
+}
+
+// add indexes p, replacing any previously indexed document for the same version
+func (idx *searchIndex) add(p pkg) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.addLocked(p)
+}
+
+// remove drops the document for the package version from the index
+func (idx *searchIndex) remove(name, version string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(searchDocKey(name, version))
+}
+
+// resetProject replaces every indexed version of a project with the releases of pr
+func (idx *searchIndex) resetProject(name string, pr project) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for key := range idx.projects[name] {
+		idx.removeLocked(key)
+	}
+	for _, r := range pr.Releases {
+		idx.addLocked(r.pkg(name))
+	}
+}
+
+func (idx *searchIndex) addLocked(p pkg) {
+	key := searchDocKey(p.Name, p.Version)
+	idx.removeLocked(key)
+
+	idx.docs[key] = p
+	if _, ok := idx.projects[p.Name]; !ok {
+		idx.projects[p.Name] = make(map[string]struct{})
+	}
+	idx.projects[p.Name][key] = struct{}{}
+
+	for field := searchFieldID(0); field < numSearchFields; field++ {
+		for _, term := range fieldTokens(field, fieldValues(p, field)...) {
+			docs, ok := idx.postings[term]
+			if !ok {
+				docs = make(map[string]*termFreqs)
+				idx.postings[term] = docs
+				idx.insertVocab(term)
+			}
+			freqs, ok := docs[key]
+			if !ok {
+				freqs = &termFreqs{}
+				docs[key] = freqs
+				idx.docTerms[key] = append(idx.docTerms[key], term)
+			}
+			freqs[field]++
+		}
+	}
+}
+
+func (idx *searchIndex) removeLocked(key string) {
+	p, ok := idx.docs[key]
+	if !ok {
+		return
+	}
+	for _, term := range idx.docTerms[key] {
+		delete(idx.postings[term], key)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+			idx.removeVocab(term)
+		}
+	}
+	delete(idx.docTerms, key)
+	delete(idx.docs, key)
+	delete(idx.projects[p.Name], key)
+	if len(idx.projects[p.Name]) == 0 {
+		delete(idx.projects, p.Name)
+	}
+}
+
+func (idx *searchIndex) insertVocab(term string) {
+	i := sort.SearchStrings(idx.vocab, term)
+	idx.vocab = append(idx.vocab, "")
+	copy(idx.vocab[i+1:], idx.vocab[i:])
+	idx.vocab[i] = term
+}
+
+func (idx *searchIndex) removeVocab(term string) {
+	i := sort.SearchStrings(idx.vocab, term)
+	if i < len(idx.vocab) && idx.vocab[i] == term {
+		idx.vocab = append(idx.vocab[:i], idx.vocab[i+1:]...)
+	}
+}
+
+// expand returns every indexed term that starts with token
+func (idx *searchIndex) expand(token string) []string {
+	var terms []string
+	for i := sort.SearchStrings(idx.vocab, token); i < len(idx.vocab); i++ {
+		if !strings.HasPrefix(idx.vocab[i], token) {
+			break
+		}
+		terms = append(terms, idx.vocab[i])
+	}
+	return terms
+}
+
+// search runs a free text query over the index and returns one result per
+// matching project, best match first. Every word of the query has to match
+// a field of the package, either fully or as a prefix of an indexed word.
+func (idx *searchIndex) search(query string, limit int) []searchResult {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var scores map[string]float64
+	for _, token := range tokens {
+		tokenScores := make(map[string]float64)
+		for _, term := range idx.expand(token) {
+			boost := 1.0
+			if term != token {
+				// Prefix matches rank below exact matches
+				boost = 0.5
+			}
+			docs := idx.postings[term]
+			idf := math.Log(1 + float64(len(idx.docs))/float64(len(docs)))
+			for key, freqs := range docs {
+				score := 0.0
+				for field, n := range freqs {
+					if n > 0 {
+						score += fieldWeights[field] * (1 + math.Log(float64(n)))
+					}
+				}
+				score *= idf * boost
+				if score > tokenScores[key] {
+					tokenScores[key] = score
+				}
+			}
+		}
+		if scores == nil {
+			scores = tokenScores
+			continue
+		}
+		for key := range scores {
+			if s, ok := tokenScores[key]; ok {
+				scores[key] += s
+			} else {
+				delete(scores, key)
+			}
+		}
+	}
+
+	// Group the matched versions by project, ranking each project by its best version
+	best := make(map[string]float64)
+	for key, score := range scores {
+		name := idx.docs[key].Name
+		if score > best[name] {
+			best[name] = score
+		}
+	}
+
+	results := make([]searchResult, 0, len(best))
+	for name, score := range best {
+		latest := idx.latestLocked(name)
+		results = append(results, searchResult{
+			Name:    name,
+			Version: latest.Version,
+			Summary: latest.Summary,
+			Score:   score,
+			Highlights: searchExcerpt{
+				Name:        highlight(name, tokens),
+				Summary:     highlight(latest.Summary, tokens),
+				Description: highlight(snippet(latest.Description, tokens), tokens),
+			},
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Name < results[j].Name
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// query runs a field specific search and returns the latest matching version
+// of each matching project, sorted by name. A term matches a field that
+// contains it anywhere (case insensitive) as in PyPI's XML-RPC search, so it
+// scans the documents instead of matching the words of the inverted index.
+// With the "and" operator every term has to match, with "or" a single match
+// is enough. Empty terms are ignored and a query without terms matches nothing.
+func (idx *searchIndex) query(terms []fieldTerm, operator string) pkgs {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var matched map[string]struct{}
+	for _, t := range terms {
+		term := strings.ToLower(strings.TrimSpace(t.term))
+		if term == "" {
+			continue
+		}
+		docs := idx.fieldContainsLocked(t.field, term)
+		switch {
+		case matched == nil:
+			matched = docs
+		case operator == "or":
+			for key := range docs {
+				matched[key] = struct{}{}
+			}
+		default:
+			for key := range matched {
+				if _, ok := docs[key]; !ok {
+					delete(matched, key)
+				}
+			}
+		}
+	}
+
+	byProject := make(map[string]pkgs)
+	for key := range matched {
+		p := idx.docs[key]
+		byProject[p.Name] = append(byProject[p.Name], p)
+	}
+	names := make([]string, 0, len(byProject))
+	for name := range byProject {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make(pkgs, 0, len(names))
+	for _, name := range names {
+		result = append(result, byProject[name].GetLatestVersionPackage())
+	}
+	return result
+}
+
+// fieldContainsLocked returns the documents where a value of the field contains the lower case term
+func (idx *searchIndex) fieldContainsLocked(field searchFieldID, term string) map[string]struct{} {
+	docs := make(map[string]struct{})
+	for key, p := range idx.docs {
+		for _, v := range fieldValues(p, field) {
+			if strings.Contains(strings.ToLower(v), term) {
+				docs[key] = struct{}{}
+				break
+			}
+		}
+	}
+	return docs
+}
+
+func (idx *searchIndex) latestLocked(name string) pkg {
+	versions := pkgs{}
+	for key := range idx.projects[name] {
+		versions = append(versions, idx.docs[key])
+	}
+	return versions.GetLatestVersionPackage()
+}
+
+// fieldValues returns the raw text of a field of p
+func fieldValues(p pkg, field searchFieldID) []string {
+	switch field {
+	case fieldName:
+		return []string{p.Name}
+	case fieldVersion:
+		return []string{p.Version}
+	case fieldAuthor:
+		return []string{p.Author}
+	case fieldKeywords:
+		return []string{p.Keywords}
+	case fieldSummary:
+		return []string{p.Summary}
+	case fieldDescription:
+		return []string{p.Description}
+	case fieldClassifiers:
+		return p.Classifiers
+	}
+	return nil
+}
+
+// fieldTokens splits values into index terms. Names are indexed both whole and
+// by their dash separated parts, versions are only indexed whole and all
+// other fields are split into lower case words.
+func fieldTokens(field searchFieldID, values ...string) []string {
+	var tokens []string
+	for _, v := range values {
+		switch field {
+		case fieldName:
+			name := normalisePackageName(strings.TrimSpace(v))
+			if name == "" {
+				continue
+			}
+			tokens = append(tokens, name)
+			if parts := tokenize(name); len(parts) > 1 {
+				tokens = append(tokens, parts...)
+			}
+		case fieldVersion:
+			if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+				tokens = append(tokens, v)
+			}
+		default:
+			tokens = append(tokens, tokenize(v)...)
+		}
+	}
+	return tokens
+}
+
+// tokenize splits text into lower case words
+func tokenize(text string) []string {
+	return wordRe.FindAllString(strings.ToLower(text), -1)
+}
+
+// matchesToken reports whether word starts with any of the query tokens
+func matchesToken(word string, tokens []string) bool {
+	word = strings.ToLower(word)
+	for _, t := range tokens {
+		if strings.HasPrefix(word, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// highlight HTML escapes text and wraps every word matching the query tokens in <mark>
+func highlight(text string, tokens []string) template.HTML {
+	var b strings.Builder
+	last := 0
+	for _, loc := range wordRe.FindAllStringIndex(text, -1) {
+		if !matchesToken(text[loc[0]:loc[1]], tokens) {
+			continue
+		}
+		b.WriteString(template.HTMLEscapeString(text[last:loc[0]]))
+		b.WriteString("<mark>")
+		b.WriteString(template.HTMLEscapeString(text[loc[0]:loc[1]]))
+		b.WriteString("</mark>")
+		last = loc[1]
+	}
+	b.WriteString(template.HTMLEscapeString(text[last:]))
+	return template.HTML(b.String())
+}
+
+// snippet returns an excerpt of text around the first word matching the query tokens
+func snippet(text string, tokens []string) string {
+	for _, loc := range wordRe.FindAllStringIndex(text, -1) {
+		if !matchesToken(text[loc[0]:loc[1]], tokens) {
+			continue
+		}
+		start := loc[0] - snippetLength/4
+		if start < 0 {
+			start = 0
+		}
+		end := start + snippetLength
+		if end > len(text) {
+			end = len(text)
+		}
+		// Don't cut multi-byte characters in half
+		for start > 0 && !utf8.RuneStart(text[start]) {
+			start--
+		}
+		for end < len(text) && !utf8.RuneStart(text[end]) {
+			end++
+		}
+		excerpt := strings.Join(strings.Fields(text[start:end]), " ")
+		if start > 0 {
+			excerpt = "…" + excerpt
+		}
+		if end < len(text) {
+			excerpt += "…"
+		}
+		return excerpt
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"html/template"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSearchIndex returns an index of a few projects
+func testSearchIndex() *searchIndex {
+	idx := newSearchIndex()
+	for _, p := range []pkg{
+		{Name: "requests", Version: "2.31.0", releaseMetadata: releaseMetadata{Summary: "HTTP for humans", Author: "Kenneth Reitz"}},
+		{Name: "requests", Version: "2.30.0", releaseMetadata: releaseMetadata{Summary: "HTTP for humans"}},
+		{Name: "httpx", Version: "0.25.0", releaseMetadata: releaseMetadata{Summary: "A next generation HTTP client", Keywords: "requests async"}},
+		{Name: "myutils", Version: "1.0", releaseMetadata: releaseMetadata{Summary: "Utilities", Description: "Helpers for parsing <html> and sending requests."}},
+		{Name: "toolbox", Version: "1.0", releaseMetadata: releaseMetadata{Summary: "Tools", Classifiers: []string{"Topic :: Utilities"}}},
+	} {
+		idx.add(p)
+	}
+	return idx
+}
+
+func TestSearchRanking(t *testing.T) {
+	idx := testSearchIndex()
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// Name matches rank above keyword matches, which rank above description matches
+		{query: "requests", want: []string{"requests", "httpx", "myutils"}},
+		// Prefix matches rank below exact matches
+		{query: "http", want: []string{"httpx", "requests"}},
+		{query: "util", want: []string{"myutils", "toolbox"}},
+		// Every word has to match
+		{query: "http client", want: []string{"httpx"}},
+		{query: "requests nothing", want: []string{}},
+		{query: "  ", want: []string{}},
+	}
+	for _, tt := range tests {
+		names := []string{}
+		for _, r := range idx.search(tt.query, 0) {
+			names = append(names, r.Name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("search(%q) is %v, want %v", tt.query, names, tt.want)
+		}
+	}
+
+	if results := idx.search("requests", 1); len(results) != 1 || results[0].Version != "2.31.0" {
+		t.Errorf("search limited to 1 result is %+v, want the latest version of requests", results)
+	}
+}
+
+func TestSearchIndexUpdates(t *testing.T) {
+	idx := testSearchIndex()
+	idx.remove("httpx", "0.25.0")
+	if results := idx.search("client", 0); len(results) != 0 {
+		t.Errorf("search for a removed package returned %+v", results)
+	}
+	idx.resetProject("requests", project{Releases: []release{{Version: "3.0", releaseMetadata: releaseMetadata{Summary: "HTTP client"}}}})
+	results := idx.search("client", 0)
+	if len(results) != 1 || results[0].Name != "requests" || results[0].Version != "3.0" {
+		t.Errorf("search after resetting a project is %+v, want requests 3.0", results)
+	}
+	if results := idx.search("humans", 0); len(results) != 0 {
+		t.Errorf("search for a replaced release returned %+v", results)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		text   string
+		tokens []string
+		want   template.HTML
+	}{
+		{text: "HTTP for humans", tokens: []string{"http"}, want: "<mark>HTTP</mark> for humans"},
+		{text: "HTTP for humans", tokens: []string{"hum", "for"}, want: "HTTP <mark>for</mark> <mark>humans</mark>"},
+		{text: "Parse <html> & more", tokens: []string{"html"}, want: "Parse &lt;<mark>html</mark>&gt; &amp; more"},
+		// Only word prefixes match
+		{text: "myutils", tokens: []string{"utils"}, want: "myutils"},
+		{text: "no match", tokens: []string{"other"}, want: "no match"},
+	}
+	for _, tt := range tests {
+		if got := highlight(tt.text, tt.tokens); got != tt.want {
+			t.Errorf("highlight(%q, %v) is %q, want %q", tt.text, tt.tokens, got, tt.want)
+		}
+	}
+
+	results := testSearchIndex().search("pars", 0)
+	if len(results) != 1 || results[0].Highlights.Description != "Helpers for <mark>parsing</mark> &lt;html&gt; and sending requests." {
+		t.Errorf("highlights are %+v, want the matched description word marked", results)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	text := strings.Repeat("lorem ipsum ", 50) + "needle " + strings.Repeat("dolor sit ", 50)
+	got := snippet(text, []string{"needle"})
+	if !strings.HasPrefix(got, "…") || !strings.HasSuffix(got, "…") || !strings.Contains(got, "needle") {
+		t.Errorf("snippet is %q, want an excerpt around needle", got)
+	}
+	if len(got) > snippetLength+len("……") {
+		t.Errorf("snippet is %d bytes long, want at most about %d", len(got), snippetLength)
+	}
+	if got := snippet("short text", []string{"text"}); got != "short text" {
+		t.Errorf("snippet of a short text is %q, want all of it", got)
+	}
+}
+
+func TestXMLSearch(t *testing.T) {
+	s, _ := newTestServer(t, serverConfig{})
+	s.search = testSearchIndex()
+	search := newXMLSearch(s)
+	tests := []struct {
+		name     string
+		args     func(*PackageSearchArgs)
+		operator string
+		want     []PackageVersion
+	}{
+		{
+			name: "names match substrings",
+			args: func(a *PackageSearchArgs) { a.Query.Name = []string{"utils"} },
+			want: []PackageVersion{{Name: "myutils", Summary: "Utilities", Version: "1.0"}},
+		},
+		{
+			name: "matches are case insensitive and reply with the latest version",
+			args: func(a *PackageSearchArgs) { a.Query.Summary = []string{"FOR HUM"} },
+			want: []PackageVersion{{Name: "requests", Summary: "HTTP for humans", Version: "2.31.0"}},
+		},
+		{
+			name: "every term matches with and",
+			args: func(a *PackageSearchArgs) {
+				a.Query.Name = []string{"http"}
+				a.Query.Keywords = []string{"async"}
+			},
+			want: []PackageVersion{{Name: "httpx", Summary: "A next generation HTTP client", Version: "0.25.0"}},
+		},
+		{
+			name: "any term matches with or",
+			args: func(a *PackageSearchArgs) {
+				a.Query.Name = []string{"toolbox"}
+				a.Query.Author = []string{"reitz"}
+			},
+			operator: "or",
+			want: []PackageVersion{
+				{Name: "requests", Summary: "HTTP for humans", Version: "2.31.0"},
+				{Name: "toolbox", Summary: "Tools", Version: "1.0"},
+			},
+		},
+		{
+			name: "empty terms match nothing",
+			args: func(a *PackageSearchArgs) { a.Query.Name = []string{" "} },
+			want: []PackageVersion{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := &PackageSearchArgs{Operator: tt.operator}
+			tt.args(args)
+			reply := &PackageSearchReply{}
+			if err := search.Search(httptest.NewRequest("POST", "/RPC2", nil), args, reply); err != nil {
+				t.Fatalf("Failed to search, %s", err)
+			}
+			if !reflect.DeepEqual(reply.Packages, tt.want) {
+				t.Errorf("packages are %+v, want %+v", reply.Packages, tt.want)
+			}
+		})
+	}
+
+	if err := search.Search(httptest.NewRequest("POST", "/RPC2", nil), &PackageSearchArgs{Operator: "xor"}, &PackageSearchReply{}); err == nil {
+		t.Error("searching with an unsupported operator succeeded")
+	}
+}
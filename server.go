@@ -1,17 +1,20 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 
 	"github.com/gorilla/rpc"
@@ -26,27 +29,111 @@ type server struct {
 	router    *mux.Router
 	rpc       *rpc.Server
 	s3cfg     s3Config
-	packages  packageMap
+	index     *packageIndex
+	indexMu   sync.Mutex
+	search    *searchIndex
+	changelog *changelog
+	journalMu sync.Mutex
+	// unrecorded are changes that couldn't be written to the journal yet, oldest first
+	unrecorded []journalEntry
+	// replica identifies this server in the journal entries it writes
+	replica  string
+	refresh  refreshState
+	stats    *downloadStats
+	statsMu  sync.Mutex
+	totals   downloadTotals
+	accessMu sync.Mutex
+	// reindexJob is the reindex started from the admin API
+	reindexJob reindexJob
+	passwords  passwordCache
+	metrics    *metrics
+	// background tracks the loops started by runBackground
+	background sync.WaitGroup
+	// draining is set once gopi starts shutting down
+	draining  atomic.Bool
 	s3        *minio.Client
 	templates *template.Template
+	// ui holds the templates and assets, see uiFS
+	ui fs.FS
+
+	cfg serverConfig
 }
 
-func newServer(s3cfg s3Config) (*server, error) {
-	s := &server{}
-	var err error
+// Download modes
+const (
+	// downloadRedirect redirects clients to a presigned S3 URL
+	downloadRedirect = "redirect"
+	// downloadStream streams files from S3 through gopi
+	downloadStream = "stream"
+)
 
-	err = s.parseTemplates()
+// serverConfig holds the settings of the gopi server itself
+type serverConfig struct {
+	// adminToken is the bearer token required by the /admin endpoints, they are disabled if it's empty
+	adminToken string
+	// downloadMode is either downloadRedirect or downloadStream
+	downloadMode string
+	// maxUploadSize is the largest upload request accepted in bytes, 0 means no limit
+	maxUploadSize int64
+	// allowOverwrite lets uploads replace existing files and reuse the names of deleted ones
+	allowOverwrite bool
+	// readers and uploaders are the identities allowed to read and upload
+	// packages, anyone may if they're empty
+	readers   []string
+	uploaders []string
+	// users maps user names to bcrypt password hashes
+	users map[string][]byte
+	// identified is set when clients can identify themselves, with passwords
+	// or client certificates, anonymous uploads can't create projects then
+	identified bool
+	// themeDir overrides the built-in templates and assets, see uiFS
+	themeDir string
+}
+
+// newStorageServer returns a server connected to S3 with an empty index and
+// no routes. It's used as is by the maintenance commands.
+func newStorageServer(s3cfg s3Config) (*server, error) {
+	s := &server{
+		s3cfg:     s3cfg,
+		index:     newPackageIndex(),
+		search:    newSearchIndex(),
+		changelog: newChangelog(),
+		replica:   newRequestID(),
+		stats:     newDownloadStats(),
+		metrics:   newMetrics(),
+	}
+	err := s.S3Connect()
 	if err != nil {
 		return s, err
 	}
+	return s, nil
+}
 
+func newServer(s3cfg s3Config, cfg serverConfig) (*server, error) {
 	// Make sure we connect to S3 before we start router as it depends on S3 connections
-	s.s3cfg = s3cfg
-	err = s.S3Connect()
+	s, err := newStorageServer(s3cfg)
 	if err != nil {
 		return s, err
 	}
-	s.packages = make(packageMap)
+	s.cfg = cfg
+	s.metrics.registerIndexMetrics(s)
+	ctx := context.Background()
+
+	s.ui = uiFS(cfg.themeDir)
+	err = s.parseTemplates()
+	if err != nil {
+		return s, err
+	}
+
+	err = s.loadIndex(ctx)
+	if err != nil {
+		return s, fmt.Errorf("Failed to load package index, %s", err.Error())
+	}
+	s.buildSearchIndex(ctx)
+	err = s.loadJournal(ctx)
+	if err != nil {
+		return s, fmt.Errorf("Failed to load journal, %s", err.Error())
+	}
 
 	r := mux.NewRouter()
 	p := rpc.NewServer()
@@ -56,6 +143,10 @@ func newServer(s3cfg s3Config) (*server, error) {
 
 	p.RegisterCodec(xmlrpcCodec, "text/xml")
 	p.RegisterService(newXMLSearch(s), "")
+	p.RegisterService(newXMLChangelog(s), "")
+	xmlrpcCodec.RegisterAlias("changelog", "XMLChangelog.Changelog")
+	xmlrpcCodec.RegisterAlias("changelog_last_serial", "XMLChangelog.LastSerial")
+	xmlrpcCodec.RegisterAlias("changelog_since_serial", "XMLChangelog.SinceSerial")
 	s.router = r
 	s.rpc = p
 	s.routes()
@@ -64,8 +155,7 @@ func newServer(s3cfg s3Config) (*server, error) {
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	loggedRouter := handlers.CombinedLoggingHandler(os.Stdout, s.router)
-	loggedRouter.ServeHTTP(w, r)
+	logRequests(s.router).ServeHTTP(w, r)
 }
 
 func (s *server) S3Connect() error {
@@ -95,7 +185,7 @@ func (s *server) S3Connect() error {
 		},
 		&credentials.EnvMinio{},
 	}
-	if accessKey != "" && secretKey != "" {
+	if s.s3cfg.accessKey != "" && s.s3cfg.secretKey != "" {
 		defaultAWSCredProviders = []credentials.Provider{
 			&credentials.Static{
 				Value: credentials.Value{
@@ -119,6 +209,13 @@ func (s *server) S3Connect() error {
 	if err != nil {
 		return err
 	}
+	proxy, err := s.s3cfg.proxyFunc()
+	if err != nil {
+		return err
+	}
+	transport := minio.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	client.SetCustomTransport(conditionalTransport{transport})
 	s.s3 = client
 	return nil
 }
@@ -144,10 +241,89 @@ func NewCustomHTTPTransport() *http.Transport {
 }
 
 func (s *server) parseTemplates() error {
-	templates, err := template.ParseGlob("templates/*.tpl.html")
+	assets, err := loadVendorAssets(s.ui)
+	if err != nil {
+		return err
+	}
+	templates, err := template.New("").Funcs(templateFuncs(assets)).ParseFS(s.ui, "templates/*.tpl.html")
 	if err != nil {
 		return fmt.Errorf("Failed to parse templates, %s", err.Error())
 	}
 	s.templates = templates
 	return nil
 }
+
+// runBackground starts refreshing the index every refreshInterval, unless
+// it's 0, writing the download stats every statsInterval and indexing the
+// projects that haven't been loaded for search until ctx is done
+func (s *server) runBackground(ctx context.Context, refreshInterval, statsInterval time.Duration) {
+	s.refresh.mu.Lock()
+	s.refresh.interval = refreshInterval
+	s.refresh.mu.Unlock()
+	if refreshInterval > 0 {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.watchIndex(ctx, refreshInterval)
+		}()
+	}
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.writeStatsEvery(ctx, statsInterval)
+	}()
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.retryJournalEvery(ctx, journalRetryInterval)
+	}()
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.indexUnloadedProjectsUntilDone(ctx, searchIndexRetryInterval)
+	}()
+}
+
+// shutdown fails the readiness check and keeps serving for drain so load
+// balancers stop sending new requests, then stops accepting connections and
+// gives in-flight requests up to grace to finish, 0 waiting for as long as
+// they take. The background loops are stopped with stopBackground, a reindex
+// that's running is waited for and the download stats counted since the last
+// flush are written to the bucket.
+func (s *server) shutdown(srv *http.Server, drain, grace time.Duration, stopBackground context.CancelFunc) error {
+	s.draining.Store(true)
+	if drain > 0 {
+		slog.Info("Shutting down, draining before closing connections", "drain", drain)
+		time.Sleep(drain)
+	}
+	slog.Info("Shutting down, waiting for in-flight requests to finish", "grace_period", grace)
+	ctx := context.Background()
+	if grace > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, grace)
+		defer cancel()
+	}
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("In-flight requests didn't finish in time, closing their connections", "err", err)
+		srv.Close()
+	}
+
+	stopBackground()
+	s.background.Wait()
+	// Handlers can outlive closed connections, wait for any index or
+	// journal write they're in the middle of
+	s.indexMu.Lock()
+	s.indexMu.Unlock()
+	err = s.retryJournal(context.Background())
+	if err != nil {
+		slog.Error("Failed to record changes in journal, mirrors won't see them", "err", err)
+	}
+
+	err = s.flushStats(context.Background())
+	if err != nil {
+		return err
+	}
+	slog.Info("Shut down")
+	return nil
+}
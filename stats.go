@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// statsPrefix is where the download counts of each project are stored
+	statsPrefix = internalPrefix + "stats/"
+
+	// knownInstallers are matched against the start of user agents without linehaul data
+	knownInstallers = []string{"pip", "uv", "poetry", "pdm", "pipenv", "pex", "bandersnatch", "devpi", "twine", "setuptools", "python-requests", "curl", "wget"}
+	pythonUAVersion = regexp.MustCompile(`(?i)(?:c?python)/(\d+\.\d+)`)
+	pythonVersionRe = regexp.MustCompile(`^(\d+\.\d+)`)
+)
+
+// fileStats counts the downloads of a single file
+type fileStats struct {
+	Version    string         `json:"version"`
+	Total      int            `json:"total"`
+	Days       map[string]int `json:"days"`
+	Installers map[string]int `json:"installers"`
+	Python     map[string]int `json:"python"`
+}
+
+// projectStats counts the downloads of every file of a project
+type projectStats struct {
+	Total int                   `json:"total"`
+	Files map[string]*fileStats `json:"files"`
+}
+
+func newProjectStats() *projectStats {
+	return &projectStats{Files: make(map[string]*fileStats)}
+}
+
+// add merges the counts of other into ps
+func (ps *projectStats) add(other *projectStats) {
+	ps.Total += other.Total
+	for name, o := range other.Files {
+		f, ok := ps.Files[name]
+		if !ok {
+			f = &fileStats{
+				Days:       make(map[string]int),
+				Installers: make(map[string]int),
+				Python:     make(map[string]int),
+			}
+			ps.Files[name] = f
+		}
+		f.Version = o.Version
+		f.Total += o.Total
+		addCounts(f.Days, o.Days)
+		addCounts(f.Installers, o.Installers)
+		addCounts(f.Python, o.Python)
+	}
+}
+
+func addCounts(dst, src map[string]int) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+// File returns the stats of a file, used by the templates
+func (ps *projectStats) File(name string) fileStats {
+	if f, ok := ps.Files[name]; ok {
+		return *f
+	}
+	return fileStats{}
+}
+
+// Versions returns the number of downloads per version
+func (ps *projectStats) Versions() map[string]int {
+	versions := make(map[string]int)
+	for _, f := range ps.Files {
+		versions[f.Version] += f.Total
+	}
+	return versions
+}
+
+// LastDownload returns the last day the project has been downloaded, empty if it never has been
+func (ps *projectStats) LastDownload() string {
+	last := ""
+	for _, f := range ps.Files {
+		for day := range f.Days {
+			if day > last {
+				last = day
+			}
+		}
+	}
+	return last
+}
+
+// download describes a single download for the stats
+type download struct {
+	project   string
+	version   string
+	file      string
+	day       string
+	installer string
+	python    string
+}
+
+// downloadStats holds the downloads counted since the stats were last written to the bucket
+type downloadStats struct {
+	mu      sync.Mutex
+	pending map[string]*projectStats
+}
+
+func newDownloadStats() *downloadStats {
+	return &downloadStats{pending: make(map[string]*projectStats)}
+}
+
+func (ds *downloadStats) count(d download) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ps, ok := ds.pending[d.project]
+	if !ok {
+		ps = newProjectStats()
+		ds.pending[d.project] = ps
+	}
+	ps.add(&projectStats{
+		Total: 1,
+		Files: map[string]*fileStats{
+			d.file: {
+				Version:    d.version,
+				Total:      1,
+				Days:       map[string]int{d.day: 1},
+				Installers: map[string]int{d.installer: 1},
+				Python:     map[string]int{d.python: 1},
+			},
+		},
+	})
+}
+
+// take returns and clears the pending counts
+func (ds *downloadStats) take() map[string]*projectStats {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	pending := ds.pending
+	ds.pending = make(map[string]*projectStats)
+	return pending
+}
+
+// peek returns a copy of the pending counts of a project
+func (ds *downloadStats) peek(name string) *projectStats {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ps := newProjectStats()
+	if pending, ok := ds.pending[name]; ok {
+		ps.add(pending)
+	}
+	return ps
+}
+
+// summaries returns the pending number of downloads and the last download day of every project
+func (ds *downloadStats) summaries() map[string]projectDownloads {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	summaries := make(map[string]projectDownloads, len(ds.pending))
+	for name, ps := range ds.pending {
+		summaries[name] = newProjectDownloads(name, ps)
+	}
+	return summaries
+}
+
+// putBack returns counts that couldn't be written so they're retried on the next flush
+func (ds *downloadStats) putBack(name string, ps *projectStats) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	pending, ok := ds.pending[name]
+	if !ok {
+		pending = newProjectStats()
+		ds.pending[name] = pending
+	}
+	pending.add(ps)
+}
+
+// classifyUserAgent returns the installer and Python version (major.minor)
+// of a download. pip, uv and other modern installers append linehaul JSON
+// after their name and version, others are matched on their name.
+func classifyUserAgent(ua string) (string, string) {
+	if i := strings.Index(ua, "{"); i >= 0 {
+		var linehaul struct {
+			Installer struct {
+				Name string `json:"name"`
+			} `json:"installer"`
+			Python string `json:"python"`
+		}
+		if err := json.Unmarshal([]byte(ua[i:]), &linehaul); err == nil && linehaul.Installer.Name != "" {
+			python := "unknown"
+			if m := pythonVersionRe.FindStringSubmatch(linehaul.Python); m != nil {
+				python = m[1]
+			}
+			return strings.ToLower(linehaul.Installer.Name), python
+		}
+	}
+
+	python := "unknown"
+	if m := pythonUAVersion.FindStringSubmatch(ua); m != nil {
+		python = m[1]
+	}
+	lower := strings.ToLower(ua)
+	for _, installer := range knownInstallers {
+		if strings.HasPrefix(lower, installer+"/") || strings.HasPrefix(lower, installer+" ") {
+			return installer, python
+		}
+	}
+	if strings.HasPrefix(lower, "mozilla/") {
+		return "browser", python
+	}
+	return "other", python
+}
+
+// newProjectDownloads summarises the download counts of a project
+func newProjectDownloads(name string, ps *projectStats) projectDownloads {
+	return projectDownloads{Name: name, Total: ps.Total, LastDownload: ps.LastDownload()}
+}
+
+func statsKey(name string) string {
+	return statsPrefix + name + ".json"
+}
+
+// readStats reads the stored download counts of a project
+func (s *server) readStats(ctx context.Context, name string) (*projectStats, error) {
+	data, err := s.getObject(ctx, statsKey(name))
+	if errors.Is(err, NoSuchKey) {
+		return newProjectStats(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseStats(name, data)
+}
+
+// parseStats parses the stored download counts of a project, nil data being no downloads
+func parseStats(name string, data []byte) (*projectStats, error) {
+	ps := newProjectStats()
+	if data == nil {
+		return ps, nil
+	}
+	err := json.Unmarshal(data, ps)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, %s", statsKey(name), err.Error())
+	}
+	if ps.Files == nil {
+		ps.Files = make(map[string]*fileStats)
+	}
+	return ps, nil
+}
+
+// projectStats returns the stored download counts of a project plus the ones that haven't been written yet
+func (s *server) projectStats(ctx context.Context, name string) (*projectStats, error) {
+	ps, err := s.readStats(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ps.add(s.stats.peek(name))
+	return ps, nil
+}
+
+// countDownload records a download of p for the stats
+func (s *server) countDownload(p pkg, userAgent string) {
+	installer, python := classifyUserAgent(userAgent)
+	s.stats.count(download{
+		project:   p.Name,
+		version:   p.Version,
+		file:      p.FileName,
+		day:       time.Now().UTC().Format("2006-01-02"),
+		installer: installer,
+		python:    python,
+	})
+}
+
+// flushStats adds the pending download counts to the ones stored in the bucket.
+// Other replicas flush their counts to the same objects, so they're only
+// written if they haven't changed since they were read. Counts that fail to
+// be written are kept for the next flush.
+func (s *server) flushStats(ctx context.Context) error {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	var failed []string
+	for name, pending := range s.stats.take() {
+		var stored *projectStats
+		err := s.updateObject(ctx, statsKey(name), "application/json", func(data []byte) ([]byte, error) {
+			var err error
+			stored, err = parseStats(name, data)
+			if err != nil {
+				return nil, err
+			}
+			stored.add(pending)
+			return json.Marshal(stored)
+		})
+		if err == nil {
+			s.totals.set(name, stored)
+		} else {
+			s.stats.putBack(name, pending)
+			failed = append(failed, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("Failed to write download stats, %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// writeStatsEvery flushes the download counts to the bucket every interval until ctx is done
+func (s *server) writeStatsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.flushStats(ctx)
+			if err != nil {
+				logger(ctx).Error("Failed to flush download stats", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassifyUserAgent(t *testing.T) {
+	tests := []struct {
+		ua            string
+		wantInstaller string
+		wantPython    string
+	}{
+		{
+			ua:            `pip/23.3.1 {"installer":{"name":"pip","version":"23.3.1"},"python":"3.11.6","implementation":{"name":"CPython"}}`,
+			wantInstaller: "pip",
+			wantPython:    "3.11",
+		},
+		{
+			ua:            `uv/0.1.24 {"installer":{"name":"uv","version":"0.1.24"},"python":"3.12.2"}`,
+			wantInstaller: "uv",
+			wantPython:    "3.12",
+		},
+		{
+			ua:            `pip/9.0.1 {"installer":{"name":"pip"}}`,
+			wantInstaller: "pip",
+			wantPython:    "unknown",
+		},
+		{
+			ua:            "poetry/1.7.1 CPython/3.10.12 Linux/6.5.0",
+			wantInstaller: "poetry",
+			wantPython:    "3.10",
+		},
+		{
+			ua:            "python-requests/2.31.0",
+			wantInstaller: "python-requests",
+			wantPython:    "unknown",
+		},
+		{
+			ua:            "curl/8.4.0",
+			wantInstaller: "curl",
+			wantPython:    "unknown",
+		},
+		{
+			ua:            "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0",
+			wantInstaller: "browser",
+			wantPython:    "unknown",
+		},
+		{
+			ua:            "pipx/1.2.0",
+			wantInstaller: "other",
+			wantPython:    "unknown",
+		},
+		{
+			ua:            "",
+			wantInstaller: "other",
+			wantPython:    "unknown",
+		},
+	}
+	for _, tt := range tests {
+		installer, python := classifyUserAgent(tt.ua)
+		if installer != tt.wantInstaller || python != tt.wantPython {
+			t.Errorf("classifyUserAgent(%q) is %s, %s, want %s, %s", tt.ua, installer, python, tt.wantInstaller, tt.wantPython)
+		}
+	}
+}
+
+func TestFlushStats(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	p := testPkg("demo-1.0.tar.gz", "1.0", "")
+	s.countDownload(p, "pip/23.3.1")
+	s.countDownload(p, "curl/8.4.0")
+	if err := s.flushStats(ctx); err != nil {
+		t.Fatalf("Failed to flush stats, %s", err)
+	}
+	s.countDownload(p, "pip/23.3.1")
+	if err := s.flushStats(ctx); err != nil {
+		t.Fatalf("Failed to flush stats, %s", err)
+	}
+
+	stored, err := s.readStats(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read stats, %s", err)
+	}
+	if stored.Total != 3 {
+		t.Errorf("stored total is %d, want 3", stored.Total)
+	}
+	if got := stored.File(p.FileName).Installers["pip"]; got != 2 {
+		t.Errorf("stored pip downloads are %d, want 2", got)
+	}
+	if got := s.stats.peek("demo").Total; got != 0 {
+		t.Errorf("%d downloads are still pending after flushing, want 0", got)
+	}
+
+	f.denyPut = func(key string) bool { return key == statsKey("demo") }
+	s.countDownload(p, "pip/23.3.1")
+	if err := s.flushStats(ctx); err == nil {
+		t.Fatal("Flushing stats succeeded although they couldn't be written")
+	}
+	if got := s.stats.peek("demo").Total; got != 1 {
+		t.Errorf("%d downloads are pending after a failed flush, want them kept for the next one", got)
+	}
+}
+
+func TestFlushStatsKeepsConcurrentCounts(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	replica := newReplica(t, f, serverConfig{})
+	p := testPkg("demo-1.0.tar.gz", "1.0", "")
+	s.countDownload(p, "pip/23.3.1")
+	replica.countDownload(p, "pip/23.3.1")
+	replica.countDownload(p, "pip/23.3.1")
+
+	// The replica flushes its counts between the read and the write of the first server
+	f.beforePut = func(key string) {
+		if key != statsKey("demo") {
+			return
+		}
+		f.beforePut = nil
+		if err := replica.flushStats(ctx); err != nil {
+			t.Errorf("Failed to flush the stats of the replica, %s", err)
+		}
+	}
+	if err := s.flushStats(ctx); err != nil {
+		t.Fatalf("Failed to flush stats, %s", err)
+	}
+
+	stored, err := s.readStats(ctx, "demo")
+	if err != nil {
+		t.Fatalf("Failed to read stats, %s", err)
+	}
+	if stored.Total != 3 {
+		t.Errorf("stored total is %d, want the 3 downloads counted by both servers", stored.Total)
+	}
+}
+
+func TestStatsOverviewUsesCachedTotals(t *testing.T) {
+	ctx := context.Background()
+	s, f := newTestServer(t, serverConfig{})
+	p := testPkg("demo-1.0.tar.gz", "1.0", "")
+	if err := s.addPackage(ctx, p); err != nil {
+		t.Fatalf("Failed to add package, %s", err)
+	}
+	s.countDownload(p, "pip/23.3.1")
+	if err := s.flushStats(ctx); err != nil {
+		t.Fatalf("Failed to flush stats, %s", err)
+	}
+
+	overview := func() projectDownloads {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+		var body struct {
+			Projects []projectDownloads `json:"projects"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body.Projects) != 1 {
+			t.Fatalf("/stats returned %d %q, want one project", w.Code, w.Body.String())
+		}
+		return body.Projects[0]
+	}
+	if got := overview(); got.Total != 1 || got.LastDownload == "" {
+		t.Errorf("overview is %+v, want 1 download with its day", got)
+	}
+
+	// Once read the totals come from the cache and the downloads that haven't been flushed
+	f.denyGet = func(key string) bool { return key == statsKey("demo") }
+	s.countDownload(p, "pip/23.3.1")
+	if got := overview(); got.Total != 2 {
+		t.Errorf("overview total is %d, want 2", got.Total)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client certificate modes
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate in certFile and keyFile, reloading it
+// when either file changes so rotated certificates are picked up without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	err = cr.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// latestModTime returns when the certificate or key was last changed
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, fmt.Errorf("Failed to read TLS certificate, %s", err.Error())
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load TLS certificate, %s", err.Error())
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If the new files
+// can't be loaded, e.g. because only one of them has been replaced so far,
+// the previous certificate is kept.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.lastCheck) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.lastCheck = time.Now()
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		slog.Error("Failed to check TLS certificate for changes", "err", err)
+		return cr.cert, nil
+	}
+	if modTime.Equal(cr.modTime) {
+		return cr.cert, nil
+	}
+	err = cr.load(modTime)
+	if err != nil {
+		slog.Error("Failed to reload TLS certificate, keeping the previous one", "err", err)
+		return cr.cert, nil
+	}
+	slog.Info("Reloaded TLS certificate", "cert", cr.certFile)
+	return cr.cert, nil
+}
+
+// newTLSConfig returns the TLS config of the server, or nil if TLS isn't configured
+func newTLSConfig(c tlsSection) (*tls.Config, error) {
+	if c.CertFile == "" {
+		return nil, nil
+	}
+	cr, err := newCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+	if c.ClientCAFile == "" || c.ClientAuth == clientAuthNone {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read client CA file, %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in client CA file %s", c.ClientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.ClientAuth == clientAuthRequire {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
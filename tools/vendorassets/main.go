@@ -0,0 +1,105 @@
+// Command vendorassets downloads the third party files listed in
+// assets/vendor/vendor.json next to it so they're embedded in gopi and the
+// web UI works without access to the CDNs. Every file is checked against its
+// integrity hash, the same one the browser checks. It's run by `go generate`
+// from the root of the repo.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const manifest = "assets/vendor/vendor.json"
+
+type vendorAsset struct {
+	File      string `json:"file"`
+	URL       string `json:"url"`
+	Integrity string `json:"integrity"`
+}
+
+func main() {
+	b, err := os.ReadFile(manifest)
+	if err != nil {
+		log.Fatalf("Failed to read vendor manifest, %s", err.Error())
+	}
+	var assets []vendorAsset
+	err = json.Unmarshal(b, &assets)
+	if err != nil {
+		log.Fatalf("Failed to parse vendor manifest, %s", err.Error())
+	}
+	client := &http.Client{Timeout: time.Minute}
+	dir := filepath.Dir(manifest)
+	for _, a := range assets {
+		dest := filepath.Join(dir, a.File)
+		if existing, err := os.ReadFile(dest); err == nil && verify(existing, a.Integrity) == nil {
+			continue
+		}
+		data, err := download(client, a.URL)
+		if err != nil {
+			log.Fatalf("Failed to download %s, %s", a.URL, err.Error())
+		}
+		err = verify(data, a.Integrity)
+		if err != nil {
+			log.Fatalf("Refusing to vendor %s, %s", a.URL, err.Error())
+		}
+		err = os.WriteFile(dest, data, 0644)
+		if err != nil {
+			log.Fatalf("Failed to write %s, %s", dest, err.Error())
+		}
+		log.Printf("Vendored %s as %s", a.URL, dest)
+	}
+}
+
+func download(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// verify checks data against a subresource integrity value such as "sha384-..."
+func verify(data []byte, integrity string) error {
+	algo, want, ok := strings.Cut(integrity, "-")
+	if !ok {
+		return fmt.Errorf("invalid integrity %q", integrity)
+	}
+	var h hash.Hash
+	switch algo {
+	case "sha256":
+		h = sha256.New()
+	case "sha384":
+		h = sha512.New384()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported integrity algorithm %q", algo)
+	}
+	h.Write(data)
+	got := h.Sum(nil)
+	wantSum, err := base64.StdEncoding.DecodeString(want)
+	if err != nil {
+		return fmt.Errorf("invalid integrity %q", integrity)
+	}
+	if !bytes.Equal(got, wantSum) {
+		return fmt.Errorf("integrity mismatch, got %s-%s", algo, base64.StdEncoding.EncodeToString(got))
+	}
+	return nil
+}
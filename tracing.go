@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates gopi's spans. Until setupTracing is called it's backed by
+// the no-op provider of the otel package so tracing costs next to nothing.
+var tracer = otel.Tracer("github.com/leosunmo/gopi")
+
+// setupTracing exports spans over OTLP/HTTP to the collector at endpoint,
+// e.g. "http://otel-collector:4318". The returned function flushes and stops
+// the exporter.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create OTLP exporter, %s", err.Error())
+	}
+	return useSpanExporter(exporter).Shutdown, nil
+}
+
+// useSpanExporter installs a tracer provider sending spans to exporter and
+// returns it. Tests can pass an in-memory exporter.
+func useSpanExporter(exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "gopi"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider
+}
+
+func init() {
+	// Honour traceparent headers even when gopi doesn't export spans itself,
+	// so the trace context of requests still reaches the logs
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// startSpan starts a span for one of gopi's own operations
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan marks span as failed if err is set and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// rpcAttrs describes an XML-RPC call to method on a span
+func rpcAttrs(method string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("rpc.system", "xmlrpc"),
+		attribute.String("rpc.method", method),
+	}
+}
+
+// traceRequest continues the trace of an incoming traceparent header, if
+// any, in a server span named after route
+func traceRequest(r *http.Request, route string) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("user_agent.original", r.UserAgent()),
+		),
+	)
+	return r.WithContext(ctx), span
+}
+
+// endRequestSpan records the status code of a request on its span and ends it
+func endRequestSpan(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	testTracing  sync.Once
+	testExporter *tracetest.InMemoryExporter
+	testProvider *sdktrace.TracerProvider
+)
+
+// useTestExporter installs an in-memory exporter the first time it's called,
+// the global tracer provider can only be set once
+func useTestExporter() (*tracetest.InMemoryExporter, *sdktrace.TracerProvider) {
+	testTracing.Do(func() {
+		testExporter = tracetest.NewInMemoryExporter()
+		testProvider = useSpanExporter(testExporter)
+	})
+	return testExporter, testProvider
+}
+
+func spanAttr(s tracetest.SpanStub, key string) attribute.Value {
+	for _, a := range s.Attributes {
+		if string(a.Key) == key {
+			return a.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// findSpan returns the first span called name, with the storage key if one is given
+func findSpan(spans tracetest.SpanStubs, name, key string) (tracetest.SpanStub, bool) {
+	for _, s := range spans {
+		if s.Name == name && (key == "" || spanAttr(s, "gopi.storage.key").AsString() == key) {
+			return s, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func TestTracing(t *testing.T) {
+	exporter, provider := useTestExporter()
+	s, _ := newTestServer(t, serverConfig{})
+	ctx := context.Background()
+	if err := s.addPackage(ctx, testPkg("demo-1.0.tar.gz", "1.0", "first")); err != nil {
+		t.Fatalf("Failed to add package, %s", err)
+	}
+	provider.ForceFlush(ctx)
+	exporter.Reset()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/simple/demo/", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /simple/demo/ returned %d", w.Code)
+	}
+
+	body := `<?xml version="1.0"?><methodCall><methodName>changelog_last_serial</methodName><params></params></methodCall>`
+	req = httptest.NewRequest("POST", "/RPC2", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/xml")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /RPC2 returned %d", w.Code)
+	}
+
+	if _, err := s.getObject(ctx, "demo/missing.tar.gz"); err == nil {
+		t.Fatalf("Getting a missing object succeeded")
+	}
+
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatalf("Failed to flush spans, %s", err)
+	}
+	spans := exporter.GetSpans()
+
+	tests := []struct {
+		span   string
+		key    string
+		kind   trace.SpanKind
+		attrs  map[string]string
+		parent string
+		failed bool
+	}{
+		{
+			span:  "simple",
+			kind:  trace.SpanKindServer,
+			attrs: map[string]string{"http.route": "simple", "http.request.method": "GET", "url.path": "/simple/demo/", "http.response.status_code": "200"},
+		},
+		{
+			span:  "rpc2",
+			kind:  trace.SpanKindServer,
+			attrs: map[string]string{"http.route": "rpc2", "http.request.method": "POST"},
+		},
+		{
+			span:   "rpc.changelog_last_serial",
+			kind:   trace.SpanKindInternal,
+			attrs:  map[string]string{"rpc.system": "xmlrpc", "rpc.method": "changelog_last_serial"},
+			parent: "rpc2",
+		},
+		{
+			span:   "storage.get",
+			key:    "demo/missing.tar.gz",
+			kind:   trace.SpanKindClient,
+			attrs:  map[string]string{"gopi.storage.operation": "get", "gopi.storage.bucket": testBucket, "gopi.storage.key": "demo/missing.tar.gz"},
+			failed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.span, func(t *testing.T) {
+			span, ok := findSpan(spans, tt.span, tt.key)
+			if !ok {
+				t.Fatalf("No %s span", tt.span)
+			}
+			if span.SpanKind != tt.kind {
+				t.Errorf("Span kind is %s, want %s", span.SpanKind, tt.kind)
+			}
+			for key, want := range tt.attrs {
+				if got := spanAttr(span, key).Emit(); got != want {
+					t.Errorf("Attribute %s is %q, want %q", key, got, want)
+				}
+			}
+			if tt.parent != "" {
+				parent, ok := findSpan(spans, tt.parent, "")
+				if !ok || span.Parent.SpanID() != parent.SpanContext.SpanID() {
+					t.Errorf("Span isn't a child of %s", tt.parent)
+				}
+			}
+			if failed := span.Status.Code.String() == "Error"; failed != tt.failed {
+				t.Errorf("Span status is %s, want failed %t", span.Status.Code, tt.failed)
+			}
+		})
+	}
+
+	if span, ok := findSpan(spans, "simple", ""); ok && span.SpanContext.TraceID().String() != traceID {
+		t.Errorf("Request span has trace ID %s, want the %s of the traceparent header", span.SpanContext.TraceID(), traceID)
+	}
+}
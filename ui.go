@@ -0,0 +1,204 @@
+package main
+
+//go:generate go run ./tools/vendorassets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// embeddedUI holds the templates and static assets built into the binary
+//
+//go:embed templates/*.tpl.html assets
+var embeddedUI embed.FS
+
+// vendorManifest lists the third party CSS and JavaScript used by the
+// templates. `go generate` downloads and verifies them next to it, they're
+// committed so every build embeds them.
+const vendorManifest = "assets/vendor/vendor.json"
+
+// uiFS returns the templates and assets of the web UI. Files in themeDir, laid
+// out like the templates and assets directories of the repo, replace the
+// built-in ones of the same name.
+func uiFS(themeDir string) fs.FS {
+	if themeDir == "" {
+		return embeddedUI
+	}
+	return overlayFS{upper: os.DirFS(themeDir), lower: embeddedUI}
+}
+
+// overlayFS serves files from upper, falling back to lower for the ones it doesn't have
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return o.lower.Open(name)
+}
+
+// ReadDir merges the entries of both directories so globbing sees every template
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries := map[string]fs.DirEntry{}
+	var found bool
+	for _, fsys := range []fs.FS{o.lower, o.upper} {
+		dir, err := fs.ReadDir(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, e := range dir {
+			entries[e.Name()] = e
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	merged := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		merged = append(merged, e)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name() < merged[j].Name() })
+	return merged, nil
+}
+
+// vendorAsset is a third party file included by the templates
+type vendorAsset struct {
+	File      string `json:"file"`
+	URL       string `json:"url"`
+	Integrity string `json:"integrity"`
+}
+
+// loadVendorAssets reads the vendor manifest from ui. Every asset is served
+// from /assets, see verifyVendorAssets.
+func loadVendorAssets(ui fs.FS) (map[string]vendorAsset, error) {
+	list, err := readVendorManifest(ui)
+	if err != nil {
+		return nil, err
+	}
+	assets := make(map[string]vendorAsset, len(list))
+	for _, a := range list {
+		a.URL = "/" + path.Join(path.Dir(vendorManifest), a.File)
+		assets[a.File] = a
+	}
+	return assets, nil
+}
+
+// verifyVendorAssets checks that every vendored file is in ui and matches its
+// integrity hash. gopi doesn't start without them, browsers would refuse to
+// use the files and the UI would break.
+func verifyVendorAssets(ui fs.FS) error {
+	list, err := readVendorManifest(ui)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, a := range list {
+		local := path.Join(path.Dir(vendorManifest), a.File)
+		data, err := fs.ReadFile(ui, local)
+		if err == nil {
+			err = checkIntegrity(data, a.Integrity)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("vendored %s: %s", local, err.Error()))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Vendored UI files are missing or changed, run go generate:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func readVendorManifest(ui fs.FS) ([]vendorAsset, error) {
+	b, err := fs.ReadFile(ui, vendorManifest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read vendor manifest, %s", err.Error())
+	}
+	var list []vendorAsset
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse vendor manifest, %s", err.Error())
+	}
+	return list, nil
+}
+
+// checkIntegrity checks data against a subresource integrity value such as
+// "sha384-...", the same check the browser makes before using the file
+func checkIntegrity(data []byte, integrity string) error {
+	algo, want, ok := strings.Cut(integrity, "-")
+	if !ok {
+		return fmt.Errorf("invalid integrity %q", integrity)
+	}
+	var h hash.Hash
+	switch algo {
+	case "sha256":
+		h = sha256.New()
+	case "sha384":
+		h = sha512.New384()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported integrity algorithm %q", algo)
+	}
+	h.Write(data)
+	wantSum, err := base64.StdEncoding.DecodeString(want)
+	if err != nil {
+		return fmt.Errorf("invalid integrity %q", integrity)
+	}
+	if !bytes.Equal(h.Sum(nil), wantSum) {
+		return errors.New("integrity mismatch")
+	}
+	return nil
+}
+
+// templateFuncs are the functions available to the templates
+func templateFuncs(assets map[string]vendorAsset) template.FuncMap {
+	return template.FuncMap{
+		// vendor returns the URL and integrity hash of a vendored file
+		"vendor": func(file string) (vendorAsset, error) {
+			a, ok := assets[file]
+			if !ok {
+				return a, fmt.Errorf("%s is not in %s", file, vendorManifest)
+			}
+			return a, nil
+		},
+		"filesize": formatSize,
+	}
+}
+
+// formatSize formats a file size in bytes for people, e.g. 1.5 MB
+func formatSize(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "kMGTPE"[exp])
+}
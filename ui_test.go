@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestVendorAssets(t *testing.T) {
+	good := []byte("body{}")
+	sum := sha512.Sum384(good)
+	integrity := "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+	manifest := `[
+		{"file": "good.css", "url": "https://cdn.example.com/good.css", "integrity": "` + integrity + `"},
+		{"file": "stub.css", "url": "https://cdn.example.com/stub.css", "integrity": "` + integrity + `"},
+		{"file": "missing.css", "url": "https://cdn.example.com/missing.css", "integrity": "` + integrity + `"}
+	]`
+	ui := fstest.MapFS{
+		vendorManifest:           {Data: []byte(manifest)},
+		"assets/vendor/good.css": {Data: good},
+		"assets/vendor/stub.css": {Data: []byte("/* placeholder */")},
+	}
+
+	assets, err := loadVendorAssets(ui)
+	if err != nil {
+		t.Fatalf("loadVendorAssets() error = %s", err)
+	}
+	for _, file := range []string{"good.css", "stub.css", "missing.css"} {
+		if got, want := assets[file].URL, "/assets/vendor/"+file; got != want {
+			t.Errorf("%s is served from %q, want %q", file, got, want)
+		}
+		if got := assets[file].Integrity; got != integrity {
+			t.Errorf("%s has integrity %q, want %q", file, got, integrity)
+		}
+	}
+
+	err = verifyVendorAssets(ui)
+	if err == nil {
+		t.Fatal("verifyVendorAssets() succeeded with a missing and a changed file")
+	}
+	for _, want := range []string{"stub.css: integrity mismatch", "missing.css"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "good.css") {
+		t.Errorf("error %q mentions the file that matches its hash", err)
+	}
+
+	delete(ui, "assets/vendor/stub.css")
+	delete(ui, "assets/vendor/missing.css")
+	ui[vendorManifest] = &fstest.MapFile{Data: []byte(`[{"file": "good.css", "url": "https://cdn.example.com/good.css", "integrity": "` + integrity + `"}]`)}
+	if err := verifyVendorAssets(ui); err != nil {
+		t.Errorf("verifyVendorAssets() error = %s", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pep440Re matches the versions allowed by PEP 440, including the
+// alternative spellings pip accepts, https://peps.python.org/pep-0440/#appendix-b-parsing-version-strings-with-regular-expressions
+var pep440Re = regexp.MustCompile(`^v?` +
+	`(?:(\d+)!)?` + // epoch
+	`(\d+(?:\.\d+)*)` + // release
+	`(?:[-_.]?(a|b|c|rc|alpha|beta|pre|preview)[-_.]?(\d+)?)?` + // pre-release
+	`(?:-(\d+)|[-_.]?(post|rev|r)[-_.]?(\d+)?)?` + // post-release
+	`(?:[-_.]?(dev)[-_.]?(\d+)?)?` + // development release
+	`(?:\+([a-z0-9]+(?:[-_.][a-z0-9]+)*))?$`) // local version
+
+// Pre-release kinds in the order they sort in
+const (
+	preAlpha = iota
+	preBeta
+	preRC
+)
+
+// pep440Version is a parsed PEP 440 version
+type pep440Version struct {
+	epoch   uint64
+	release []uint64
+	hasPre  bool
+	preKind int
+	pre     uint64
+	hasPost bool
+	post    uint64
+	hasDev  bool
+	dev     uint64
+	local   []string
+}
+
+// parseVersion parses a PEP 440 version such as "1.0", "2.1.0rc1" or "1!3.0.post2+ubuntu.1"
+func parseVersion(s string) (pep440Version, error) {
+	var v pep440Version
+	m := pep440Re.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return v, fmt.Errorf("%q is not a PEP 440 version", s)
+	}
+	var err error
+	number := func(s string) uint64 {
+		if s == "" || err != nil {
+			return 0
+		}
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 64)
+		return n
+	}
+	v.epoch = number(m[1])
+	for _, part := range strings.Split(m[2], ".") {
+		v.release = append(v.release, number(part))
+	}
+	if m[3] != "" {
+		v.hasPre = true
+		switch m[3] {
+		case "a", "alpha":
+			v.preKind = preAlpha
+		case "b", "beta":
+			v.preKind = preBeta
+		default:
+			v.preKind = preRC
+		}
+		v.pre = number(m[4])
+	}
+	if m[5] != "" {
+		v.hasPost = true
+		v.post = number(m[5])
+	} else if m[6] != "" {
+		v.hasPost = true
+		v.post = number(m[7])
+	}
+	if m[8] != "" {
+		v.hasDev = true
+		v.dev = number(m[9])
+	}
+	if m[10] != "" {
+		v.local = strings.FieldsFunc(m[10], func(r rune) bool { return r == '-' || r == '_' || r == '.' })
+	}
+	if err != nil {
+		return v, fmt.Errorf("%q is not a PEP 440 version, %s", s, err.Error())
+	}
+	return v, nil
+}
+
+// compare returns -1, 0 or 1 if v is older, the same or newer than o
+func (v pep440Version) compare(o pep440Version) int {
+	if c := compareUint(v.epoch, o.epoch); c != 0 {
+		return c
+	}
+	// Trailing zeros don't count, 1.0 is the same as 1.0.0
+	for i := 0; i < len(v.release) || i < len(o.release); i++ {
+		var a, b uint64
+		if i < len(v.release) {
+			a = v.release[i]
+		}
+		if i < len(o.release) {
+			b = o.release[i]
+		}
+		if c := compareUint(a, b); c != 0 {
+			return c
+		}
+	}
+	if c := compareInts(v.preKey(), o.preKey()); c != 0 {
+		return c
+	}
+	if c := compareInts(v.postKey(), o.postKey()); c != 0 {
+		return c
+	}
+	if c := compareInts(v.devKey(), o.devKey()); c != 0 {
+		return c
+	}
+	return compareLocal(v.local, o.local)
+}
+
+// preKey orders the pre-release part. 1.0.dev1 comes before 1.0a1, which
+// comes before 1.0 itself.
+func (v pep440Version) preKey() []int64 {
+	switch {
+	case v.hasPre:
+		return []int64{0, int64(v.preKind), int64(v.pre)}
+	case v.hasDev && !v.hasPost:
+		return []int64{-1}
+	}
+	return []int64{1}
+}
+
+// postKey puts releases without a post-release before the ones with one
+func (v pep440Version) postKey() []int64 {
+	if !v.hasPost {
+		return []int64{-1}
+	}
+	return []int64{0, int64(v.post)}
+}
+
+// devKey puts development releases before the release they lead up to
+func (v pep440Version) devKey() []int64 {
+	if !v.hasDev {
+		return []int64{1}
+	}
+	return []int64{0, int64(v.dev)}
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareInts(a, b []int64) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return compareUint(uint64(len(a)), uint64(len(b)))
+}
+
+// compareLocal compares local version labels. Numeric segments sort after
+// alphanumeric ones and a longer label sorts after its prefix.
+func compareLocal(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		na, errA := strconv.ParseUint(a[i], 10, 64)
+		nb, errB := strconv.ParseUint(b[i], 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			if c := compareUint(na, nb); c != 0 {
+				return c
+			}
+		case errA == nil:
+			return 1
+		case errB == nil:
+			return -1
+		default:
+			if c := strings.Compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareUint(uint64(len(a)), uint64(len(b)))
+}
+
+// compareVersions returns -1, 0 or 1 if version a is older, the same or newer
+// than b in PEP 440 order. Versions that can't be parsed are older than any
+// that can and are compared as strings among themselves.
+func compareVersions(a, b string) int {
+	va, errA := parseVersion(a)
+	vb, errB := parseVersion(b)
+	switch {
+	case errA == nil && errB == nil:
+		return va.compare(vb)
+	case errA == nil:
+		return 1
+	case errB == nil:
+		return -1
+	}
+	return strings.Compare(a, b)
+}
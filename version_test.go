@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"v1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"2.0", "1.99.99", 1},
+		{"1!1.0", "2.0", 1},
+		{"1.0.dev1", "1.0a1", -1},
+		{"1.0a1", "1.0a2", -1},
+		{"1.0a2", "1.0b1", -1},
+		{"1.0b1", "1.0rc1", -1},
+		{"1.0c1", "1.0rc1", 0},
+		{"1.0rc1", "1.0", -1},
+		{"1.0alpha1", "1.0a1", 0},
+		{"1.0", "1.0.post1", -1},
+		{"1.0-1", "1.0.post1", 0},
+		{"1.0.post1.dev1", "1.0.post1", -1},
+		{"1.0.post1", "1.1.dev1", -1},
+		{"1.0", "1.0+local", -1},
+		{"1.0+abc", "1.0+1", -1},
+		{"1.0+ubuntu.1", "1.0+ubuntu.2", -1},
+		{"1.0+ubuntu", "1.0+ubuntu.1", -1},
+		{"1.0", "not a version", 1},
+		{"also not", "not a version", -1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := compareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// ChangelogArgs is the argument of the XML-RPC "changelog(since)" call,
+// since is a unix timestamp
+type ChangelogArgs struct {
+	Since int
+}
+
+// ChangelogSerialArgs is the argument of the XML-RPC "changelog_since_serial(serial)" call
+type ChangelogSerialArgs struct {
+	Serial int
+}
+
+// LastSerialArgs is the (empty) argument list of the XML-RPC "changelog_last_serial()" call
+type LastSerialArgs struct{}
+
+// LastSerialReply holds the serial of the latest change
+type LastSerialReply struct {
+	Serial int
+}
+
+// ChangelogReply holds a list of changes. Like PyPI every change is a list of
+// name, version, timestamp, action and, for changelog_since_serial, the serial.
+type ChangelogReply struct {
+	Changes [][]interface{}
+}
+
+type XMLChangelog struct {
+	server *server
+}
+
+func newXMLChangelog(server *server) *XMLChangelog {
+	return &XMLChangelog{
+		server: server,
+	}
+}
+
+func (h *XMLChangelog) Changelog(r *http.Request, args *ChangelogArgs, reply *ChangelogReply) error {
+	ctx, span := startSpan(r.Context(), "rpc.changelog", rpcAttrs("changelog")...)
+	defer span.End()
+	logger(ctx).Debug("Changelog", "since", args.Since)
+	reply.Changes = changelogTuples(h.server.changelog.sinceTime(time.Unix(int64(args.Since), 0)), false)
+	return nil
+}
+
+func (h *XMLChangelog) SinceSerial(r *http.Request, args *ChangelogSerialArgs, reply *ChangelogReply) error {
+	ctx, span := startSpan(r.Context(), "rpc.changelog_since_serial", rpcAttrs("changelog_since_serial")...)
+	defer span.End()
+	logger(ctx).Debug("Changelog since serial", "serial", args.Serial)
+	reply.Changes = changelogTuples(h.server.changelog.since(args.Serial), true)
+	return nil
+}
+
+func (h *XMLChangelog) LastSerial(r *http.Request, args *LastSerialArgs, reply *LastSerialReply) error {
+	_, span := startSpan(r.Context(), "rpc.changelog_last_serial", rpcAttrs("changelog_last_serial")...)
+	defer span.End()
+	reply.Serial = h.server.changelog.lastSerial()
+	return nil
+}
+
+func changelogTuples(entries []journalEntry, withSerial bool) [][]interface{} {
+	changes := make([][]interface{}, 0, len(entries))
+	for _, e := range entries {
+		change := []interface{}{e.Name, e.Version, int(e.Timestamp.Unix()), e.Action}
+		if withSerial {
+			change = append(change, e.Serial)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
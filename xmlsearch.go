@@ -1,16 +1,25 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
 
-	"github.com/minio/minio/pkg/console"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// PackageSearchArgs mirrors the PyPI XML-RPC "search(spec, operator)" call.
+// Every spec field is a list of terms, a package version matches a term if the
+// field contains it (case insensitive).
 type PackageSearchArgs struct {
 	Query struct {
-		Name    []string
-		Summary []string
+		Name        []string
+		Version     []string
+		Author      []string
+		Keywords    []string
+		Summary     []string
+		Description []string
+		Classifiers []string
 	}
 	Operator string
 }
@@ -36,53 +45,45 @@ func newXMLSearch(server *server) *XMLSearch {
 	}
 }
 
-func (h *XMLSearch) Search(r *http.Request, args *PackageSearchArgs, reply *PackageSearchReply) error {
-	console.Debugf("Query is: %+v\n", args)
-	nameQuery := args.Query.Name
-	summaryQuery := args.Query.Summary
-	ps := h.server.packages
-
-	matched := make(map[string]pkg, 0)
-
-	// First look for summaries and add all versions of the packages who's
-	// summary matches
-	matchingVersions := pkgs{}
-	for _, searchSummary := range summaryQuery {
-		for _, packageVersions := range ps {
-			for _, p := range packageVersions {
-				if strings.Contains(strings.ToLower(p.Summary), strings.ToLower(searchSummary)) {
-					matchingVersions = append(matchingVersions, p)
-				}
-			}
-		}
+func (h *XMLSearch) Search(r *http.Request, args *PackageSearchArgs, reply *PackageSearchReply) (err error) {
+	ctx, span := startSpan(r.Context(), "rpc.search", rpcAttrs("search")...)
+	defer func() { endSpan(span, err) }()
+	logger(ctx).Debug("Search", "query", fmt.Sprintf("%+v", args.Query), "operator", args.Operator)
+	operator := strings.ToLower(strings.TrimSpace(args.Operator))
+	if operator == "" {
+		operator = "and"
+	}
+	if operator != "and" && operator != "or" {
+		return fmt.Errorf("Unsupported search operator %q, must be \"and\" or \"or\"", args.Operator)
 	}
-	// From the list of matched package versions, get the latest matching version
-	latestMatchedVersions := matchingVersions.GetLatestVersionPackage()
-	matched[latestMatchedVersions.Name] = latestMatchedVersions
 
-	// Now search for a name match and overwrite the previous query if
-	// we find a name match instead.
-	for _, searchName := range nameQuery {
-		for packageName, packageVersions := range ps {
-			if strings.Contains(strings.ToLower(packageName), strings.ToLower(searchName)) {
-				matched[packageName] = packageVersions.GetLatestVersionPackage()
-			}
+	q := args.Query
+	var terms []fieldTerm
+	for field, values := range map[searchFieldID][]string{
+		fieldName:        q.Name,
+		fieldVersion:     q.Version,
+		fieldAuthor:      q.Author,
+		fieldKeywords:    q.Keywords,
+		fieldSummary:     q.Summary,
+		fieldDescription: q.Description,
+		fieldClassifiers: q.Classifiers,
+	} {
+		for _, v := range values {
+			terms = append(terms, fieldTerm{field: field, term: v})
 		}
 	}
-	if len(matched) == 0 {
-		return nil
-	}
+
 	replyPkgList := []PackageVersion{}
-	for _, p := range matched {
-		pv := PackageVersion{
+	for _, p := range h.server.search.query(terms, operator) {
+		replyPkgList = append(replyPkgList, PackageVersion{
 			Name:     p.Name,
 			Summary:  p.Summary,
 			Version:  p.Version,
 			Ordering: false,
-		}
-		replyPkgList = append(replyPkgList, pv)
+		})
 	}
 	reply.Packages = replyPkgList
-	console.Debugf("Reply is: %+v\n", reply)
+	span.SetAttributes(attribute.Int("gopi.search.results", len(reply.Packages)))
+	logger(ctx).Debug("Search results", "results", len(reply.Packages))
 	return nil
 }